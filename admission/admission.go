@@ -0,0 +1,215 @@
+package admission
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"tg-resize-sticker-images/storage"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	memorySampleInterval  = time.Second // How often memory usage is sampled
+	memoryRecoveryPercent = 80          // Memory shedding stops below this percentage of MaxMemoryMB
+	noticeInterval        = time.Minute // How often a chat is told its conversion was refused
+)
+
+// Errors returned when a conversion is refused
+var (
+	ErrMaintenance = errors.New("the bot is in maintenance mode")
+	ErrOverloaded  = errors.New("the bot is under high load")
+)
+
+// Thresholds for load shedding. A threshold of zero is disabled.
+type Limits struct {
+	MaxConversions int64  // Conversions in progress at once
+	MaxBacklog     int64  // Messages waiting in the send queue
+	MaxMemoryMB    uint64 // Memory in use by images, in megabytes
+}
+
+// The thresholds a config starts out with
+func DefaultLimits() Limits {
+	return Limits{
+		MaxConversions: 16,
+		MaxBacklog:     500,
+	}
+}
+
+// Maintenance mode, persisted so that it survives the restarts of a deploy
+type Maintenance struct {
+	Enabled bool   // Are conversions paused?
+	Message string // Notice shown to users, the default one if empty
+}
+
+// Decides whether conversions are admitted, based on maintenance mode and load
+type Controller struct {
+	path        string              // Path of the persisted maintenance state
+	limits      Limits              // Load shedding thresholds
+	maintenance Maintenance         // Maintenance mode
+	inFlight    int64               // Conversions in progress
+	shedding    bool                // Was the last conversion refused due to load?
+	memoryHigh  bool                // Is memory over the threshold, until it falls below the recovery level?
+	memoryUsage func() uint64       // Returns the memory in use, in bytes
+	memoryMB    uint64              // Last sampled memory in use
+	sampledAt   time.Time           // When memory was last sampled
+	noticeSent  map[int64]time.Time // When chats were last told their conversion was refused
+	mutex       sync.Mutex          // Mutex to avoid concurrent writes
+}
+
+// Creates a controller, restoring maintenance mode from path. The memory threshold is checked against
+// memoryUsage, which must go back down once images are released: unlike the resident memory of the
+// process, which the allocators rarely return to the OS.
+func NewController(path string, limits Limits, memoryUsage func() uint64) *Controller {
+	controller := &Controller{
+		path:        path,
+		limits:      limits,
+		memoryUsage: memoryUsage,
+		noticeSent:  make(map[int64]time.Time),
+	}
+
+	err := storage.ReadJSON(path, &controller.maintenance)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error().Err(err).Msg("⚠️ Restoring maintenance mode failed")
+	}
+
+	if controller.maintenance.Enabled {
+		log.Warn().Msg("🛠 Maintenance mode is on")
+	}
+
+	return controller
+}
+
+// Sets the load shedding thresholds
+func (controller *Controller) SetLimits(limits Limits) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.limits = limits
+}
+
+// Turns maintenance mode on or off, with an optional notice for users
+func (controller *Controller) SetMaintenance(enabled bool, message string) error {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.maintenance = Maintenance{Enabled: enabled, Message: message}
+	return storage.WriteJSON(controller.path, controller.maintenance)
+}
+
+// Returns the maintenance mode
+func (controller *Controller) Maintenance() Maintenance {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	return controller.maintenance
+}
+
+// Returns the conversions in progress and the memory in use in megabytes
+func (controller *Controller) Load() (int64, uint64) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	return controller.inFlight, controller.sampleMemory()
+}
+
+// Admits a conversion, given the amount of messages waiting in the send queue. Returns
+// ErrMaintenance or ErrOverloaded if the conversion is refused; otherwise, Release must
+// be called once the conversion is done.
+func (controller *Controller) Acquire(backlog int64) error {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	if controller.maintenance.Enabled {
+		return ErrMaintenance
+	}
+
+	limits := controller.limits
+	overloaded := (limits.MaxConversions != 0 && controller.inFlight >= limits.MaxConversions) ||
+		(limits.MaxBacklog != 0 && backlog >= limits.MaxBacklog) ||
+		controller.memoryOverloaded()
+
+	// Only log when load shedding starts or stops, instead of for every conversion
+	if overloaded != controller.shedding {
+		controller.shedding = overloaded
+
+		if overloaded {
+			log.Warn().Msgf("🔥 Shedding load: %d conversions in progress, %d messages queued, %d MB in use",
+				controller.inFlight, backlog, controller.memoryMB)
+		} else {
+			log.Info().Msg("🧯 Load is back to normal, admitting conversions")
+		}
+	}
+
+	if overloaded {
+		return ErrOverloaded
+	}
+
+	controller.inFlight++
+	return nil
+}
+
+// Marks an admitted conversion as done
+func (controller *Controller) Release() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.inFlight--
+}
+
+// Checks if the chat should be told its conversion was refused, and records that
+// it was. Avoids replying to every image of a batch.
+func (controller *Controller) ShouldNotify(chat int64) bool {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(controller.noticeSent[chat]) < noticeInterval {
+		return false
+	}
+
+	// Forget chats that could be notified again anyway
+	for id, sentAt := range controller.noticeSent {
+		if now.Sub(sentAt) >= noticeInterval {
+			delete(controller.noticeSent, id)
+		}
+	}
+
+	controller.noticeSent[chat] = now
+	return true
+}
+
+// Checks if memory is over the threshold. Once over it, memory stays high until it falls below
+// memoryRecoveryPercent of the threshold, so that admitting a few conversions doesn't immediately
+// push it back over. Mutex must be held.
+func (controller *Controller) memoryOverloaded() bool {
+	maxMemory := controller.limits.MaxMemoryMB
+	if maxMemory == 0 {
+		controller.memoryHigh = false
+		return false
+	}
+
+	memoryMB := controller.sampleMemory()
+	if controller.memoryHigh {
+		controller.memoryHigh = memoryMB >= maxMemory*memoryRecoveryPercent/100
+	} else {
+		controller.memoryHigh = memoryMB >= maxMemory
+	}
+
+	return controller.memoryHigh
+}
+
+// Returns the memory in use in megabytes, sampled at most once per memorySampleInterval.
+// Mutex must be held.
+func (controller *Controller) sampleMemory() uint64 {
+	if time.Since(controller.sampledAt) < memorySampleInterval {
+		return controller.memoryMB
+	}
+
+	controller.memoryMB = controller.memoryUsage() / (1024 * 1024)
+	controller.sampledAt = time.Now()
+
+	return controller.memoryMB
+}
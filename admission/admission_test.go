@@ -0,0 +1,103 @@
+package admission
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Memory usage of a process that holds no images
+func noMemory() uint64 {
+	return 0
+}
+
+func TestLoadShedding(t *testing.T) {
+	controller := NewController(filepath.Join(t.TempDir(), "maintenance.json"), Limits{MaxConversions: 2, MaxBacklog: 10}, noMemory)
+
+	for i := 0; i < 2; i++ {
+		if err := controller.Acquire(0); err != nil {
+			t.Fatalf("Expected conversion %d to be admitted, got %s", i, err)
+		}
+	}
+
+	if err := controller.Acquire(0); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("Expected a third concurrent conversion to be refused, got %v", err)
+	}
+
+	controller.Release()
+
+	if err := controller.Acquire(10); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("Expected a conversion to be refused with a full send queue, got %v", err)
+	}
+
+	if err := controller.Acquire(9); err != nil {
+		t.Errorf("Expected a conversion to be admitted once load decreased, got %s", err)
+	}
+}
+
+func TestMaintenanceSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+
+	controller := NewController(path, Limits{}, noMemory)
+	if err := controller.SetMaintenance(true, "Back in 5 minutes"); err != nil {
+		t.Fatalf("Error saving maintenance mode: %s", err)
+	}
+
+	restored := NewController(path, Limits{}, noMemory)
+	if err := restored.Acquire(0); !errors.Is(err, ErrMaintenance) {
+		t.Errorf("Expected conversions to be refused in maintenance mode, got %v", err)
+	}
+
+	if maintenance := restored.Maintenance(); maintenance.Message != "Back in 5 minutes" {
+		t.Errorf("Expected maintenance notice to be restored, got %q", maintenance.Message)
+	}
+
+	if !restored.ShouldNotify(1) || restored.ShouldNotify(1) {
+		t.Errorf("Expected a chat to be notified once per minute")
+	}
+}
+
+func TestMemorySheddingRecovers(t *testing.T) {
+	var usedMB uint64
+	controller := NewController(filepath.Join(t.TempDir(), "maintenance.json"), Limits{MaxMemoryMB: 100},
+		func() uint64 { return usedMB * 1024 * 1024 })
+
+	// Checks admission with a fresh memory sample
+	acquire := func(memoryMB uint64) error {
+		usedMB = memoryMB
+		controller.sampledAt = time.Time{}
+
+		err := controller.Acquire(0)
+		if err == nil {
+			controller.Release()
+		}
+
+		return err
+	}
+
+	if err := acquire(99); err != nil {
+		t.Errorf("Expected a conversion to be admitted under the memory threshold, got %s", err)
+	}
+
+	if err := acquire(100); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("Expected a conversion to be refused over the memory threshold, got %v", err)
+	}
+
+	// Conversions are only admitted again once memory has fallen well below the threshold
+	if err := acquire(90); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("Expected a conversion to be refused until memory recovers, got %v", err)
+	}
+
+	if err := acquire(79); err != nil {
+		t.Errorf("Expected a conversion to be admitted once memory recovered, got %s", err)
+	}
+
+	if err := acquire(90); err != nil {
+		t.Errorf("Expected a conversion to be admitted under the memory threshold, got %s", err)
+	}
+
+	if _, memoryMB := controller.Load(); memoryMB != 90 {
+		t.Errorf("Expected 90 MB in use, got %d", memoryMB)
+	}
+}
@@ -0,0 +1,177 @@
+package alerts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hako/durafmt"
+)
+
+// Error categories recorded by the bot
+const (
+	Download   = "download"   // Downloading a received file failed
+	Conversion = "conversion" // Processing an image failed
+	Send       = "send"       // Sending a message failed
+	Panic      = "panic"      // A handler panicked
+)
+
+// When admins are alerted of errors
+type Settings struct {
+	WindowMinutes   int            // Length of the sliding window errors are counted in
+	CooldownMinutes int            // Minimum time between two alerts of the same category
+	Thresholds      map[string]int // Errors per window that trigger an alert, per category; 0 disables alerts
+}
+
+// The settings a config starts out with
+func DefaultSettings() Settings {
+	return Settings{
+		WindowMinutes:   10,
+		CooldownMinutes: 30,
+		Thresholds: map[string]int{
+			Download:   20,
+			Conversion: 10,
+			Send:       20,
+			Panic:      1,
+		},
+	}
+}
+
+// Checks that the settings are usable
+func (settings Settings) Validate() error {
+	if settings.WindowMinutes <= 0 {
+		return fmt.Errorf("WindowMinutes must be positive, got %d", settings.WindowMinutes)
+	}
+
+	if settings.CooldownMinutes < 0 {
+		return fmt.Errorf("CooldownMinutes must not be negative, got %d", settings.CooldownMinutes)
+	}
+
+	for category, threshold := range settings.Thresholds {
+		if threshold < 0 {
+			return fmt.Errorf("threshold of %q must not be negative: use 0 to disable it", category)
+		}
+	}
+
+	return nil
+}
+
+// An alert sent to admins
+type Alert struct {
+	Category  string        // Category of the errors
+	Count     int           // Errors during the window
+	Threshold int           // Threshold that was crossed
+	Window    time.Duration // Length of the window
+	Latest    string        // Description of the latest error
+}
+
+// Formats the alert as a Markdown message
+func (alert Alert) String() string {
+	return fmt.Sprintf(
+		"🚨 *%d %s error(s)* in the last %s (threshold %d)\nLatest: `%s`",
+		alert.Count, alert.Category, durafmt.Parse(alert.Window), alert.Threshold, sanitize(alert.Latest),
+	)
+}
+
+// Keeps a description from breaking out of its Markdown code span
+func sanitize(description string) string {
+	runes := []rune(description)
+	if len(runes) > 300 {
+		runes = append(runes[:300], '…')
+	}
+
+	for i, r := range runes {
+		if r == '`' {
+			runes[i] = '\''
+		}
+	}
+
+	return string(runes)
+}
+
+// Tracks error rates per category in a sliding window, alerting admins when a
+// category's threshold is crossed. A category is alerted at most once per cooldown.
+type Monitor struct {
+	settings  Settings               // Thresholds, window and cooldown
+	errors    map[string][]time.Time // When the errors in the window happened, per category
+	alertedAt map[string]time.Time   // When each category was last alerted
+	notify    func(Alert)            // Sends alerts to admins
+	mutex     sync.Mutex             // Mutex to avoid concurrent writes
+}
+
+// Creates a monitor with the given settings
+func NewMonitor(settings Settings) *Monitor {
+	return &Monitor{
+		settings:  settings,
+		errors:    make(map[string][]time.Time),
+		alertedAt: make(map[string]time.Time),
+	}
+}
+
+// Sets the thresholds, window and cooldown
+func (monitor *Monitor) SetSettings(settings Settings) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	monitor.settings = settings
+}
+
+// Sets the function sending alerts to admins
+func (monitor *Monitor) SetNotifier(notify func(Alert)) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	monitor.notify = notify
+}
+
+// Records an error of a category, with a description of it. Alerts admins if the
+// category's threshold is crossed, and returns whether they were alerted.
+func (monitor *Monitor) Record(category string, description string) bool {
+	alert, notify, ok := monitor.record(category, description, time.Now())
+
+	// Notify without holding the mutex, so errors while notifying can be recorded
+	if ok && notify != nil {
+		notify(alert)
+	}
+
+	return ok
+}
+
+// Records an error at the given time, returning the alert to send, if any
+func (monitor *Monitor) record(category string, description string, now time.Time) (Alert, func(Alert), bool) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	window := time.Duration(monitor.settings.WindowMinutes) * time.Minute
+	threshold := monitor.settings.Thresholds[category]
+
+	// Forget errors that have slid out of the window
+	recent := monitor.errors[category]
+	for len(recent) != 0 && now.Sub(recent[0]) >= window {
+		recent = recent[1:]
+	}
+
+	recent = append(recent, now)
+	monitor.errors[category] = recent
+
+	if threshold == 0 || len(recent) < threshold {
+		return Alert{}, nil, false
+	}
+
+	cooldown := time.Duration(monitor.settings.CooldownMinutes) * time.Minute
+	if alertedAt, ok := monitor.alertedAt[category]; ok && now.Sub(alertedAt) < cooldown {
+		return Alert{}, nil, false
+	}
+
+	monitor.alertedAt[category] = now
+
+	alert := Alert{
+		Category:  category,
+		Count:     len(recent),
+		Threshold: threshold,
+		Window:    window,
+		Latest:    description,
+	}
+
+	return alert, monitor.notify, true
+}
@@ -0,0 +1,63 @@
+package alerts
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThresholdAndCooldown(t *testing.T) {
+	monitor := NewMonitor(Settings{
+		WindowMinutes:   10,
+		CooldownMinutes: 30,
+		Thresholds:      map[string]int{Conversion: 3},
+	})
+
+	start := time.Now()
+	alerted := 0
+
+	// Three errors within the window cross the threshold once
+	for i := 0; i < 5; i++ {
+		if _, _, ok := monitor.record(Conversion, "Error processing image", start.Add(time.Duration(i)*time.Minute)); ok {
+			alerted++
+		}
+	}
+
+	if alerted != 1 {
+		t.Errorf("Expected 1 alert during the cooldown, got %d", alerted)
+	}
+
+	// After the cooldown, old errors have slid out of the window
+	later := start.Add(45 * time.Minute)
+	if _, _, ok := monitor.record(Conversion, "Error processing image", later); ok {
+		t.Errorf("Expected errors outside the window not to count")
+	}
+
+	monitor.record(Conversion, "Error processing image", later.Add(time.Second))
+	alert, _, ok := monitor.record(Conversion, "Error `processing` image", later.Add(2*time.Second))
+
+	if !ok || alert.Count != 3 {
+		t.Fatalf("Expected an alert of 3 errors after the cooldown, got %+v", alert)
+	}
+
+	if strings.Count(alert.String(), "`") != 2 {
+		t.Errorf("Expected backticks in the description to be replaced, got %q", alert.String())
+	}
+}
+
+func TestDisabledCategories(t *testing.T) {
+	monitor := NewMonitor(DefaultSettings())
+
+	for i := 0; i < 100; i++ {
+		if monitor.Record("file too large", "") {
+			t.Fatalf("Expected categories without a threshold not to alert")
+		}
+	}
+
+	notified := 0
+	monitor.SetNotifier(func(alert Alert) { notified++ })
+
+	if !monitor.Record(Panic, "runtime error: index out of range") || notified != 1 {
+		t.Errorf("Expected a single panic to alert admins")
+	}
+}
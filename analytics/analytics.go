@@ -0,0 +1,218 @@
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Upper bounds of the latency histogram's buckets, in milliseconds. Conversions
+// slower than the last bound land in an extra overflow bucket.
+var latencyBounds = [...]int64{50, 100, 200, 300, 500, 750, 1000, 1500, 2000, 3000, 5000, 10000}
+
+// Details of a single conversion
+type Conversion struct {
+	Mode              string        // Conversion mode, e.g. "sticker" or "emoji"
+	MediaType         string        // Type of the received media: "photo", "document" or "sticker"
+	InputFormat       string        // Format of the received image, e.g. "jpeg"
+	Upscaled          bool          // Was the image enlarged?
+	Distorted         bool          // Was the image's aspect ratio changed?
+	CompressionFailed bool          // Did the image stay over the size limit after compression?
+	Width             int           // Width of the converted image
+	Height            int           // Height of the converted image
+	Cached            bool          // Was a previous conversion of the same file resent?
+	Latency           time.Duration // Time spent downloading and processing the image
+}
+
+// Conversions broken down by mode, input and outcome
+type Breakdown struct {
+	Total             int64                         // Conversions counted in the breakdown
+	Modes             map[string]int64              // Conversions per mode
+	MediaTypes        map[string]int64              // Conversions per type of received media
+	InputFormats      map[string]int64              // Conversions per input format
+	Upscaled          int64                         // Conversions that enlarged the image
+	Distorted         int64                         // Conversions that changed the aspect ratio
+	CompressionFailed int64                         // Conversions that stayed over the size limit
+	Cached            int64                         // Conversions answered from the conversion cache
+	Latency           [len(latencyBounds) + 1]int64 // Histogram of latencies, bucketed by latencyBounds
+}
+
+// Increments a counter in a map, creating the map if needed
+func increment(counts map[string]int64, key string, n int64) map[string]int64 {
+	if counts == nil {
+		counts = make(map[string]int64)
+	}
+
+	if key == "" {
+		key = "unknown"
+	}
+
+	counts[key] += n
+	return counts
+}
+
+// Adds a conversion to the breakdown
+func (breakdown *Breakdown) Add(conversion Conversion) {
+	breakdown.Total++
+	breakdown.Modes = increment(breakdown.Modes, conversion.Mode, 1)
+	breakdown.MediaTypes = increment(breakdown.MediaTypes, conversion.MediaType, 1)
+	breakdown.InputFormats = increment(breakdown.InputFormats, conversion.InputFormat, 1)
+
+	if conversion.Upscaled {
+		breakdown.Upscaled++
+	}
+
+	if conversion.Distorted {
+		breakdown.Distorted++
+	}
+
+	if conversion.CompressionFailed {
+		breakdown.CompressionFailed++
+	}
+
+	// Resends of cached conversions skip downloading and converting, and would skew the latencies
+	if conversion.Cached {
+		breakdown.Cached++
+		return
+	}
+
+	ms := conversion.Latency.Milliseconds()
+	bucket := sort.Search(len(latencyBounds), func(i int) bool { return latencyBounds[i] >= ms })
+	breakdown.Latency[bucket]++
+}
+
+// Adds the conversions of another breakdown to this one
+func (breakdown *Breakdown) Merge(other Breakdown) {
+	breakdown.Total += other.Total
+	breakdown.Upscaled += other.Upscaled
+	breakdown.Distorted += other.Distorted
+	breakdown.CompressionFailed += other.CompressionFailed
+	breakdown.Cached += other.Cached
+
+	for key, n := range other.Modes {
+		breakdown.Modes = increment(breakdown.Modes, key, n)
+	}
+
+	for key, n := range other.MediaTypes {
+		breakdown.MediaTypes = increment(breakdown.MediaTypes, key, n)
+	}
+
+	for key, n := range other.InputFormats {
+		breakdown.InputFormats = increment(breakdown.InputFormats, key, n)
+	}
+
+	for i, n := range other.Latency {
+		breakdown.Latency[i] += n
+	}
+}
+
+// Returns a deep copy of the breakdown, safe to read without holding its owner's lock
+func (breakdown Breakdown) Copy() Breakdown {
+	var copied Breakdown
+	copied.Merge(breakdown)
+
+	return copied
+}
+
+// Returns the conversions counted in the latency histogram, i.e. those that weren't cached
+func (breakdown *Breakdown) timed() int64 {
+	counted := int64(0)
+	for _, n := range breakdown.Latency {
+		counted += n
+	}
+
+	return counted
+}
+
+// Returns the latency under which the fraction p (0-1) of conversions finished, as
+// the upper bound of its histogram bucket. Returns false if the latency is over the
+// last bound, or if no conversions are counted. Cached conversions aren't included.
+func (breakdown *Breakdown) Percentile(p float64) (time.Duration, bool) {
+	counted := breakdown.timed()
+	if counted == 0 {
+		return 0, false
+	}
+
+	// Rank of the conversion at the percentile
+	rank := int64(math.Ceil(p * float64(counted)))
+	cumulative := int64(0)
+
+	for i, n := range breakdown.Latency[:len(latencyBounds)] {
+		cumulative += n
+		if cumulative >= rank {
+			return time.Duration(latencyBounds[i]) * time.Millisecond, true
+		}
+	}
+
+	return 0, false
+}
+
+// Formats the counts of a map, largest first, with their share of the total
+func shares(counts map[string]int64, total int64) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s %s (%s)", key, humanize.Comma(counts[key]), percentage(counts[key], total)))
+	}
+
+	if len(parts) == 0 {
+		return "–"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Formats n as a percentage of total
+func percentage(n int64, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+
+	return fmt.Sprintf("%.0f%%", 100*float64(n)/float64(total))
+}
+
+// Formats a latency percentile
+func (breakdown *Breakdown) percentileString(p float64) string {
+	latency, ok := breakdown.Percentile(p)
+	if ok {
+		return fmt.Sprintf("≤%s", latency)
+	}
+
+	if breakdown.timed() == 0 {
+		return "–"
+	}
+
+	return fmt.Sprintf(">%s", time.Duration(latencyBounds[len(latencyBounds)-1])*time.Millisecond)
+}
+
+// Describes the breakdown, under a Markdown title
+func (breakdown *Breakdown) String(title string) string {
+	total := breakdown.Total
+
+	return fmt.Sprintf("*%s* (%s conversions)\n", title, humanize.Comma(total)) +
+		fmt.Sprintf("Modes: %s\n", shares(breakdown.Modes, total)) +
+		fmt.Sprintf("Media: %s\n", shares(breakdown.MediaTypes, total)) +
+		fmt.Sprintf("Formats: %s\n", shares(breakdown.InputFormats, total)) +
+		fmt.Sprintf("Upscaled: %s (%s)\n", humanize.Comma(breakdown.Upscaled), percentage(breakdown.Upscaled, total)) +
+		fmt.Sprintf("Distorted: %s (%s)\n", humanize.Comma(breakdown.Distorted), percentage(breakdown.Distorted, total)) +
+		fmt.Sprintf("Compression failed: %s (%s)\n", humanize.Comma(breakdown.CompressionFailed), percentage(breakdown.CompressionFailed, total)) +
+		fmt.Sprintf("Cached: %s (%s)\n", humanize.Comma(breakdown.Cached), percentage(breakdown.Cached, total)) +
+		fmt.Sprintf("Latency p50/p90/p99: %s / %s / %s",
+			breakdown.percentileString(0.5), breakdown.percentileString(0.9), breakdown.percentileString(0.99))
+}
@@ -0,0 +1,77 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakdown(t *testing.T) {
+	var breakdown Breakdown
+
+	for i := 0; i < 9; i++ {
+		breakdown.Add(Conversion{Mode: "sticker", MediaType: "photo", InputFormat: "jpeg", Latency: 80 * time.Millisecond})
+	}
+	breakdown.Add(Conversion{Mode: "emoji", MediaType: "document", InputFormat: "png", Upscaled: true, Distorted: true, Latency: 4 * time.Second})
+
+	if breakdown.Total != 10 || breakdown.Modes["sticker"] != 9 || breakdown.Modes["emoji"] != 1 {
+		t.Errorf("Expected 9 sticker and 1 emoji conversions, got %v", breakdown.Modes)
+	}
+
+	if breakdown.Upscaled != 1 || breakdown.Distorted != 1 || breakdown.CompressionFailed != 0 {
+		t.Errorf("Expected 1 upscaled and distorted conversion, got %d and %d", breakdown.Upscaled, breakdown.Distorted)
+	}
+
+	if p50, _ := breakdown.Percentile(0.5); p50 != 100*time.Millisecond {
+		t.Errorf("Expected p50 of 100ms, got %s", p50)
+	}
+
+	if p99, _ := breakdown.Percentile(0.99); p99 != 5*time.Second {
+		t.Errorf("Expected p99 of 5s, got %s", p99)
+	}
+
+	// Merging into an empty breakdown copies it
+	copied := breakdown.Copy()
+	copied.Add(Conversion{Mode: "emoji"})
+
+	if breakdown.Modes["emoji"] != 1 || copied.Modes["emoji"] != 2 || copied.Total != 11 {
+		t.Errorf("Expected the copy to be independent, got %v and %v", breakdown.Modes, copied.Modes)
+	}
+}
+
+func TestCachedConversionsHaveNoLatency(t *testing.T) {
+	var breakdown Breakdown
+	breakdown.Add(Conversion{Latency: 2500 * time.Millisecond})
+
+	for i := 0; i < 5; i++ {
+		breakdown.Add(Conversion{Cached: true, Latency: time.Millisecond})
+	}
+
+	if breakdown.Total != 6 || breakdown.Cached != 5 {
+		t.Errorf("Expected 6 conversions, 5 of them cached, got %d and %d", breakdown.Total, breakdown.Cached)
+	}
+
+	if p50, _ := breakdown.Percentile(0.5); p50 != 3*time.Second {
+		t.Errorf("Expected p50 of 3s from the only converted image, got %s", p50)
+	}
+
+	// Only cached conversions have no latencies to show
+	var cached Breakdown
+	cached.Add(Conversion{Cached: true})
+
+	if latency := cached.percentileString(0.5); latency != "–" {
+		t.Errorf("Expected no latency for cached conversions, got %s", latency)
+	}
+}
+
+func TestSlowConversions(t *testing.T) {
+	var breakdown Breakdown
+	breakdown.Add(Conversion{Latency: time.Minute})
+
+	if _, ok := breakdown.Percentile(0.5); ok {
+		t.Errorf("Expected conversions over the last bucket to have no upper bound")
+	}
+
+	if breakdown.MediaTypes["unknown"] != 1 {
+		t.Errorf("Expected a conversion with no media type to be counted as unknown, got %v", breakdown.MediaTypes)
+	}
+}
@@ -0,0 +1,287 @@
+package bots
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/spam"
+	"tg-resize-sticker-images/stats"
+	"tg-resize-sticker-images/templates"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hako/durafmt"
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Handler for an admin command, receiving the command's arguments
+type adminHandler func(session *config.Session, message *tb.Message, args []string)
+
+// Adds a Markdown text message to the send queue
+func queueText(session *config.Session, recipient *tb.User, text string) {
+	msg := queue.Message{
+		Recipient: recipient,
+		Bytes:     nil,
+		Caption:   text,
+		Sopts:     tb.SendOptions{ParseMode: "Markdown"},
+	}
+
+	session.Queue.AddToQueue(&msg)
+}
+
+// Adapts an admin command handler to telebot, passing it the command's arguments
+func adminCommand(session *config.Session, handler adminHandler) tb.HandlerFunc {
+	return func(c tb.Context) error {
+		handler(session, c.Message(), c.Args())
+		return nil
+	}
+}
+
+// Parses a ban duration, e.g. "30m", "12h" or "7d"
+func parseBanDuration(arg string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(arg, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", arg)
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(arg)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", arg)
+	}
+
+	return duration, nil
+}
+
+// Parses the user ID argument of an admin command, notifying the admin on failure
+func parseUserArg(session *config.Session, message *tb.Message, args []string, usage string) (int64, bool) {
+	if len(args) == 0 {
+		queueText(session, message.Sender, "ℹ️ Usage: "+usage)
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		queueText(session, message.Sender, fmt.Sprintf("⚠️ Invalid user ID `%s`. Usage: %s", args[0], usage))
+		return 0, false
+	}
+
+	return id, true
+}
+
+// /ban <id> [duration]: bans a user, permanently if no duration is given
+func handleBan(session *config.Session, message *tb.Message, args []string) {
+	const usage = "/ban <id> [duration, e.g. 12h or 7d]"
+
+	id, ok := parseUserArg(session, message, args, usage)
+	if !ok {
+		return
+	}
+
+	if session.Config.IsAdmin(id) {
+		queueText(session, message.Sender, "⚠️ Admins can't be banned.")
+		return
+	}
+
+	until := int64(spam.PermanentBan)
+	description := "permanently"
+
+	if len(args) > 1 {
+		duration, err := parseBanDuration(args[1])
+		if err != nil {
+			queueText(session, message.Sender, fmt.Sprintf("⚠️ %s. Usage: %s", err, usage))
+			return
+		}
+
+		until = time.Now().Add(duration).Unix()
+		description = "for " + durafmt.Parse(duration).LimitFirstN(2).String()
+	}
+
+	session.Spam.BanChat(id, until)
+	log.Info().Msgf("🔨 %d banned %s by %d", id, description, message.Sender.ID)
+
+	queueText(session, message.Sender, fmt.Sprintf("🔨 Banned `%d` %s.", id, description))
+}
+
+// /unban <id>: lifts a user's ban
+func handleUnban(session *config.Session, message *tb.Message, args []string) {
+	id, ok := parseUserArg(session, message, args, "/unban <id>")
+	if !ok {
+		return
+	}
+
+	if !session.Spam.UnbanChat(id) {
+		queueText(session, message.Sender, fmt.Sprintf("ℹ️ `%d` is not banned.", id))
+		return
+	}
+
+	log.Info().Msgf("🕊 %d unbanned by %d", id, message.Sender.ID)
+	queueText(session, message.Sender, fmt.Sprintf("🕊 Unbanned `%d`.", id))
+}
+
+// /whois <id>: shows what the bot knows about a user
+func handleWhois(session *config.Session, message *tb.Message, args []string) {
+	id, ok := parseUserArg(session, message, args, "/whois <id>")
+	if !ok {
+		return
+	}
+
+	conversions, banned, bannedUntil, manual := session.Spam.ChatStatus(id)
+
+	banStatus := "not banned"
+	if banned && bannedUntil == spam.PermanentBan {
+		banStatus = "banned permanently"
+	} else if banned && manual {
+		banStatus = "banned until " + humanize.Time(time.Unix(bannedUntil, 0))
+	} else if banned {
+		banStatus = "rate-limited until " + humanize.Time(time.Unix(bannedUntil, 0))
+	}
+
+	mode := "sticker"
+	if session.Prefs.GetConversionMode(id) {
+		mode = "emoji"
+	}
+
+	tierName, tier := session.Spam.TierOf(id)
+
+	queueText(session, message.Sender, fmt.Sprintf(
+		"🔎 *User* `%d`\n"+
+			"Seen before: %t\n"+
+			"Admin: %t\n"+
+			"Tier: %s (%s)\n"+
+			"Conversions during the last hour: %d\n"+
+			"Strikes: %d\n"+
+			"Mode: %s\n"+
+			"Status: %s",
+		id, stats.ChatExists(id, session.Config), session.Config.IsAdmin(id),
+		templates.EscapeMarkdown(tierName), templates.TierLimits(locale.For(locale.Default), tier),
+		conversions, session.Spam.Strikes(id), mode, banStatus,
+	))
+}
+
+// /limits [conversions per hour]: shows or changes the hourly conversion limit
+func handleLimits(session *config.Session, message *tb.Message, args []string) {
+	if len(args) == 0 {
+		tiers, _ := session.Config.TierSettings()
+
+		// List tiers in a stable order
+		names := make([]string, 0, len(tiers))
+		for name := range tiers {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		text := "🚦 *Conversion limits*\n"
+		for _, name := range names {
+			text += fmt.Sprintf("%s: %s\n", templates.EscapeMarkdown(name), templates.TierLimits(locale.For(locale.Default), tiers[name]))
+		}
+
+		queueText(session, message.Sender, text+"\nUse /limits <n> to change the hourly limit of the default tier.")
+		return
+	}
+
+	limit, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || limit <= 0 {
+		queueText(session, message.Sender, "⚠️ The limit must be a positive number. Usage: /limits <n>")
+		return
+	}
+
+	// Update the rule and persist the change
+	session.Spam.SetConversionRate(limit)
+
+	session.Config.SetConversionRate(limit)
+
+	go config.DumpConfig(session.Config)
+
+	log.Info().Msgf("🚦 Conversion limit set to %d/h by %d", limit, message.Sender.ID)
+
+	text := fmt.Sprintf("🚦 Users in the default tier can now convert %d images per hour.", limit)
+	if src := session.Config.ConversionRateOverride(); src != "" {
+		text += fmt.Sprintf("\n\n⚠️ The limit is also set with `%s`, which takes precedence again on the next reload or restart.", src)
+	}
+
+	queueText(session, message.Sender, text)
+}
+
+// /tier <id> [tier]: shows or changes a user's tier
+func handleTier(session *config.Session, message *tb.Message, args []string) {
+	id, ok := parseUserArg(session, message, args, "/tier <id> [tier]")
+	if !ok {
+		return
+	}
+
+	if len(args) == 1 {
+		name, tier := session.Spam.TierOf(id)
+		queueText(session, message.Sender, fmt.Sprintf("🎚 `%d` is in the %s tier (%s).",
+			id, templates.EscapeMarkdown(name), templates.TierLimits(locale.For(locale.Default), tier)))
+		return
+	}
+
+	name := args[1]
+	if err := session.Spam.SetChatTier(id, name); err != nil {
+		queueText(session, message.Sender, fmt.Sprintf("⚠️ Can't change tier: %s. See /limits for the tiers.", templates.EscapeMarkdown(err.Error())))
+		return
+	}
+
+	// Persist the assignment
+	session.Config.Mutex.Lock()
+	if name == spam.DefaultTier {
+		delete(session.Config.UserTiers, id)
+	} else {
+		if session.Config.UserTiers == nil {
+			session.Config.UserTiers = make(map[int64]string)
+		}
+
+		session.Config.UserTiers[id] = name
+	}
+	session.Config.Mutex.Unlock()
+
+	go config.DumpConfig(session.Config)
+
+	log.Info().Msgf("🎚 %d moved to the %s tier by %d", id, name, message.Sender.ID)
+	queueText(session, message.Sender, fmt.Sprintf("🎚 Moved `%d` to the %s tier.", id, templates.EscapeMarkdown(name)))
+}
+
+// /spam: shows insights into the anti-spam state
+func handleSpam(session *config.Session, message *tb.Message, args []string) {
+	queueText(session, message.Sender, spam.SpamInspectionString(session.Spam))
+}
+
+// Notifies admins of a chat that has reached the harshest penalty
+func notifyTopPenalty(session *config.Session, chat int64, strikes int, until int64) {
+	text := fmt.Sprintf(
+		"🚨 `%d` has reached the harshest penalty with %d strikes, and is rate-limited until %s. "+
+			"Use /whois %d for details, or /ban %d to ban them.",
+		chat, strikes, humanize.Time(time.Unix(until, 0)), chat, chat,
+	)
+
+	for _, admin := range session.Config.AdminIds() {
+		queueText(session, &tb.User{ID: admin}, text)
+	}
+}
+
+// Registers the admin commands
+func setupAdminCommands(session *config.Session) {
+	// Admin commands are rate-limited, and rejected from everyone who isn't an admin
+	admin := session.Bot.Group()
+	admin.Use(rateLimit(session), requireAdmin(session))
+
+	admin.Handle("/ban", adminCommand(session, handleBan))
+	admin.Handle("/unban", adminCommand(session, handleUnban))
+	admin.Handle("/whois", adminCommand(session, handleWhois))
+	admin.Handle("/limits", adminCommand(session, handleLimits))
+	admin.Handle("/tier", adminCommand(session, handleTier))
+	admin.Handle("/spam", adminCommand(session, handleSpam))
+	admin.Handle("/broadcast", adminCommand(session, handleBroadcast))
+	admin.Handle("/maintenance", adminCommand(session, handleMaintenance))
+}
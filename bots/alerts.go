@@ -0,0 +1,37 @@
+package bots
+
+import (
+	"tg-resize-sticker-images/alerts"
+	"tg-resize-sticker-images/broadcast"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/queue"
+
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Records an error in the reports, and alerts admins if its category's error rate is too high
+func recordError(session *config.Session, category string, err error) {
+	session.Reports.AddError(category)
+	session.Alerts.Record(category, err.Error())
+}
+
+// Records a failed send of a queued message. Broadcasts reach every user, including the many who
+// blocked the bot since, so those failures are only counted by the broadcast.
+func recordSendError(session *config.Session, msg *queue.Message, err error) {
+	if msg.Broadcast && broadcast.IsBlocked(err) {
+		return
+	}
+
+	recordError(session, alerts.Send, err)
+}
+
+// Sends an alert to the admins
+func notifyAlert(session *config.Session, alert alerts.Alert) {
+	log.Warn().Msgf("🚨 Alerting admins: %d %s error(s) in %s", alert.Count, alert.Category, alert.Window)
+
+	for _, admin := range session.Config.AdminIds() {
+		queueText(session, &tb.User{ID: admin}, alert.String())
+	}
+}
@@ -3,9 +3,10 @@ package bots
 import (
 	"context"
 	"strings"
+	"tg-resize-sticker-images/alerts"
 	"tg-resize-sticker-images/config"
 	"tg-resize-sticker-images/queue"
-	"tg-resize-sticker-images/spam"
+	"tg-resize-sticker-images/reports"
 	"tg-resize-sticker-images/stats"
 	"tg-resize-sticker-images/templates"
 
@@ -16,18 +17,36 @@ import (
 	tb "gopkg.in/telebot.v3"
 )
 
-// Function clears the SendQueue and stays within API limits while doing so
-func MessageSender(session *config.Session) {
+// Function clears the SendQueue and stays within API limits while doing so. Returns once
+// stop is closed; a nil channel keeps it running for as long as the process.
+func MessageSender(session *config.Session, stop <-chan struct{}) {
 	for {
-		// If queue is not empty, clear it
-		if len(session.Queue.MessageQueue) != 0 {
+		// If queue is not empty, clear it. The backlog is read atomically, as the queue itself may only be read locked.
+		if session.Queue.Backlog() != 0 {
 			// Lock sendQueue for parsing
 			session.Queue.Mutex.Lock()
 
 			// Iterate over queue
 			for _, msg := range session.Queue.MessageQueue {
-				// If nil bytes, we are only sending text
-				if msg.Bytes == nil {
+				// If nil bytes, we are only sending text, or media by reference
+				if msg.Media != nil {
+					// Media, take two tokens from the pool (limits to 10 msg/sec)
+					err := session.Queue.Limiter.WaitN(context.Background(), 2)
+
+					if err != nil {
+						log.Error().Err(err).Msg("Running limiter.WaitN failed in media sender")
+					}
+
+					// Send media by reference
+					sent, err := session.Bot.Send(msg.Recipient, msg.Media, &msg.Sopts)
+
+					if err != nil {
+						log.Error().Err(err).Msg("Error sending media message in messageSender")
+						recordSendError(session, &msg, err)
+					}
+
+					msg.Done(sent, err)
+				} else if msg.Bytes == nil {
 					// Text-only, take one token from the pool (limits to 20 msg/sec)
 					err := session.Queue.Limiter.WaitN(context.Background(), 1)
 
@@ -36,11 +55,14 @@ func MessageSender(session *config.Session) {
 					}
 
 					// Send text only
-					_, err = session.Bot.Send(msg.Recipient, msg.Caption, &msg.Sopts)
+					sent, err := session.Bot.Send(msg.Recipient, msg.Caption, &msg.Sopts)
 
 					if err != nil {
 						log.Error().Err(err).Msg("Error sending non-bytes message in messageSender")
+						recordSendError(session, &msg, err)
 					}
+
+					msg.Done(sent, err)
 				} else {
 					// Photo, take two tokens from the pool (limits to 10 msg/sec)
 					err := session.Queue.Limiter.WaitN(context.Background(), 2)
@@ -52,6 +74,8 @@ func MessageSender(session *config.Session) {
 					// If non-nil bytes, we are sending a photo
 					sendDocument(session, &msg)
 				}
+
+				session.Queue.MarkSent()
 			}
 
 			// Clear queue
@@ -61,157 +85,128 @@ func MessageSender(session *config.Session) {
 			session.Queue.Mutex.Unlock()
 		}
 
-		// Sleep while waiting for updates
-		time.Sleep(time.Millisecond * 50)
+		// Sleep while waiting for updates, or stop once the batch is sent
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Millisecond * 50):
+		}
 	}
 }
 
+// Wires the session's components to the bot, so that admins are notified of penalties, reports and alerts
+func setupSession(session *config.Session) {
+	session.Spam.SetPenaltyHook(func(chat int64, strikes int, until int64) {
+		notifyTopPenalty(session, chat, strikes, until)
+	})
+
+	session.Reports.SetSender(func(period reports.Period) {
+		sendReport(session, period)
+	})
+
+	// Send errors are recorded by the message sender while it holds the send queue,
+	// so alerts are queued without blocking the caller
+	session.Alerts.SetNotifier(func(alert alerts.Alert) {
+		go notifyAlert(session, alert)
+	})
+}
+
 func SetupBot(session *config.Session) {
 	// Pull pointers from session for cleaner code
 	bot, aspam := session.Bot, session.Spam
 
-	// Command handler for /start
-	bot.Handle("/start", func(c tb.Context) error {
-		// Anti-spam
-		message := c.Message()
-
-		// Run rate-limiter
-		session.Spam.RunUserLimiter(message.Sender.ID, 1)
-
-		// Construct message
-		startMessage := templates.HelpMessage(message, aspam)
-		msg := queue.Message{
-			Recipient: message.Sender,
-			Bytes:     nil,
-			Caption:   startMessage,
-			Sopts:     tb.SendOptions{ParseMode: "Markdown"},
-		}
+	// Admins are notified by the session's components
+	setupSession(session)
+
+	// Every update is logged with a correlation ID, and recovered from if its handler panics
+	bot.Use(logRequests(session), recoverPanics(session))
+
+	// Commands and buttons are ignored from banned users, and rate-limited
+	commands := bot.Group()
+	commands.Use(enforceBans(session), rateLimit(session))
 
-		// Add to send queue
-		session.Queue.AddToQueue(&msg)
+	// Media is ignored from banned users, and rate-limited by the conversion limits instead
+	media := bot.Group()
+	media.Use(enforceBans(session))
+
+	// Command handler for /start
+	commands.Handle("/start", func(c tb.Context) error {
+		reply(session, c, templates.HelpMessage(userLocale(session, c.Sender()), c.Message(), aspam),
+			tb.SendOptions{ParseMode: "Markdown"})
 
 		// Check if the chat is actually new, or just calling /start again
-		if !stats.ChatExists(message.Sender.ID, session.Config) {
-			log.Info().Msgf("🌟 %d bot added to new chat", message.Sender.ID)
+		if !stats.ChatExists(c.Sender().ID, session.Config) {
+			requestLog(c).Info().Msgf("🌟 %d bot added to new chat", c.Sender().ID)
 		}
 
 		return nil
 	})
 
 	// Command handler for /help
-	bot.Handle("/help", func(c tb.Context) error {
-		// Pointer to message
-		message := c.Message()
-
-		// Run rate-limiter
-		session.Spam.RunUserLimiter(message.Sender.ID, 1)
-
-		// Refresh ConversionCount for chat
-		spam.RefreshConversions(aspam, message.Sender.ID)
-
-		// Help message
-		helpMessage := templates.HelpMessage(message, aspam)
-
-		// Construct message
-		msg := queue.Message{
-			Recipient: message.Sender,
-			Bytes:     nil,
-			Caption:   helpMessage,
-			Sopts:     tb.SendOptions{ParseMode: "Markdown"},
-		}
-
-		// Add to send queue
-		session.Queue.AddToQueue(&msg)
-
-		if message.Sender.ID != session.Config.Owner {
-			log.Info().Msgf("🙋 %d requested help", message.Sender.ID)
-		}
+	commands.Handle("/help", func(c tb.Context) error {
+		reply(session, c, templates.HelpMessage(userLocale(session, c.Sender()), c.Message(), aspam),
+			tb.SendOptions{ParseMode: "Markdown"})
 
 		return nil
 	})
 
 	// Command handler for /stats
-	bot.Handle("/stats", func(c tb.Context) error {
-		// Pointer to message
-		message := c.Message()
-
-		// Run rate-limiter
-		session.Spam.RunUserLimiter(message.Sender.ID, 1)
+	commands.Handle("/stats", func(c tb.Context) error {
+		caption, sopts := stats.BuildStatsMsg(session.Config, session.Daily, session.History, session.Vnum)
+		reply(session, c, caption, sopts)
 
-		// Get stats message
-		caption, sopts := stats.BuildStatsMsg(session.Config, session.Daily, session.Vnum)
-
-		// Construct message
-		msg := queue.Message{Recipient: message.Sender, Bytes: nil, Caption: caption, Sopts: sopts}
+		return nil
+	})
 
-		// Add to send queue
-		session.Queue.AddToQueue(&msg)
-
-		if message.Sender.ID != session.Config.Owner {
-			log.Info().Msgf("📊 %d requested to view stats", message.Sender.ID)
-		}
+	// Command handler for /mode
+	commands.Handle("/mode", func(c tb.Context) error {
+		// Toggle conversion mode, send user confirmation of mode change
+		_, _, confirmation, _ := session.Prefs.ToggleConversionMode(c.Sender().ID, c.Sender().LanguageCode)
+		reply(session, c, confirmation, tb.SendOptions{ParseMode: "Markdown"})
 
 		return nil
 	})
 
-	// Command handler for /stats
-	bot.Handle("/mode", func(c tb.Context) error {
-		// Pointer to message
-		message := c.Message()
-
-		// Run rate-limiter
-		session.Spam.RunUserLimiter(message.Sender.ID, 1)
-
-		// Toggle conversion mode
-		_, _, confirmation, _ := session.Spam.ToggleConversionMode(message.Sender.ID)
-
-		// Send user confirmation of mode change
-		msg := queue.Message{
-			Recipient: message.Sender,
-			Bytes:     nil,
-			Caption:   confirmation,
-			Sopts:     tb.SendOptions{ParseMode: "Markdown"},
-		}
+	// Command handler for /settings
+	commands.Handle("/settings", func(c tb.Context) error {
+		// Show the settings menu for the user's current preferences
+		userPrefs := session.Prefs.Get(c.Sender().ID)
+		loc := userPrefs.Locale(c.Sender().LanguageCode)
 
-		// Add to send queue
-		session.Queue.AddToQueue(&msg)
-
-		if message.Sender.ID != session.Config.Owner {
-			log.Info().Msgf("🪛 %d requested to change mode", message.Sender.ID)
-		}
+		reply(session, c, templates.SettingsMessage(loc, userPrefs, c.Sender().LanguageCode), settingsSendOptions(loc, userPrefs))
 
 		return nil
 	})
 
+	// Register owner/admin commands
+	setupAdminCommands(session)
+
 	// Register photo handler
-	bot.Handle(tb.OnPhoto, func(c tb.Context) error {
+	media.Handle(tb.OnPhoto, func(c tb.Context) error {
 		handleIncomingMedia(session, c.Message(), "photo")
 		return nil
 	})
 
 	// Register document handler
-	bot.Handle(tb.OnDocument, func(c tb.Context) error {
+	media.Handle(tb.OnDocument, func(c tb.Context) error {
 		handleIncomingMedia(session, c.Message(), "document")
 		return nil
 	})
 
 	// Register sticker handler
-	bot.Handle(tb.OnSticker, func(c tb.Context) error {
+	media.Handle(tb.OnSticker, func(c tb.Context) error {
 		handleIncomingMedia(session, c.Message(), "sticker")
 		return nil
 	})
 
 	// Register handler for incoming callback queries (i.e. stats refresh)
-	bot.Handle(tb.OnCallback, func(c tb.Context) error {
+	commands.Handle(tb.OnCallback, func(c tb.Context) error {
 		// Pointer to received callback
 		cb := c.Callback()
 
 		if cb.Data == "stats/refresh" {
-			// Run rate-limiter
-			session.Spam.RunUserLimiter(cb.Sender.ID, 1)
-
 			// Create updated message
-			msg, sopts := stats.BuildStatsMsg(session.Config, session.Daily, session.Vnum)
+			msg, sopts := stats.BuildStatsMsg(session.Config, session.Daily, session.History, session.Vnum)
 
 			// Edit message with new content if the messages aren't identical
 			_, err := bot.Edit(cb.Message, msg, &sopts)
@@ -238,11 +233,8 @@ func SetupBot(session *config.Session) {
 			}
 
 		} else if cb.Data == "mode/switch" {
-			// Run rate-limiter
-			session.Spam.RunUserLimiter(cb.Sender.ID, 1)
-
 			// Switch mode
-			_, cb_string, confirmation, editableSendOptions := session.Spam.ToggleConversionMode(cb.Sender.ID)
+			_, cb_string, confirmation, editableSendOptions := session.Prefs.ToggleConversionMode(cb.Sender.ID, cb.Sender.LanguageCode)
 
 			// Callback response
 			resp := tb.CallbackResponse{
@@ -275,6 +267,39 @@ func SetupBot(session *config.Session) {
 				log.Error().Err(err).Msg("Error editing message in /mode handler")
 			}
 
+		} else if cb.Data == "stats/details" {
+			// Show the second page of the stats
+			msg, sopts := stats.BuildDetailsMsg(session.Config, session.Daily, session.Cache)
+
+			_, err := bot.Edit(cb.Message, msg, &sopts)
+
+			if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+				log.Error().Err(err).Msg("Error editing stats message")
+				return nil
+			}
+
+			err = bot.Respond(cb, &tb.CallbackResponse{CallbackID: cb.ID, Text: "🔍 Conversion details"})
+
+			if err != nil {
+				log.Error().Err(err).Msg("Error responding to callback")
+			}
+
+		} else if cb.Data == "stats/chart" || cb.Data == "stats/chart/refresh" {
+			// Render a chart of conversions over time
+			handleChartCallback(session, cb)
+
+		} else if strings.HasPrefix(cb.Data, "broadcast/") {
+			// Confirm or cancel a broadcast
+			handleBroadcastCallback(session, cb)
+
+		} else if cb.Data == "notify/unban" {
+			// Subscribe to a notification when the rate-limit ends
+			handleNotifyCallback(session, cb)
+
+		} else if strings.HasPrefix(cb.Data, "settings/") {
+			// Apply the setting, update the menu
+			handleSettingsCallback(session, cb)
+
 		} else {
 			log.Error().Msgf("⚠️ Invalid callback data received: %s", cb.Data)
 		}
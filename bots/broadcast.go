@@ -0,0 +1,102 @@
+package bots
+
+import (
+	"fmt"
+	"strings"
+	"tg-resize-sticker-images/config"
+
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// /broadcast [text]: drafts a broadcast to all users, either from the text or
+// from the message (text or photo) the command replies to
+func handleBroadcast(session *config.Session, message *tb.Message, args []string) {
+	var text, photoId string
+	var entities tb.Entities
+
+	if reply := message.ReplyTo; reply != nil {
+		if reply.Photo != nil {
+			text, entities, photoId = reply.Caption, reply.CaptionEntities, reply.Photo.FileID
+		} else {
+			text, entities = reply.Text, reply.Entities
+		}
+	} else {
+		text = message.Payload
+	}
+
+	if text == "" && photoId == "" {
+		queueText(session, message.Sender,
+			"ℹ️ Usage: /broadcast <text>, or reply to a text or photo message with /broadcast")
+		return
+	}
+
+	// Snapshot the recipients
+	session.Config.Mutex.Lock()
+	recipients := append([]int64{}, session.Config.UniqueUsers...)
+	session.Config.Mutex.Unlock()
+
+	state, err := session.Broadcast.Draft(message.Sender.ID, text, entities, photoId, recipients)
+	if err != nil {
+		queueText(session, message.Sender, fmt.Sprintf("⚠️ Can't create a broadcast: %s.", err))
+		return
+	}
+
+	// Send a preview, with buttons to confirm or cancel this draft only
+	preview := state.Message(message.Sender.ID)
+	preview.Broadcast = false
+	preview.Sopts.ReplyMarkup = &tb.ReplyMarkup{
+		InlineKeyboard: [][]tb.InlineButton{{
+			tb.InlineButton{Text: fmt.Sprintf("✅ Send to %d users", len(recipients)), Data: "broadcast/confirm/" + state.Id},
+			tb.InlineButton{Text: "❌ Cancel", Data: "broadcast/cancel/" + state.Id},
+		}},
+	}
+
+	queueText(session, message.Sender, "📣 *Broadcast preview*: the message below will be sent to every user.")
+	session.Queue.AddToQueue(&preview)
+}
+
+// Handles the confirm and cancel buttons of broadcasts, e.g. "broadcast/confirm/<draft ID>". The
+// buttons only act on the draft they were shown with, so a stale preview can't send a newer draft.
+func handleBroadcastCallback(session *config.Session, cb *tb.Callback) {
+	resp := tb.CallbackResponse{CallbackID: cb.ID}
+	action, id, _ := strings.Cut(strings.TrimPrefix(cb.Data, "broadcast/"), "/")
+
+	if !session.Config.IsAdmin(cb.Sender.ID) {
+		log.Warn().Msgf("🚫 %d tried to use broadcast callback %s", cb.Sender.ID, cb.Data)
+		resp.Text = "🚫 Only admins can manage broadcasts"
+	} else if action == "confirm" {
+		// Create the status message the progress is reported in
+		status, err := session.Bot.Send(cb.Sender, "📣 Starting broadcast...")
+
+		if err != nil {
+			log.Error().Err(err).Msg("Error sending broadcast status message")
+			resp.Text = "⚠️ Could not start broadcast"
+		} else if err = session.Broadcast.Confirm(id, status); err != nil {
+			resp.Text = fmt.Sprintf("⚠️ Could not start broadcast: %s", err)
+
+			if err := session.Bot.Delete(status); err != nil {
+				log.Error().Err(err).Msg("Error deleting broadcast status message")
+			}
+		} else {
+			resp.Text = "📣 Broadcast started"
+		}
+	} else if session.Broadcast.Cancel(id) {
+		log.Info().Msgf("📣 Broadcast cancelled by %d", cb.Sender.ID)
+		resp.Text = "❌ Broadcast cancelled"
+	} else {
+		resp.Text = "ℹ️ Nothing to cancel"
+	}
+
+	if err := session.Bot.Respond(cb, &resp); err != nil {
+		log.Error().Err(err).Msg("Error responding to callback")
+	}
+
+	// Remove the buttons from the preview
+	if action == "confirm" || resp.Text == "❌ Broadcast cancelled" {
+		if _, err := session.Bot.EditReplyMarkup(cb.Message, nil); err != nil {
+			log.Error().Err(err).Msg("Error removing broadcast buttons")
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package bots
+
+import (
+	"strings"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/stats"
+
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Sends a chart of conversions over time, or re-renders a sent one
+func handleChartCallback(session *config.Session, cb *tb.Callback) {
+	resp := tb.CallbackResponse{CallbackID: cb.ID, Text: "📈 Rendering chart..."}
+
+	photo, sopts, err := stats.BuildChartMsg(session.History)
+	if err != nil {
+		log.Error().Err(err).Msg("⚠️ Rendering statistics chart failed")
+		resp.Text = "⚠️ Rendering the chart failed"
+	} else if cb.Data == "stats/chart/refresh" {
+		// Replace the chart in the message the button is attached to
+		_, err = session.Bot.EditMedia(cb.Message, photo, &sopts)
+
+		if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+			log.Error().Err(err).Msg("Error editing chart message")
+		}
+
+		resp.Text = "🔄 Chart refreshed"
+	} else {
+		// Send the chart as a new photo
+		msg := queue.Message{Recipient: cb.Sender, Media: photo, Sopts: sopts}
+		session.Queue.AddToQueue(&msg)
+	}
+
+	if err := session.Bot.Respond(cb, &resp); err != nil {
+		log.Error().Err(err).Msg("Error responding to callback")
+	}
+}
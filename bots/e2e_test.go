@@ -0,0 +1,573 @@
+package bots
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tg-resize-sticker-images/admission"
+	"tg-resize-sticker-images/alerts"
+	"tg-resize-sticker-images/broadcast"
+	"tg-resize-sticker-images/cache"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/daily"
+	"tg-resize-sticker-images/history"
+	"tg-resize-sticker-images/limits"
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/prefs"
+	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/reports"
+	"tg-resize-sticker-images/resize"
+	"tg-resize-sticker-images/spam"
+	"tg-resize-sticker-images/telegramtest"
+	"tg-resize-sticker-images/templates"
+
+	"golang.org/x/time/rate"
+	tb "gopkg.in/telebot.v3"
+)
+
+// How long to wait for the bot to respond
+const responseTimeout = 5 * time.Second
+
+// Owner of the test bot, receiving alerts
+const testOwner = 7
+
+// Starts a bot against a fake Bot API server, with all state kept in a temporary directory.
+// The bot is attached to the server instead of polling it, and handles each update before
+// the test goes on; only sending messages happens in the background.
+func startBot(t *testing.T) (*config.Session, *telegramtest.Server) {
+	return startBotWith(t, true)
+}
+
+// Starts a bot like startBot. Unless synchronous, every update is handled in its own
+// goroutine as in production, and the test goes on while it's being handled.
+func startBotWith(t *testing.T, synchronous bool) (*config.Session, *telegramtest.Server) {
+	server := telegramtest.NewServer()
+	dir := t.TempDir()
+
+	bot, err := tb.NewBot(tb.Settings{
+		URL:         server.URL,
+		Token:       telegramtest.Token,
+		Synchronous: synchronous,
+	})
+
+	if err != nil {
+		server.Close()
+		t.Fatalf("Creating bot failed: %s", err)
+	}
+
+	conf := &config.Config{
+		Owner:           testOwner,
+		ConversionRate:  100,
+		Tiers:           spam.DefaultTiers(),
+		UserTiers:       make(map[int64]string),
+		Penalties:       spam.DefaultPenalties(),
+		LoadShedding:    admission.DefaultLimits(),
+		ImageLimits:     limits.DefaultLimits(),
+		ConversionCache: 100,
+		Reports:         reports.DefaultSettings(),
+		Alerts:          alerts.DefaultSettings(),
+		SendRate:        20,
+		SendBurst:       2,
+		UniqueUsers:     []int64{},
+	}
+
+	aspam := spam.NewAntiSpam()
+	aspam.SetTiers(conf.TierSettings())
+	aspam.SetPenalties(conf.Penalties)
+
+	sendQueue := &queue.SendQueue{Limiter: rate.NewLimiter(rate.Inf, 1)}
+
+	session := &config.Session{
+		Bot:       bot,
+		Config:    conf,
+		Spam:      aspam,
+		Queue:     sendQueue,
+		Daily:     daily.NewConversionStatistics(),
+		History:   history.New(filepath.Join(dir, "history.json")),
+		Prefs:     prefs.NewStore(filepath.Join(dir, "preferences")),
+		Broadcast: broadcast.NewBroadcaster(filepath.Join(dir, "broadcast.json"), bot, sendQueue),
+		Admission: admission.NewController(filepath.Join(dir, "maintenance.json"), conf.LoadShedding, resize.MemoryInUse),
+		Reports:   reports.NewCollector(filepath.Join(dir, "reports.json")),
+		Alerts:    alerts.NewMonitor(conf.Alerts),
+		Cache:     cache.New(conf.ConversionCache),
+		Vnum:      "test",
+	}
+
+	// The sender is stopped before the server is closed, as cleanups run last-in first-out
+	t.Cleanup(server.Close)
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		MessageSender(session, stop)
+		close(stopped)
+	}()
+
+	t.Cleanup(func() {
+		close(stop)
+		<-stopped
+	})
+
+	SetupBot(session)
+	server.Attach(bot)
+
+	return session, server
+}
+
+// Waits for the next request of a method, failing the test if none arrives
+func waitFor(t *testing.T, server *telegramtest.Server, method string) telegramtest.Request {
+	t.Helper()
+
+	request, err := server.Wait(method, responseTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return request
+}
+
+// Waits for the bot to reach a state after responding, e.g. counting a sent conversion
+func waitUntil(condition func() bool) bool {
+	deadline := time.Now().Add(responseTimeout)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// Returns the conversions counted in the statistics, and how many of them were resent from the cache.
+// They are counted by the sender once Telegram answers, so tests wait for them with waitUntil.
+func conversions(session *config.Session) (int, int64) {
+	session.Config.Mutex.Lock()
+	defer session.Config.Mutex.Unlock()
+
+	return session.Config.StatConverted, session.Config.StatBreakdown.Cached
+}
+
+// Returns the callback data of every inline button of a message
+func buttonData(message *tb.Message) []string {
+	data := []string{}
+	if message.ReplyMarkup == nil {
+		return data
+	}
+
+	for _, row := range message.ReplyMarkup.InlineKeyboard {
+		for _, button := range row {
+			data = append(data, button.Data)
+		}
+	}
+
+	return data
+}
+
+// Encodes a PNG of the given size
+func testPNG(t *testing.T, width int, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, height/2, color.NRGBA{R: 255, A: 255})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Encoding test image failed: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestHelpCommand(t *testing.T) {
+	session, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+
+	message := server.SendText(user, "/help")
+	request := waitFor(t, server, "sendMessage")
+
+	expected := templates.HelpMessage(locale.For("en"), message, session.Spam)
+	if request.Params["chat_id"] != "42" || request.Params["text"] != expected {
+		t.Errorf("Expected the help message in chat 42, got %+v", request.Params)
+	}
+
+	if request.Params["parse_mode"] != "Markdown" {
+		t.Errorf("Expected the help message to be Markdown, got %q", request.Params["parse_mode"])
+	}
+}
+
+func TestStatsKeyboard(t *testing.T) {
+	_, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+
+	server.SendText(user, "/stats")
+	request := waitFor(t, server, "sendMessage")
+
+	buttons := strings.Join(buttonData(request.Message), " ")
+	if buttons != "stats/refresh stats/chart stats/details" {
+		t.Fatalf("Expected the statistics keyboard, got %q", buttons)
+	}
+
+	// The details page replaces the overview in the same message
+	callback := server.PressButton(user, request.Message, "stats/details")
+	edit := waitFor(t, server, "editMessageText")
+
+	if edit.Message.ID != request.Message.ID || !strings.Contains(edit.Params["text"], "Conversion details") || !strings.Contains(edit.Params["text"], "Conversion cache") {
+		t.Errorf("Expected the message to show the details, got %+v", edit.Params)
+	}
+
+	if answer := waitFor(t, server, "answerCallbackQuery"); answer.Params["callback_query_id"] != callback.ID {
+		t.Errorf("Expected the callback to be answered, got %+v", answer.Params)
+	}
+}
+
+func TestConcurrentHandlers(t *testing.T) {
+	session, server := startBotWith(t, false)
+	const users = 4
+
+	// Every user converts an image and looks at the statistics, handled all at once
+	for i := 0; i < users; i++ {
+		user := tb.User{ID: int64(100 + i), FirstName: "Test", LanguageCode: "en"}
+
+		server.SendPhoto(user, testPNG(t, 600+i, 400))
+		server.SendText(user, "/stats")
+	}
+
+	counted := func() bool {
+		converted, _ := conversions(session)
+		return converted == users
+	}
+
+	if !waitUntil(counted) {
+		converted, _ := conversions(session)
+		t.Fatalf("Expected %d conversions to be counted, got %d", users, converted)
+	}
+
+	if sent := len(server.Requests("sendDocument")); sent != users {
+		t.Errorf("Expected %d converted images, got %d", users, sent)
+	}
+
+	session.Config.Mutex.Lock()
+	uniqueUsers := len(session.Config.UniqueUsers)
+	session.Config.Mutex.Unlock()
+
+	if uniqueUsers != users {
+		t.Errorf("Expected %d unique users, got %d", users, uniqueUsers)
+	}
+}
+
+func TestPhotoConversion(t *testing.T) {
+	session, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+	loc := locale.For("en")
+
+	server.SendPhoto(user, testPNG(t, 1024, 768))
+	request := waitFor(t, server, "sendDocument")
+
+	// The converted image fits the sticker size
+	config, format, err := image.DecodeConfig(bytes.NewReader(request.Files["document"].Data))
+	if err != nil {
+		t.Fatalf("Expected a PNG document, got an error: %s", err)
+	}
+
+	if format != "png" || config.Width != 512 || config.Height != 384 {
+		t.Errorf("Expected a 512x384 PNG, got a %dx%d %s", config.Width, config.Height, format)
+	}
+
+	expected := templates.CaptionMessage(loc, templates.CaptionData{Mode: "sticker", Width: 512, Height: 384, Format: prefs.FormatPNG})
+	if request.Params["caption"] != expected {
+		t.Errorf("Expected caption %q, got %q", expected, request.Params["caption"])
+	}
+
+	if buttons := buttonData(request.Message); len(buttons) != 1 || buttons[0] != "mode/switch" {
+		t.Fatalf("Expected a button switching modes, got %v", buttons)
+	}
+
+	// Switching modes from the converted image confirms it, and updates the button
+	server.PressButton(user, request.Message, "mode/switch")
+	waitFor(t, server, "answerCallbackQuery")
+
+	edit := waitFor(t, server, "editMessageCaption")
+	if edit.Message.ReplyMarkup.InlineKeyboard[0][0].Text != loc.Text("mode.switch_to_sticker", nil) {
+		t.Errorf("Expected the button to switch back to sticker mode, got %+v", edit.Message.ReplyMarkup)
+	}
+
+	waitFor(t, server, "sendMessage")
+
+	if !session.Prefs.Get(user.ID).InEmojiMode {
+		t.Errorf("Expected the user to be in emoji mode")
+	}
+
+	counted := func() bool {
+		converted, _ := conversions(session)
+		return converted == 1
+	}
+
+	if !waitUntil(counted) {
+		converted, _ := conversions(session)
+		t.Errorf("Expected 1 conversion to be counted, got %d", converted)
+	}
+}
+
+func TestDownloadFailure(t *testing.T) {
+	session, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+
+	server.FailNext("getFile", telegramtest.Failure{Code: 400, Description: "Bad Request: invalid file_id"})
+	server.SendPhoto(user, testPNG(t, 64, 64))
+
+	request := waitFor(t, server, "sendMessage")
+	if request.Params["text"] != locale.For("en").Text("download.failed", nil) {
+		t.Errorf("Expected the user to be told the download failed, got %q", request.Params["text"])
+	}
+
+	report := session.Reports.Close(reports.Daily, time.Now())
+	if report.Current.Errors[alerts.Download] != 1 {
+		t.Errorf("Expected the download error to be counted, got %v", report.Current.Errors)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	session, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+
+	session.Config.Mutex.Lock()
+	session.Config.ImageLimits.MaxDownloadMB = 1
+	session.Config.Mutex.Unlock()
+
+	server.SendDocument(user, make([]byte, 2*1024*1024), "huge.png", "image/png")
+
+	request := waitFor(t, server, "sendMessage")
+	if request.Params["text"] != locale.For("en").Text("limits.download", locale.Args{"max": 1}) {
+		t.Errorf("Expected the user to be told the file is over the limit, got %q", request.Params["text"])
+	}
+
+	// The file is refused from its size alone
+	if n := len(server.Requests("getFile")); n != 0 {
+		t.Errorf("Expected the file not to be downloaded, got %d getFile requests", n)
+	}
+}
+
+func TestSendFailureAlertsAdmins(t *testing.T) {
+	session, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+
+	// A single failed send crosses the threshold
+	settings := alerts.DefaultSettings()
+	settings.Thresholds[alerts.Send] = 1
+	session.Alerts.SetSettings(settings)
+
+	server.FailNext("sendDocument", telegramtest.TooManyRequests(3))
+	server.SendPhoto(user, testPNG(t, 64, 64))
+
+	waitFor(t, server, "sendDocument")
+
+	// The user is told to try again, and the owner is alerted
+	recipients := map[string]string{}
+	for i := 0; i < 2; i++ {
+		request := waitFor(t, server, "sendMessage")
+		recipients[request.Params["chat_id"]] = request.Params["text"]
+	}
+
+	if recipients["42"] != locale.For("en").Text("send.failed", nil) {
+		t.Errorf("Expected the user to be told the send failed, got %q", recipients["42"])
+	}
+
+	if !strings.Contains(recipients["7"], "send error(s)") || !strings.Contains(recipients["7"], "retry after 3") {
+		t.Errorf("Expected the owner to be alerted of the send error, got %q", recipients["7"])
+	}
+
+	// The user is only notified once the send has failed, so it would have been counted by now
+	if converted, _ := conversions(session); converted != 0 {
+		t.Errorf("Expected the failed send not to be counted, got %d", converted)
+	}
+}
+
+func TestCachedConversion(t *testing.T) {
+	session, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+	other := tb.User{ID: 43, FirstName: "Other", LanguageCode: "de"}
+
+	original := server.SendPhoto(user, testPNG(t, 1024, 768))
+	converted := waitFor(t, server, "sendDocument")
+
+	// The document is cached once Telegram answers with its file ID
+	cached := func() bool {
+		size, _, _ := session.Cache.Stats()
+		return size == 1
+	}
+
+	if !waitUntil(cached) {
+		t.Fatalf("Expected the sent document to be cached")
+	}
+
+	// Another user sending the same file gets the uploaded document, with a caption in their language
+	server.SendAgain(other, original)
+	resent := waitFor(t, server, "sendDocument")
+
+	if len(resent.Files) != 0 || resent.Params["document"] != converted.Message.Document.FileID {
+		t.Errorf("Expected the converted document to be resent by file ID, got %+v", resent.Params)
+	}
+
+	expected := templates.CaptionMessage(locale.For("de"), templates.CaptionData{Mode: "sticker", Width: 512, Height: 384, Format: prefs.FormatPNG})
+	if resent.Params["caption"] != expected {
+		t.Errorf("Expected caption %q, got %q", expected, resent.Params["caption"])
+	}
+
+	if buttons := buttonData(resent.Message); len(buttons) != 1 || buttons[0] != "mode/switch" {
+		t.Errorf("Expected a button switching modes, got %v", buttons)
+	}
+
+	// The file was only downloaded once, but both conversions count
+	if n := len(server.Requests("getFile")); n != 1 {
+		t.Errorf("Expected a single download, got %d", n)
+	}
+
+	counted := func() bool {
+		converted, resent := conversions(session)
+		return converted == 2 && resent == 1
+	}
+
+	if !waitUntil(counted) {
+		converted, resent := conversions(session)
+		t.Errorf("Expected 2 conversions to be counted, 1 of them cached, got %d and %d", converted, resent)
+	}
+
+	// Other options are converted anew
+	session.Prefs.Update(user.ID, func(userPrefs *prefs.Preferences) { userPrefs.InEmojiMode = true })
+	server.SendAgain(user, original)
+
+	if request := waitFor(t, server, "sendDocument"); request.Files["document"].Data == nil {
+		t.Errorf("Expected an emoji conversion to be uploaded, got %+v", request.Params)
+	}
+
+	// A file ID Telegram no longer accepts is replaced by converting the image again
+	server.FailNext("sendDocument", telegramtest.Failure{Code: 400, Description: "Bad Request: wrong file identifier/HTTP URL specified"})
+	server.SendAgain(other, original)
+	waitFor(t, server, "sendDocument")
+
+	reconverted := waitFor(t, server, "sendDocument")
+	if reconverted.Files["document"].Data == nil {
+		t.Errorf("Expected the conversion to be uploaded again, got %+v", reconverted.Params)
+	}
+
+	if n := len(server.Requests("getFile")); n != 3 {
+		t.Errorf("Expected the image to be downloaded again, got %d downloads", n)
+	}
+
+	recached := func() bool {
+		entry, found := session.Cache.Get(cache.NewKey(original.Photo.UniqueID, prefs.Preferences{}))
+		return found && entry.FileID == reconverted.Message.Document.FileID
+	}
+
+	if !waitUntil(recached) {
+		t.Errorf("Expected the new conversion to replace the rejected one in the cache")
+	}
+
+	// Only the conversions that were sent are reported: the rejected resend isn't, its replacement is
+	if report := session.Reports.Close(reports.Daily, time.Now()); report.Current.Conversions != 4 {
+		t.Errorf("Expected 4 reported conversions, got %d", report.Current.Conversions)
+	}
+}
+
+func TestAdminCommandRefused(t *testing.T) {
+	_, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "de"}
+
+	server.SendText(user, "/whois 43")
+
+	request := waitFor(t, server, "sendMessage")
+	if request.Params["text"] != locale.For("de").Text("error.admin_only", nil) {
+		t.Errorf("Expected the refusal in the user's language, got %q", request.Params["text"])
+	}
+}
+
+func TestBannedUserIsIgnored(t *testing.T) {
+	session, server := startBot(t)
+	user := tb.User{ID: 42, FirstName: "Test", LanguageCode: "en"}
+	other := tb.User{ID: 43, FirstName: "Other", LanguageCode: "en"}
+
+	server.SendText(user, "/stats")
+	statsMessage := waitFor(t, server, "sendMessage").Message
+
+	session.Spam.BanChat(user.ID, spam.PermanentBan)
+
+	// Neither buttons nor images of a banned user are handled
+	server.PressButton(user, statsMessage, "stats/refresh")
+	server.SendPhoto(user, testPNG(t, 100, 100))
+
+	// Replies are sent in order, so anything queued for the banned user would be sent first
+	server.SendText(other, "/help")
+	if request := waitFor(t, server, "sendMessage"); request.Params["chat_id"] != "43" {
+		t.Errorf("Expected only the other user to get a reply, got %+v", request.Params)
+	}
+
+	for _, method := range []string{"answerCallbackQuery", "editMessageText", "getFile", "sendDocument"} {
+		if requests := server.Requests(method); len(requests) != 0 {
+			t.Errorf("Expected no %s requests for a banned user, got %d", method, len(requests))
+		}
+	}
+}
+
+func TestBroadcastToBlockedUsers(t *testing.T) {
+	session, server := startBot(t)
+
+	// A single failed send would alert the owner
+	settings := alerts.DefaultSettings()
+	settings.Thresholds[alerts.Send] = 1
+	session.Alerts.SetSettings(settings)
+
+	status, err := session.Bot.Send(&tb.User{ID: testOwner}, "📣 Broadcast")
+	if err != nil {
+		t.Fatalf("Sending status message failed: %s", err)
+	}
+
+	draft, err := session.Broadcast.Draft(testOwner, "News", nil, "", []int64{42, 43})
+	if err != nil {
+		t.Fatalf("Drafting broadcast failed: %s", err)
+	}
+
+	server.FailNext("sendMessage", telegramtest.Failure{Code: 403, Description: "Forbidden: bot was blocked by the user"})
+	if err := session.Broadcast.Confirm(draft.Id, status); err != nil {
+		t.Fatalf("Confirming broadcast failed: %s", err)
+	}
+
+	edit := waitFor(t, server, "editMessageText")
+	if !strings.Contains(edit.Params["text"], "finished") || !strings.Contains(edit.Params["text"], "Blocked: 1") {
+		t.Errorf("Expected the broadcast to finish with a blocked recipient, got %q", edit.Params["text"])
+	}
+
+	// Recipients that blocked the bot are expected, and aren't send errors
+	report := session.Reports.Close(reports.Daily, time.Now())
+	if report.Current.Errors[alerts.Send] != 0 {
+		t.Errorf("Expected no send errors, got %v", report.Current.Errors)
+	}
+}
+
+func TestTierNamesAreEscaped(t *testing.T) {
+	session, server := startBot(t)
+	owner := tb.User{ID: testOwner, FirstName: "Owner", LanguageCode: "en"}
+
+	session.Config.Tiers["power_users"] = spam.Tier{HourlyLimit: 1000}
+	session.Spam.SetTiers(session.Config.TierSettings())
+
+	server.SendText(owner, "/tier 43 power_users")
+
+	if text := waitFor(t, server, "sendMessage").Params["text"]; !strings.Contains(text, "power\\_users") {
+		t.Errorf("Expected the tier name to be escaped, got %q", text)
+	}
+
+	server.SendText(owner, "/limits")
+
+	expected := "power\\_users: " + templates.TierLimits(locale.For("en"), spam.Tier{HourlyLimit: 1000})
+	if text := waitFor(t, server, "sendMessage").Params["text"]; !strings.Contains(text, expected) {
+		t.Errorf("Expected the tiers to be listed with escaped names, got %q", text)
+	}
+}
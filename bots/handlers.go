@@ -2,9 +2,16 @@ package bots
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
+	"runtime/debug"
+	"tg-resize-sticker-images/alerts"
+	"tg-resize-sticker-images/analytics"
+	"tg-resize-sticker-images/cache"
 	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/limits"
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/prefs"
 	"tg-resize-sticker-images/queue"
 	"tg-resize-sticker-images/resize"
 	"tg-resize-sticker-images/spam"
@@ -19,12 +26,18 @@ import (
 )
 
 func sendDocument(session *config.Session, msg *queue.Message) {
+	// File type of the image, PNG unless specified
+	fileType := msg.FileType
+	if fileType == "" {
+		fileType = "png"
+	}
+
 	// Send as a document: create object
 	doc := tb.Document{
 		File:     tb.FromReader(bytes.NewReader(*msg.Bytes)),
 		Caption:  msg.Caption,
-		MIME:     "image/png",
-		FileName: fmt.Sprintf("resized-%s.png", uuid.NewString()[0:8]),
+		MIME:     "image/" + fileType,
+		FileName: fmt.Sprintf("resized-%s.%s", uuid.NewString()[0:8], fileType),
 	}
 
 	// Disable notifications
@@ -32,12 +45,14 @@ func sendDocument(session *config.Session, msg *queue.Message) {
 	sendOpts.DisableNotification = true
 
 	// Send
-	_, err := doc.Send(session.Bot, msg.Recipient, &sendOpts)
+	sent, err := doc.Send(session.Bot, msg.Recipient, &sendOpts)
+	msg.Done(sent, err)
 
 	if err != nil {
 		log.Error().Err(err).Msg("⚠️ Error sending message in sendDocument (notifying user)")
+		recordError(session, alerts.Send, err)
 
-		_, err := session.Bot.Send(msg.Recipient, "🚦 Error sending resized image! Please try again.")
+		_, err := session.Bot.Send(msg.Recipient, userLocale(session, msg.Recipient).Text("send.failed", nil))
 
 		if err != nil {
 			log.Error().Err(err).Msg("Unable to notify user about send failure")
@@ -47,24 +62,45 @@ func sendDocument(session *config.Session, msg *queue.Message) {
 	}
 
 	// If message is successfully sent, +1 conversion
-	stats.StatsPlusOneConversion(session.Config)
+	countConversion(session, msg.Recipient.ID, msg.Details)
+}
+
+// Counts a conversion that was sent to the user in the statistics
+func countConversion(session *config.Session, recipient int64, details *analytics.Conversion) {
+	stats.StatsPlusOneConversion(session.Config, details)
 
 	// Add to trailing daily stats
-	session.Daily.AddConversionByUser(msg.Recipient.ID)
-}
+	if details != nil {
+		session.Daily.AddConversion(recipient, *details)
+	} else {
+		session.Daily.AddConversionByUser(recipient)
+	}
 
-func getBytes(session *config.Session, message *tb.Message, mediaType string) (*bytes.Buffer, error) {
-	// Variables
-	var tbFile *tb.File
+	// Add to persisted long-term stats
+	session.History.AddConversion(time.Now())
+}
 
+// Returns the file of the received media
+func mediaFile(message *tb.Message, mediaType string) *tb.File {
 	// Get file with a method corresponding to the media type
 	switch mediaType {
 	case "photo":
-		tbFile = message.Photo.MediaFile()
+		return message.Photo.MediaFile()
 	case "document":
-		tbFile = message.Document.MediaFile()
+		return message.Document.MediaFile()
 	case "sticker":
-		tbFile = message.Sticker.MediaFile()
+		return message.Sticker.MediaFile()
+	}
+
+	return &tb.File{}
+}
+
+func getBytes(session *config.Session, message *tb.Message, mediaType string, imageLimits limits.Limits) (*bytes.Buffer, error) {
+	tbFile := mediaFile(message, mediaType)
+
+	// Refuse files over the download limit without downloading them, if Telegram knows their size
+	if err := imageLimits.CheckDownload(tbFile.FileSize); err != nil {
+		return &bytes.Buffer{}, err
 	}
 
 	// Get file
@@ -75,70 +111,254 @@ func getBytes(session *config.Session, message *tb.Message, mediaType string) (*
 		return &bytes.Buffer{}, err
 	}
 
-	// Copy file contents to imgBuf
-	var imgBuf bytes.Buffer
-	_, err = io.Copy(&imgBuf, file)
+	defer file.Close()
+
+	// Stream file contents to imgBuf, stopping as soon as the download limit is crossed
+	imgBuf, err := imageLimits.Read(file)
 
 	if err != nil {
 		log.Error().Err(err).Msg("Error copying image to buffer")
 		return &bytes.Buffer{}, err
 	}
 
-	return &imgBuf, nil
+	return imgBuf, nil
+}
+
+// Result of a conversion run in the background
+type conversion struct {
+	msg      *queue.Message // Message with the converted image, or an error caption
+	err      error          // Error converting the image
+	panicked any            // Value the conversion panicked with, if it did
+}
+
+// Resizes an image, giving up once the conversion timeout passes. vips can't be interrupted,
+// so a conversion that timed out runs to completion in the background, and only releases its
+// admission slot then: the returned bool tells if that is the case.
+func convert(session *config.Session, imgBytes *bytes.Buffer, userPrefs prefs.Preferences, loc *locale.Localizer, imageLimits limits.Limits) (*queue.Message, bool, error) {
+	timeout := imageLimits.Timeout()
+	if timeout == 0 {
+		msg, err := resize.ResizeImage(imgBytes, userPrefs, loc, imageLimits)
+		return msg, false, err
+	}
+
+	started := time.Now()
+	done := make(chan conversion, 1)
+
+	go func() {
+		// Hand panics over to the handler, so they are recovered from like any other
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Error().Str("stack", string(debug.Stack())).Msgf("🔥 Conversion panicked: %v", recovered)
+				done <- conversion{panicked: recovered}
+			}
+		}()
+
+		msg, err := resize.ResizeImage(imgBytes, userPrefs, loc, imageLimits)
+		done <- conversion{msg: msg, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		if result.panicked != nil {
+			panic(result.panicked)
+		}
+
+		return result.msg, false, result.err
+
+	case <-timer.C:
+	}
+
+	go func() {
+		<-done
+		session.Admission.Release()
+		log.Warn().Msgf("⏱ Conversion that timed out finished after %s", time.Since(started).Round(time.Millisecond))
+	}()
+
+	msg := queue.Message{
+		Recipient: nil,
+		Bytes:     nil,
+		Caption:   loc.Text("limits.timeout", nil),
+	}
+
+	return &msg, true, fmt.Errorf("%w after %s", limits.ErrTimeout, timeout)
+}
+
+// Checks if Telegram refused to send a file by its ID, e.g. because the file is no longer available
+func fileIDRejected(err error) bool {
+	var tbErr *tb.Error
+	return errors.As(err, &tbErr) && tbErr.Code == 400
+}
+
+// Builds a message resending a cached conversion by its file ID. Like a converted image, it's only counted once
+// sent; if Telegram no longer accepts the file ID, the conversion is dropped from the cache and the image is
+// converted again.
+func cachedMessage(session *config.Session, message *tb.Message, key cache.Key, entry cache.Entry, userPrefs prefs.Preferences, mediaType string, latency time.Duration) *queue.Message {
+	recipient := message.Sender
+
+	details := entry.Details
+	details.MediaType = mediaType
+	details.Cached = true
+	details.Latency = latency
+
+	// Whether the chat is new is known now, before the handler records it as a user
+	newChat := !stats.ChatExists(recipient.ID, session.Config)
+
+	// The caption is built for this user, in their language and with their caption preferences
+	loc := userPrefs.Locale(recipient.LanguageCode)
+	caption, sopts := resize.Reply(loc, userPrefs, details)
+	sopts.DisableNotification = true
+
+	return &queue.Message{
+		Recipient: recipient,
+		Media:     &tb.Document{File: tb.File{FileID: entry.FileID}, Caption: caption},
+		Caption:   caption,
+		Sopts:     sopts,
+		Details:   &details,
+		Callback: func(sent *tb.Message, err error) {
+			if err != nil {
+				session.Cache.Remove(key)
+
+				// The sender holds the send queue while running callbacks, so convert in the background
+				if fileIDRejected(err) {
+					log.Warn().Err(err).Msgf("♻️ Cached conversion of %s was rejected, converting it again", key.FileUniqueID)
+					go reconvertMedia(session, message, mediaType, userPrefs, key)
+					return
+				}
+
+				if _, err := session.Bot.Send(recipient, loc.Text("send.failed", nil)); err != nil {
+					log.Error().Err(err).Msg("Unable to notify user about send failure")
+				}
+
+				return
+			}
+
+			session.Reports.AddConversion(recipient.ID, newChat)
+			countConversion(session, recipient.ID, &details)
+		},
+	}
+}
+
+// Returns the localizer for the user's language setting, or the language of their Telegram client
+func userLocale(session *config.Session, user *tb.User) *locale.Localizer {
+	return session.Prefs.Get(user.ID).Locale(user.LanguageCode)
 }
 
 // Handles incoming media, i.e. those caught by tb.OnPhoto, tb.OnDocument etc.
 func handleIncomingMedia(session *config.Session, message *tb.Message, mediaType string) {
+	// Admission control: refuse conversions during maintenance or under high load, before they count
+	if err := session.Admission.Acquire(session.Queue.Backlog()); err != nil {
+		refuseConversion(session, message, err)
+		return
+	}
+
+	// A conversion that timed out releases its slot itself, once it finishes
+	timedOut := false
+	defer func() {
+		if !timedOut {
+			session.Admission.Release()
+		}
+	}()
+
 	// Anti-spam: return if user is not allowed to convert
-	if !spam.ConversionPreHandler(session.Spam, message.Sender.ID) {
+	if !spam.ConversionPreHandler(session.Spam, message.Sender.ID, message.AlbumID) {
 		log.Debug().Msgf("🚦 Chat %d is ratelimited", message.Sender.ID)
+		session.Reports.AddRateLimited(message.Sender.ID)
 
-		// Extract pointer to user's spam log
-		userSpam := session.Spam.ChatConversionLog[message.Sender.ID]
-
-		if userSpam.RateLimitMessageSent {
-			/* Check if the message has already been sent recently
-			This simply avoids spamming the same rate-limit message 50 times. */
-			if time.Since(userSpam.RateLimitMessageSentAt) < time.Minute {
-				log.Debug().Msgf("Rate-limit message for %d has been already sent recently, not sending again",
-					message.Sender.ID)
-				return
-			}
+		// Avoid spamming the same rate-limit message over and over
+		if !session.Spam.ShouldSendRateLimitMessage(message.Sender.ID) {
+			log.Debug().Msgf("Rate-limit message for %d has been already sent recently, not sending again",
+				message.Sender.ID)
+			return
 		}
 
 		// Construct message
 		msg := queue.Message{
 			Recipient: message.Sender,
 			Bytes:     nil,
-			Caption:   templates.RatelimitedMessage(session.Spam, message.Sender.ID),
-			Sopts:     tb.SendOptions{ParseMode: "Markdown"},
+			Caption:   templates.RatelimitedMessage(userLocale(session, message.Sender), session.Spam, message.Sender.ID),
+			Sopts:     ratelimitSendOptions(session, message.Sender),
 		}
 
 		// Add to send queue
 		session.Queue.AddToQueue(&msg)
 
-		// Update the RateLimitMessageSent flag + time sent at
-		session.Spam.ChatReceivedRateLimitMessage(message.Sender.ID)
+		return
+	}
+
+	// Time the conversion from here on
+	started := time.Now()
+	userPrefs := session.Prefs.Get(message.Sender.ID)
+	key := cache.NewKey(mediaFile(message, mediaType).UniqueID, userPrefs)
 
+	// Repeats of a recent conversion resend the document sent the first time, without downloading or converting
+	if entry, found := session.Cache.Get(key); found {
+		log.Debug().Msgf("♻️ Resending cached conversion of %s", key.FileUniqueID)
+		session.Queue.AddToQueue(cachedMessage(session, message, key, entry, userPrefs, mediaType, time.Since(started)))
+		updateLastUser(session, message.Sender.ID)
 		return
 	}
 
+	timedOut = convertMedia(session, message, mediaType, userPrefs, key, started)
+}
+
+// Converts an image again after its cached conversion couldn't be resent. It was already counted
+// against the user's limits when it was received, but it's admitted like any other conversion.
+func reconvertMedia(session *config.Session, message *tb.Message, mediaType string, userPrefs prefs.Preferences, key cache.Key) {
+	if err := session.Admission.Acquire(session.Queue.Backlog()); err != nil {
+		refuseConversion(session, message, err)
+		return
+	}
+
+	timedOut := false
+	defer func() {
+		if !timedOut {
+			session.Admission.Release()
+		}
+	}()
+
+	// Not run by a handler, so recover from panics like the middleware would
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Error().Str("stack", string(debug.Stack())).Msgf("🔥 Recovered from panic while converting again: %v", recovered)
+			recordError(session, alerts.Panic, fmt.Errorf("%v, while converting again", recovered))
+
+			if _, err := session.Bot.Send(message.Sender, userLocale(session, message.Sender).Text("error.internal", nil)); err != nil {
+				log.Error().Err(err).Msgf("Error telling %d about an internal error", message.Sender.ID)
+			}
+		}
+	}()
+
+	timedOut = convertMedia(session, message, mediaType, userPrefs, key, time.Now())
+}
+
+// Downloads and converts the received media, and queues the result for sending. Returns true if the
+// conversion timed out, in which case it releases its admission slot itself once it finishes.
+func convertMedia(session *config.Session, message *tb.Message, mediaType string, userPrefs prefs.Preferences, key cache.Key, started time.Time) bool {
 	// Download
-	imgBytes, err := getBytes(session, message, mediaType)
+	imageLimits := session.Config.ImageLimitSettings()
+	imgBytes, err := getBytes(session, message, mediaType, imageLimits)
 
 	if err != nil {
 		var caption string
-		if err == tb.ErrTooLarge {
-			caption = "File is too large! Try compressing it first."
+		if errors.Is(err, limits.ErrTooLarge) {
+			caption = userLocale(session, message.Sender).Text("limits.download", locale.Args{"max": imageLimits.MaxDownloadMB})
+			session.Reports.AddError("file over download limit")
+		} else if err == tb.ErrTooLarge {
+			caption = userLocale(session, message.Sender).Text("download.too_large", nil)
+			session.Reports.AddError("file too large")
 		} else {
-			caption = "Could not download image: use a different image, or try again later."
+			caption = userLocale(session, message.Sender).Text("download.failed", nil)
+			recordError(session, alerts.Download, err)
 		}
 
 		// Construct error message
 		msg := queue.Message{
 			Recipient: message.Sender,
 			Bytes:     nil,
-			Caption:   fmt.Sprintf("⚠️ %s", caption),
+			Caption:   caption,
 		}
 
 		// Add to send queue
@@ -146,19 +366,46 @@ func handleIncomingMedia(session *config.Session, message *tb.Message, mediaType
 
 		// Log error
 		log.Error().Err(err).Msgf("Error downloading image (caption='%s')", caption)
-		return
+		return false
 	}
 
 	// Resize, set message recipient
-	msg, _ := resize.ResizeImage(imgBytes, session.Spam.GetConversionMode(message.Sender.ID))
+	msg, timedOut, err := convert(session, imgBytes, userPrefs, userPrefs.Locale(message.Sender.LanguageCode), imageLimits)
 	msg.Recipient = message.Sender
 
+	if errors.Is(err, limits.ErrTooManyPixels) || errors.Is(err, limits.ErrTooManyFrames) {
+		// Refused images are the sender's doing, not errors of the bot
+		session.Reports.AddError("image over limits")
+	} else if err != nil {
+		recordError(session, alerts.Conversion, err)
+	} else {
+		session.Reports.AddConversion(message.Sender.ID, !stats.ChatExists(message.Sender.ID, session.Config))
+	}
+
+	if msg.Details != nil {
+		msg.Details.MediaType = mediaType
+		msg.Details.Latency = time.Since(started)
+
+		// Remember the sent document, so repeats of the conversion can be resent by its file ID
+		entry := cache.Entry{Details: *msg.Details}
+		msg.Callback = func(sent *tb.Message, err error) {
+			if err == nil && sent != nil && sent.Document != nil {
+				entry.FileID = sent.Document.FileID
+				session.Cache.Add(key, entry)
+			}
+		}
+	}
+
 	// Add to send queue: regardless of resize outcome, the message is sent
 	session.Queue.AddToQueue(msg)
+	updateLastUser(session, message.Sender.ID)
+
+	return timedOut
+}
 
-	// Update stat for count of unique chats in a goroutine
-	if message.Sender.ID != session.LastUser {
-		stats.UpdateUniqueStat(message.Sender.ID, session.Config)
-		stats.UpdateLastUserId(session, message.Sender.ID)
+// Update stat for count of unique chats
+func updateLastUser(session *config.Session, id int64) {
+	if stats.UpdateLastUserId(session, id) {
+		stats.UpdateUniqueStat(id, session.Config)
 	}
 }
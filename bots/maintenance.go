@@ -0,0 +1,86 @@
+package bots
+
+import (
+	"fmt"
+	"strings"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/templates"
+
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Tells the user their conversion was refused due to maintenance or high load
+func refuseConversion(session *config.Session, message *tb.Message, err error) {
+	log.Debug().Err(err).Msgf("🛑 Refused conversion for %d", message.Sender.ID)
+
+	// Avoid replying to every image of a batch
+	if !session.Admission.ShouldNotify(message.Sender.ID) {
+		return
+	}
+
+	// Sent without Markdown, as the maintenance notice is written by an admin
+	msg := queue.Message{
+		Recipient: message.Sender,
+		Bytes:     nil,
+		Caption:   templates.RefusedMessage(userLocale(session, message.Sender), err, session.Admission.Maintenance()),
+	}
+
+	session.Queue.AddToQueue(&msg)
+}
+
+// /maintenance [on|off] [message]: pauses or resumes conversions, or shows the current load
+func handleMaintenance(session *config.Session, message *tb.Message, args []string) {
+	const usage = "/maintenance on|off [message]"
+
+	if len(args) == 0 {
+		maintenance := session.Admission.Maintenance()
+		inFlight, memoryMB := session.Admission.Load()
+
+		status := "off"
+		if maintenance.Enabled {
+			status = "on"
+		}
+
+		queueText(session, message.Sender, fmt.Sprintf(
+			"🛠 *Maintenance mode:* %s\n"+
+				"Conversions in progress: %d\n"+
+				"Messages queued: %d\n"+
+				"Memory in use: %d MB\n\n"+
+				"ℹ️ Usage: %s",
+			status, inFlight, session.Queue.Backlog(), memoryMB, usage,
+		))
+		return
+	}
+
+	var enabled bool
+	switch args[0] {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		queueText(session, message.Sender, "ℹ️ Usage: "+usage)
+		return
+	}
+
+	// The notice is the rest of the payload, keeping its whitespace
+	notice := ""
+	if enabled {
+		notice = strings.TrimSpace(strings.TrimPrefix(message.Payload, args[0]))
+	}
+
+	if err := session.Admission.SetMaintenance(enabled, notice); err != nil {
+		log.Error().Err(err).Msg("⚠️ Saving maintenance mode failed")
+	}
+
+	if enabled {
+		log.Warn().Msgf("🛠 Maintenance mode turned on by %d", message.Sender.ID)
+		queueText(session, message.Sender, "🛠 Maintenance mode is on: media is answered with a notice instead of being converted.")
+	} else {
+		log.Info().Msgf("🛠 Maintenance mode turned off by %d", message.Sender.ID)
+		queueText(session, message.Sender, "✅ Maintenance mode is off: conversions are back on.")
+	}
+}
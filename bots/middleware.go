@@ -0,0 +1,171 @@
+package bots
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"tg-resize-sticker-images/alerts"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/queue"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Key of the request's logger in the handler context
+const loggerKey = "logger"
+
+// Returns the logger of the request, tagged with its correlation ID
+func requestLog(c tb.Context) *zerolog.Logger {
+	if logger, ok := c.Get(loggerKey).(*zerolog.Logger); ok {
+		return logger
+	}
+
+	return &log.Logger
+}
+
+// Adds a reply to the sender of the update to the send queue
+func reply(session *config.Session, c tb.Context, caption string, sopts tb.SendOptions) {
+	msg := queue.Message{
+		Recipient: c.Sender(),
+		Bytes:     nil,
+		Caption:   caption,
+		Sopts:     sopts,
+	}
+
+	session.Queue.AddToQueue(&msg)
+}
+
+// Returns the command of the update, e.g. "/help", if it is one
+func commandOf(c tb.Context) string {
+	if c.Message() == nil || !strings.HasPrefix(c.Message().Text, "/") {
+		return ""
+	}
+
+	command, _, _ := strings.Cut(c.Message().Text, " ")
+	command, _, _ = strings.Cut(command, "@")
+
+	return command
+}
+
+// Describes what the update is, for logs and alerts
+func describeUpdate(c tb.Context) string {
+	switch {
+	case c.Callback() != nil:
+		return fmt.Sprintf("callback %q", c.Callback().Data)
+	case commandOf(c) != "":
+		return "command " + commandOf(c)
+	case c.Message() != nil:
+		return "message"
+	default:
+		return "update"
+	}
+}
+
+// Middleware tagging every update with a correlation ID, and logging it once handled.
+// Commands are logged at info level, except for the owner's; everything else at debug level.
+func logRequests(session *config.Session) tb.MiddlewareFunc {
+	return func(next tb.HandlerFunc) tb.HandlerFunc {
+		return func(c tb.Context) error {
+			logger := log.With().Str("request", uuid.NewString()[0:8]).Logger()
+			if c.Sender() != nil {
+				logger = logger.With().Int64("user", c.Sender().ID).Logger()
+			}
+
+			c.Set(loggerKey, &logger)
+
+			started := time.Now()
+			err := next(c)
+
+			event := logger.Debug()
+			if commandOf(c) != "" && (c.Sender() == nil || !session.Config.IsOwner(c.Sender().ID)) {
+				event = logger.Info()
+			}
+
+			event.Err(err).Dur("took", time.Since(started)).Msgf("📨 Handled %s", describeUpdate(c))
+			return err
+		}
+	}
+}
+
+// Middleware recovering from panics in handlers: the stack is logged, admins are
+// alerted, and the user is told something went wrong, instead of the bot crashing
+func recoverPanics(session *config.Session) tb.MiddlewareFunc {
+	return func(next tb.HandlerFunc) tb.HandlerFunc {
+		return func(c tb.Context) error {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+
+				requestLog(c).Error().Str("stack", string(debug.Stack())).Msgf("🔥 Recovered from panic while handling %s: %v",
+					describeUpdate(c), recovered)
+
+				recordError(session, alerts.Panic, fmt.Errorf("%v, while handling %s", recovered, describeUpdate(c)))
+
+				if sender := c.Sender(); sender != nil {
+					reply(session, c, userLocale(session, sender).Text("error.internal", nil), tb.SendOptions{})
+				}
+			}()
+
+			return next(c)
+		}
+	}
+}
+
+// Middleware ignoring updates from users banned by an admin: their commands, button presses
+// and images. Users that are only rate-limited can still use commands, e.g. to read /help.
+func enforceBans(session *config.Session) tb.MiddlewareFunc {
+	return func(next tb.HandlerFunc) tb.HandlerFunc {
+		return func(c tb.Context) error {
+			if c.Sender() == nil {
+				return next(c)
+			}
+
+			if _, banned, _, manual := session.Spam.ChatStatus(c.Sender().ID); banned && manual {
+				requestLog(c).Debug().Msgf("🚷 Ignored %s from banned user", describeUpdate(c))
+				return nil
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Middleware enforcing the per-user rate-limit of commands and button presses
+func rateLimit(session *config.Session) tb.MiddlewareFunc {
+	return func(next tb.HandlerFunc) tb.HandlerFunc {
+		return func(c tb.Context) error {
+			if c.Sender() != nil {
+				session.Spam.RunUserLimiter(c.Sender().ID, 1)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Middleware rejecting everyone who isn't an admin
+func requireAdmin(session *config.Session) tb.MiddlewareFunc {
+	return func(next tb.HandlerFunc) tb.HandlerFunc {
+		return func(c tb.Context) error {
+			if c.Sender() == nil || !session.Config.IsAdmin(c.Sender().ID) {
+				requestLog(c).Warn().Msgf("🚫 Rejected admin %s", describeUpdate(c))
+
+				if sender := c.Sender(); sender != nil {
+					reply(session, c, userLocale(session, sender).Text("error.admin_only", nil), tb.SendOptions{})
+				}
+
+				return nil
+			}
+
+			requestLog(c).Info().Msgf("👮 Admin ran %s %s", commandOf(c), strings.Join(c.Args(), " "))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package bots
+
+import (
+	"strings"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/queue"
+
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Builds the send options for the rate-limit message, with a notification button
+// for users that are rate-limited instead of banned by an admin
+func ratelimitSendOptions(session *config.Session, user *tb.User) tb.SendOptions {
+	sopts := tb.SendOptions{ParseMode: "Markdown"}
+
+	if _, _, _, manual := session.Spam.ChatStatus(user.ID); !manual {
+		button := tb.InlineButton{
+			Text: userLocale(session, user).Text("ratelimit.notify_button", nil),
+			Data: "notify/unban",
+		}
+
+		sopts.ReplyMarkup = &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{button}}}
+	}
+
+	return sopts
+}
+
+// Handles the notification button of the rate-limit message
+func handleNotifyCallback(session *config.Session, cb *tb.Callback) {
+	loc := userLocale(session, cb.Sender)
+	resp := tb.CallbackResponse{
+		CallbackID: cb.ID,
+		Text:       loc.Text("ratelimit.notify_subscribed", nil),
+	}
+
+	if !session.Spam.NotifyWhenUnbanned(cb.Sender.ID) {
+		resp.Text = loc.Text("ratelimit.notify_not_limited", nil)
+	}
+
+	if err := session.Bot.Respond(cb, &resp); err != nil {
+		log.Error().Err(err).Msg("Error responding to callback")
+	}
+
+	// Remove the button, so the same rate-limit can't be subscribed to twice
+	_, err := session.Bot.EditReplyMarkup(cb.Message, nil)
+
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Error().Err(err).Msg("Error removing notification button")
+	}
+}
+
+// Notifies the subscribed chats whose rate-limit has ended
+func NotifyUnbannedChats(session *config.Session) {
+	chats := session.Spam.DueUnbanNotifications()
+
+	for _, chat := range chats {
+		// Without an update from the user, only their language setting is known
+		msg := queue.Message{
+			Recipient: &tb.User{ID: chat},
+			Bytes:     nil,
+			Caption:   session.Prefs.Get(chat).Locale("").Text("ratelimit.ended", nil),
+			Sopts:     tb.SendOptions{ParseMode: "Markdown"},
+		}
+
+		session.Queue.AddToQueue(&msg)
+	}
+
+	if len(chats) != 0 {
+		log.Debug().Msgf("🔔 Notified %d chat(s) of their rate-limit ending", len(chats))
+	}
+}
@@ -0,0 +1,28 @@
+package bots
+
+import (
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/reports"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Sends the report of the period that just ended to the admins
+func sendReport(session *config.Session, period reports.Period) {
+	session.Reports.ObserveQueue(session.Queue.TakePeak())
+	report := session.Reports.Close(period, time.Now())
+
+	for _, admin := range session.Config.AdminIds() {
+		queueText(session, &tb.User{ID: admin}, report.String())
+	}
+
+	// The period is over: don't count it again if the bot restarts
+	if err := session.Reports.Save(); err != nil {
+		log.Error().Err(err).Msg("⚠️ Saving report counters failed")
+	}
+
+	log.Info().Msgf("📬 Sent %s report: %d conversion(s)", period, report.Current.Conversions)
+}
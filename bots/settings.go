@@ -0,0 +1,133 @@
+package bots
+
+import (
+	"strings"
+	"tg-resize-sticker-images/config"
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/prefs"
+	"tg-resize-sticker-images/templates"
+
+	"github.com/rs/zerolog/log"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Builds a button for the settings menu, with a check-mark if the option is currently selected
+func settingsButton(text string, data string, selected bool) tb.InlineButton {
+	if selected {
+		text = "✅ " + text
+	}
+
+	return tb.InlineButton{Text: text, Data: "settings/" + data}
+}
+
+// Builds the inline keyboard for the settings menu, labelled in the localizer's language
+func settingsSendOptions(loc *locale.Localizer, userPrefs prefs.Preferences) tb.SendOptions {
+	format, fit := userPrefs.OutputFormat(), userPrefs.FitStrategy()
+
+	// Languages are listed by their own names
+	languages := []tb.InlineButton{
+		settingsButton(loc.Text("settings.button.language_auto", nil), "language/auto", userPrefs.Language == ""),
+	}
+
+	for _, language := range locale.Languages() {
+		name := locale.For(language).Text("language.name", nil)
+		languages = append(languages, settingsButton(name, "language/"+language, userPrefs.Language == language))
+	}
+
+	keyboard := [][]tb.InlineButton{
+		{
+			settingsButton(loc.Text("settings.button.sticker", nil), "mode/sticker", !userPrefs.InEmojiMode),
+			settingsButton(loc.Text("settings.button.emoji", nil), "mode/emoji", userPrefs.InEmojiMode),
+		},
+		{
+			settingsButton("PNG", "format/png", format == prefs.FormatPNG),
+			settingsButton("WebP", "format/webp", format == prefs.FormatWebP),
+		},
+		{
+			settingsButton(loc.Text("settings.button.scale", nil), "fit/scale", fit == prefs.FitScale),
+			settingsButton(loc.Text("settings.button.pad", nil), "fit/pad", fit == prefs.FitPad),
+			settingsButton(loc.Text("settings.button.crop", nil), "fit/crop", fit == prefs.FitCrop),
+		},
+		{
+			settingsButton(loc.Text("settings.button.warnings_on", nil), "warnings/on", !userPrefs.HideWarnings),
+			settingsButton(loc.Text("settings.button.warnings_off", nil), "warnings/off", userPrefs.HideWarnings),
+		},
+		{
+			settingsButton(loc.Text("settings.button.captions_full", nil), "captions/full", !userPrefs.ShortCaptions),
+			settingsButton(loc.Text("settings.button.captions_short", nil), "captions/short", userPrefs.ShortCaptions),
+		},
+		languages,
+	}
+
+	return tb.SendOptions{
+		ParseMode:   "Markdown",
+		ReplyMarkup: &tb.ReplyMarkup{InlineKeyboard: keyboard},
+	}
+}
+
+// Applies a settings callback (e.g. "settings/format/webp") to the preferences.
+// Returns false if the callback data is not a valid setting.
+func applySetting(userPrefs *prefs.Preferences, data string) bool {
+	setting, value, found := strings.Cut(strings.TrimPrefix(data, "settings/"), "/")
+	if !found {
+		return false
+	}
+
+	switch setting + "/" + value {
+	case "mode/sticker", "mode/emoji":
+		userPrefs.InEmojiMode = value == "emoji"
+	case "format/png", "format/webp":
+		userPrefs.Format = value
+	case "fit/scale", "fit/pad", "fit/crop":
+		userPrefs.Fit = value
+	case "warnings/on", "warnings/off":
+		userPrefs.HideWarnings = value == "off"
+	case "captions/full", "captions/short":
+		userPrefs.ShortCaptions = value == "short"
+	case "language/auto":
+		userPrefs.Language = ""
+	default:
+		if setting != "language" || !locale.Has(value) {
+			return false
+		}
+
+		userPrefs.Language = value
+	}
+
+	return true
+}
+
+// Handles a callback from the settings menu, editing the menu in place
+func handleSettingsCallback(session *config.Session, cb *tb.Callback) {
+	valid := true
+	userPrefs, err := session.Prefs.Update(cb.Sender.ID, func(userPrefs *prefs.Preferences) {
+		valid = applySetting(userPrefs, cb.Data)
+	})
+
+	if !valid {
+		log.Error().Msgf("⚠️ Invalid settings callback data received: %s", cb.Data)
+		return
+	}
+
+	// Callback response, in the new language if it was changed
+	loc := userPrefs.Locale(cb.Sender.LanguageCode)
+
+	resp := tb.CallbackResponse{CallbackID: cb.ID, Text: loc.Text("settings.saved", nil)}
+	if err != nil {
+		log.Error().Err(err).Msgf("Saving settings for %d failed", cb.Sender.ID)
+		resp.Text = loc.Text("settings.save_failed", nil)
+	}
+
+	if err = session.Bot.Respond(cb, &resp); err != nil {
+		log.Error().Err(err).Msg("Error responding to callback")
+	}
+
+	// Edit the menu to reflect the new settings, if it changed
+	sopts := settingsSendOptions(loc, userPrefs)
+	_, err = session.Bot.Edit(cb.Message, templates.SettingsMessage(loc, userPrefs, cb.Sender.LanguageCode), &sopts)
+
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Error().Err(err).Msg("Error editing settings message")
+	}
+}
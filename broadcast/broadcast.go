@@ -0,0 +1,343 @@
+package broadcast
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/storage"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	tb "gopkg.in/telebot.v3"
+)
+
+const (
+	sendInterval   = 100 * time.Millisecond // Pause between recipients, on top of the send queue's limiter
+	statusInterval = 5 * time.Second        // How often the admin's status message is updated
+	saveInterval   = 25                     // How many recipients are processed between state saves
+	draftTimeout   = time.Hour              // How long a draft blocks other admins from drafting
+)
+
+// Errors returned when managing broadcasts
+var (
+	ErrInProgress  = errors.New("a broadcast is already in progress")
+	ErrNoDraft     = errors.New("no broadcast draft to confirm")
+	ErrStaleDraft  = errors.New("this draft was replaced or already sent")
+	ErrOthersDraft = errors.New("another admin has a broadcast draft pending")
+)
+
+// A broadcast, persisted so that it can be resumed after a restart
+type State struct {
+	Id              string      // Short identifier for logs
+	Admin           int64       // Admin who created the broadcast
+	Text            string      // Text, or caption if a photo is broadcast
+	Entities        tb.Entities // Formatting of the text
+	PhotoId         string      // Telegram file ID of the photo, if any
+	Recipients      []int64     // Users the broadcast is sent to
+	Next            int         // Index of the next recipient
+	Delivered       int         // Messages delivered
+	Blocked         int         // Recipients who blocked the bot or deleted their account
+	Failed          int         // Messages that failed for other reasons
+	Drafted         int64       // Unix timestamp of drafting
+	Confirmed       bool        // Has the admin confirmed the broadcast?
+	Stopped         bool        // Was the broadcast stopped by an admin?
+	StatusChat      int64       // Chat of the status message
+	StatusMessageId int         // Message ID of the status message, edited with progress
+	Started         int64       // Unix timestamp of confirmation
+	Finished        int64       // Unix timestamp of completion, 0 if still running
+}
+
+// Manages the single broadcast that may be drafted or running at any given time
+type Broadcaster struct {
+	path    string           // Path of the persisted broadcast state
+	bot     *tb.Bot          // Bot used for editing the status message
+	queue   *queue.SendQueue // Queue the broadcast messages are sent through
+	state   *State           // Current draft or broadcast, nil if none
+	running bool             // Is a broadcast goroutine running?
+	mutex   sync.Mutex       // Mutex to avoid concurrent writes
+}
+
+// Creates a broadcaster persisting its state to path
+func NewBroadcaster(path string, bot *tb.Bot, sendQueue *queue.SendQueue) *Broadcaster {
+	return &Broadcaster{path: path, bot: bot, queue: sendQueue}
+}
+
+// Builds the message sent to a recipient
+func (state *State) Message(recipient int64) queue.Message {
+	msg := queue.Message{
+		Recipient: &tb.User{ID: recipient},
+		Caption:   state.Text,
+		Sopts:     tb.SendOptions{Entities: state.Entities},
+		Broadcast: true,
+	}
+
+	if state.PhotoId != "" {
+		msg.Media = &tb.Photo{File: tb.File{FileID: state.PhotoId}, Caption: state.Text}
+	}
+
+	return msg
+}
+
+// Describes the progress of the broadcast
+func (state *State) StatusString() string {
+	status := "in progress"
+	if state.Stopped {
+		status = "stopped"
+	} else if state.Finished != 0 {
+		status = "finished"
+	}
+
+	return fmt.Sprintf(
+		"📣 Broadcast %s %s\n"+
+			"Progress: %d/%d\n"+
+			"Delivered: %d\n"+
+			"Blocked: %d\n"+
+			"Failed: %d",
+		state.Id, status, state.Next, len(state.Recipients), state.Delivered, state.Blocked, state.Failed,
+	)
+}
+
+// Checks if a send error means the recipient can't be reached anymore
+func IsBlocked(err error) bool {
+	var tbErr *tb.Error
+	return errors.As(err, &tbErr) && (tbErr.Code == 403 || errors.Is(err, tb.ErrChatNotFound))
+}
+
+// Creates a broadcast draft, replacing the admin's previous draft. Fails if a broadcast is running, or
+// if another admin has a draft pending: their preview could otherwise end up sending this draft.
+func (b *Broadcaster) Draft(admin int64, text string, entities tb.Entities, photoId string, recipients []int64) (*State, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.running {
+		return nil, ErrInProgress
+	}
+
+	if pending := b.state; pending != nil && !pending.Confirmed && pending.Admin != admin &&
+		time.Since(time.Unix(pending.Drafted, 0)) < draftTimeout {
+		return nil, ErrOthersDraft
+	}
+
+	b.state = &State{
+		Id:         uuid.NewString()[0:8],
+		Admin:      admin,
+		Text:       text,
+		Entities:   entities,
+		PhotoId:    photoId,
+		Recipients: append([]int64{}, recipients...),
+		Drafted:    time.Now().Unix(),
+	}
+
+	// Copied, as the state is modified once the broadcast runs
+	draft := *b.state
+	return &draft, nil
+}
+
+// Confirms the draft with the given ID, as shown in its preview, and starts sending it.
+// The status message is edited with the broadcast's progress.
+func (b *Broadcaster) Confirm(id string, statusMessage *tb.Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.running {
+		return ErrInProgress
+	}
+
+	if b.state == nil {
+		return ErrNoDraft
+	}
+
+	if b.state.Id != id || b.state.Confirmed {
+		return ErrStaleDraft
+	}
+
+	b.state.Confirmed = true
+	b.state.Started = time.Now().Unix()
+	b.state.StatusChat = statusMessage.Chat.ID
+	b.state.StatusMessageId = statusMessage.ID
+
+	b.save()
+	b.running = true
+
+	log.Info().Msgf("📣 Broadcast %s confirmed by %d for %d recipients",
+		b.state.Id, b.state.Admin, len(b.state.Recipients))
+
+	go b.run()
+	return nil
+}
+
+// Discards the draft with the given ID, or stops it if it's running. Returns false if there
+// was nothing to cancel, e.g. because the draft was replaced or the broadcast has finished.
+func (b *Broadcaster) Cancel(id string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == nil || b.state.Id != id || b.state.Finished != 0 {
+		return false
+	}
+
+	if !b.state.Confirmed {
+		b.state = nil
+		return true
+	}
+
+	b.state.Stopped = true
+	return true
+}
+
+// Resumes a broadcast interrupted by a restart, if any
+func (b *Broadcaster) Resume() {
+	state := &State{}
+	if err := storage.ReadJSON(b.path, state); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Msg("Loading broadcast state failed")
+		}
+
+		return
+	}
+
+	if !state.Confirmed || state.Finished != 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	b.state = state
+	b.running = true
+	b.mutex.Unlock()
+
+	log.Info().Msgf("📣 Resuming broadcast %s at %d/%d", state.Id, state.Next, len(state.Recipients))
+	go b.run()
+}
+
+// Persists the state of the current broadcast, e.g. before shutting down
+func (b *Broadcaster) Save() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state != nil && b.state.Confirmed {
+		b.save()
+	}
+}
+
+// Persists the state. Mutex must be held.
+func (b *Broadcaster) save() {
+	if err := storage.WriteJSON(b.path, b.state); err != nil {
+		log.Error().Err(err).Msg("Saving broadcast state failed")
+	}
+}
+
+// An edit of the admin's status message
+type statusEdit struct {
+	message tb.StoredMessage // Status message
+	text    string           // Current progress
+	sopts   tb.SendOptions   // Keyboard of the message
+}
+
+// Builds an edit of the admin's status message with the current progress. Mutex must be held.
+func (b *Broadcaster) statusEdit() statusEdit {
+	edit := statusEdit{
+		message: tb.StoredMessage{
+			MessageID: strconv.Itoa(b.state.StatusMessageId),
+			ChatID:    b.state.StatusChat,
+		},
+		text: b.state.StatusString(),
+	}
+
+	// Keep the stop button around while the broadcast runs
+	if b.state.Finished == 0 {
+		edit.sopts.ReplyMarkup = &tb.ReplyMarkup{
+			InlineKeyboard: [][]tb.InlineButton{{tb.InlineButton{Text: "⏹ Stop broadcast", Data: "broadcast/cancel/" + b.state.Id}}},
+		}
+	}
+
+	return edit
+}
+
+// Edits the admin's status message. The edit may be slow or flood-limited, so the mutex
+// must not be held, or it would hold up stopping the broadcast and shutting down.
+func (b *Broadcaster) updateStatus(edit statusEdit) {
+	_, err := b.bot.Edit(edit.message, edit.text, &edit.sopts)
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Error().Err(err).Msg("Error editing broadcast status message")
+	}
+}
+
+// Sends the broadcast to the remaining recipients, one at a time
+func (b *Broadcaster) run() {
+	lastStatus := time.Now()
+
+	for {
+		b.mutex.Lock()
+		state := b.state
+
+		if state.Stopped || state.Next >= len(state.Recipients) {
+			break
+		}
+
+		msg := state.Message(state.Recipients[state.Next])
+		b.mutex.Unlock()
+
+		// Send through the queue, and wait for the outcome
+		result := make(chan error, 1)
+		msg.Callback = func(sent *tb.Message, err error) { result <- err }
+
+		b.queue.AddToQueue(&msg)
+		err := <-result
+
+		// On flood errors, back off and retry the same recipient
+		var floodErr tb.FloodError
+		if errors.As(err, &floodErr) {
+			log.Warn().Msgf("📣 Broadcast hit flood limit, retrying in %d seconds", floodErr.RetryAfter)
+			time.Sleep(time.Duration(floodErr.RetryAfter) * time.Second)
+			continue
+		}
+
+		b.mutex.Lock()
+		switch {
+		case err == nil:
+			state.Delivered++
+		case IsBlocked(err):
+			state.Blocked++
+		default:
+			state.Failed++
+		}
+
+		state.Next++
+
+		if state.Next%saveInterval == 0 {
+			b.save()
+		}
+
+		var edit *statusEdit
+		if time.Since(lastStatus) > statusInterval {
+			current := b.statusEdit()
+			edit = &current
+			lastStatus = time.Now()
+		}
+		b.mutex.Unlock()
+
+		if edit != nil {
+			b.updateStatus(*edit)
+		}
+
+		time.Sleep(sendInterval)
+	}
+
+	// Loop exits with the mutex held
+	b.state.Finished = time.Now().Unix()
+	b.running = false
+	b.save()
+	edit := b.statusEdit()
+
+	log.Info().Msgf("📣 Broadcast %s done: %d delivered, %d blocked, %d failed",
+		b.state.Id, b.state.Delivered, b.state.Blocked, b.state.Failed)
+
+	b.mutex.Unlock()
+	b.updateStatus(edit)
+}
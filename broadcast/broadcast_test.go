@@ -0,0 +1,307 @@
+package broadcast
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/storage"
+	"tg-resize-sticker-images/telegramtest"
+
+	"golang.org/x/time/rate"
+	tb "gopkg.in/telebot.v3"
+)
+
+const testAdmin = 1000
+
+// Records the recipients the fake sender was asked to send to
+type recorder struct {
+	recipients []int64
+	mutex      sync.Mutex
+}
+
+// Returns the recipients sent to so far
+func (r *recorder) sent() []int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]int64{}, r.recipients...)
+}
+
+// Creates a broadcaster whose queue is drained by a fake sender, which reports outcome(recipient)
+// as the result of each send. Status messages are edited on a fake Telegram server.
+func newBroadcaster(t *testing.T, path string, outcome func(recipient int64) error) (*Broadcaster, *tb.Message, *recorder) {
+	server := telegramtest.NewServer()
+	t.Cleanup(server.Close)
+
+	bot, err := tb.NewBot(tb.Settings{URL: server.URL, Token: telegramtest.Token, Synchronous: true})
+	if err != nil {
+		t.Fatalf("Creating bot failed: %s", err)
+	}
+
+	status, err := bot.Send(&tb.User{ID: testAdmin}, "📣 Starting broadcast...")
+	if err != nil {
+		t.Fatalf("Sending status message failed: %s", err)
+	}
+
+	sendQueue := &queue.SendQueue{Limiter: rate.NewLimiter(rate.Inf, 1)}
+	rec := &recorder{}
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+
+			sendQueue.Mutex.Lock()
+			messages := sendQueue.MessageQueue
+			sendQueue.MessageQueue = nil
+			sendQueue.Mutex.Unlock()
+
+			for _, msg := range messages {
+				rec.mutex.Lock()
+				rec.recipients = append(rec.recipients, msg.Recipient.ID)
+				rec.mutex.Unlock()
+
+				msg.Done(&tb.Message{}, outcome(msg.Recipient.ID))
+				sendQueue.MarkSent()
+			}
+		}
+	}()
+
+	return NewBroadcaster(path, bot, sendQueue), status, rec
+}
+
+// Waits for the running broadcast to finish, returning its final state
+func waitDone(t *testing.T, b *Broadcaster) State {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		b.mutex.Lock()
+		running, state := b.running, b.state
+		b.mutex.Unlock()
+
+		if !running && state != nil && state.Finished != 0 {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			return *state
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatal("Timed out waiting for the broadcast to finish")
+	return State{}
+}
+
+// Checks that the recipients sent to match the expected ones, in order
+func expectSent(t *testing.T, rec *recorder, expected ...int64) {
+	t.Helper()
+
+	sent := rec.sent()
+	if len(sent) != len(expected) {
+		t.Fatalf("Expected sends to %v, got %v", expected, sent)
+	}
+
+	for i := range sent {
+		if sent[i] != expected[i] {
+			t.Fatalf("Expected sends to %v, got %v", expected, sent)
+		}
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	b, status, rec := newBroadcaster(t, filepath.Join(t.TempDir(), "broadcast.json"), func(int64) error { return nil })
+
+	if err := b.Confirm("missing", status); !errors.Is(err, ErrNoDraft) {
+		t.Errorf("Expected confirming without a draft to fail, got %v", err)
+	}
+
+	old, err := b.Draft(testAdmin, "Old", nil, "", []int64{1})
+	if err != nil {
+		t.Fatalf("Drafting broadcast failed: %s", err)
+	}
+
+	draft, err := b.Draft(testAdmin, "News", nil, "", []int64{1, 2, 3})
+	if err != nil {
+		t.Fatalf("Drafting broadcast failed: %s", err)
+	}
+
+	// The preview of the replaced draft can't send the new one
+	if err := b.Confirm(old.Id, status); !errors.Is(err, ErrStaleDraft) {
+		t.Errorf("Expected confirming a replaced draft to fail, got %v", err)
+	}
+
+	if err := b.Confirm(draft.Id, status); err != nil {
+		t.Fatalf("Confirming broadcast failed: %s", err)
+	}
+
+	state := waitDone(t, b)
+	if state.Delivered != 3 || state.Next != 3 || state.Stopped {
+		t.Errorf("Expected all recipients to be delivered, got %+v", state)
+	}
+
+	expectSent(t, rec, 1, 2, 3)
+
+	// Pressing confirm again doesn't send the broadcast twice
+	if err := b.Confirm(draft.Id, status); !errors.Is(err, ErrStaleDraft) {
+		t.Errorf("Expected confirming a sent broadcast to fail, got %v", err)
+	}
+}
+
+func TestOthersDraftIsKept(t *testing.T) {
+	b, status, rec := newBroadcaster(t, filepath.Join(t.TempDir(), "broadcast.json"), func(int64) error { return nil })
+
+	draft, err := b.Draft(testAdmin, "News", nil, "", []int64{1})
+	if err != nil {
+		t.Fatalf("Drafting broadcast failed: %s", err)
+	}
+
+	if _, err := b.Draft(testAdmin+1, "Other news", nil, "", []int64{2}); !errors.Is(err, ErrOthersDraft) {
+		t.Fatalf("Expected another admin's draft to be refused, got %v", err)
+	}
+
+	if err := b.Confirm(draft.Id, status); err != nil {
+		t.Fatalf("Confirming broadcast failed: %s", err)
+	}
+
+	waitDone(t, b)
+	expectSent(t, rec, 1)
+}
+
+func TestCancelDraft(t *testing.T) {
+	b, status, rec := newBroadcaster(t, filepath.Join(t.TempDir(), "broadcast.json"), func(int64) error { return nil })
+
+	draft, err := b.Draft(testAdmin, "News", nil, "", []int64{1, 2})
+	if err != nil {
+		t.Fatalf("Drafting broadcast failed: %s", err)
+	}
+
+	if b.Cancel("other") {
+		t.Errorf("Expected cancelling another draft to do nothing")
+	}
+
+	if !b.Cancel(draft.Id) {
+		t.Fatalf("Expected the draft to be cancelled")
+	}
+
+	if err := b.Confirm(draft.Id, status); !errors.Is(err, ErrNoDraft) {
+		t.Errorf("Expected confirming a cancelled draft to fail, got %v", err)
+	}
+
+	// Other admins can draft once the draft is gone
+	if _, err := b.Draft(testAdmin+1, "Other news", nil, "", []int64{2}); err != nil {
+		t.Errorf("Expected drafting to succeed after cancelling, got %s", err)
+	}
+
+	expectSent(t, rec)
+}
+
+func TestStopMidRun(t *testing.T) {
+	var b *Broadcaster
+	var id string
+
+	// The admin presses stop while the second recipient is being sent to
+	b, status, rec := newBroadcaster(t, filepath.Join(t.TempDir(), "broadcast.json"), func(recipient int64) error {
+		if recipient == 2 && !b.Cancel(id) {
+			t.Errorf("Expected the running broadcast to be stopped")
+		}
+
+		return nil
+	})
+
+	draft, err := b.Draft(testAdmin, "News", nil, "", []int64{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("Drafting broadcast failed: %s", err)
+	}
+
+	id = draft.Id
+	if err := b.Confirm(id, status); err != nil {
+		t.Fatalf("Confirming broadcast failed: %s", err)
+	}
+
+	state := waitDone(t, b)
+	if !state.Stopped || state.Delivered != 2 || state.Next != 2 {
+		t.Errorf("Expected the broadcast to stop after 2 recipients, got %+v", state)
+	}
+
+	expectSent(t, rec, 1, 2)
+
+	if b.Cancel(id) {
+		t.Errorf("Expected a finished broadcast not to be cancellable")
+	}
+}
+
+func TestFloodErrorIsRetried(t *testing.T) {
+	flooded := false
+
+	// The first send to recipient 2 hits the flood limit
+	b, status, rec := newBroadcaster(t, filepath.Join(t.TempDir(), "broadcast.json"), func(recipient int64) error {
+		if recipient == 2 && !flooded {
+			flooded = true
+			return tb.FloodError{RetryAfter: 0}
+		}
+
+		return nil
+	})
+
+	draft, err := b.Draft(testAdmin, "News", nil, "", []int64{1, 2, 3})
+	if err != nil {
+		t.Fatalf("Drafting broadcast failed: %s", err)
+	}
+
+	if err := b.Confirm(draft.Id, status); err != nil {
+		t.Fatalf("Confirming broadcast failed: %s", err)
+	}
+
+	state := waitDone(t, b)
+	if state.Delivered != 3 || state.Failed != 0 {
+		t.Errorf("Expected the flooded recipient to be delivered on retry, got %+v", state)
+	}
+
+	expectSent(t, rec, 1, 2, 2, 3)
+}
+
+func TestResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcast.json")
+	b, status, rec := newBroadcaster(t, path, func(int64) error { return nil })
+
+	// A broadcast interrupted by a restart after its first recipient
+	interrupted := State{
+		Id:              "abcd1234",
+		Admin:           testAdmin,
+		Text:            "News",
+		Recipients:      []int64{1, 2, 3},
+		Next:            1,
+		Delivered:       1,
+		Confirmed:       true,
+		StatusChat:      status.Chat.ID,
+		StatusMessageId: status.ID,
+	}
+
+	if err := storage.WriteJSON(path, &interrupted); err != nil {
+		t.Fatalf("Writing broadcast state failed: %s", err)
+	}
+
+	b.Resume()
+
+	state := waitDone(t, b)
+	if state.Delivered != 3 || state.Next != 3 {
+		t.Errorf("Expected the remaining recipients to be delivered, got %+v", state)
+	}
+
+	expectSent(t, rec, 2, 3)
+
+	// The finished broadcast isn't resumed again
+	saved := State{}
+	if err := storage.ReadJSON(path, &saved); err != nil || saved.Finished == 0 {
+		t.Errorf("Expected the finished state to be saved, got %+v (%v)", saved, err)
+	}
+}
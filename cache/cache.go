@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"tg-resize-sticker-images/analytics"
+	"tg-resize-sticker-images/prefs"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Identifies a conversion: converting the same file with the same options gives the same image
+type Key struct {
+	FileUniqueID string // Telegram's file_unique_id of the received file, the same for every bot and chat
+	Mode         string // Conversion mode, "sticker" or "emoji"
+	Format       string // Output format
+	Fit          string // Fitting strategy
+}
+
+// Builds the key of converting a file with the user's preferences. Captions are built
+// for each user when resending, so the preferences only affecting them are left out.
+func NewKey(fileUniqueID string, userPrefs prefs.Preferences) Key {
+	mode := "sticker"
+	if userPrefs.InEmojiMode {
+		mode = "emoji"
+	}
+
+	return Key{
+		FileUniqueID: fileUniqueID,
+		Mode:         mode,
+		Format:       userPrefs.OutputFormat(),
+		Fit:          userPrefs.FitStrategy(),
+	}
+}
+
+// A converted image, as sent to Telegram
+type Entry struct {
+	FileID  string               // Telegram's file_id of the sent document, to resend it by
+	Details analytics.Conversion // Details of the conversion, for the caption and statistics
+}
+
+// An entry and its key, as stored in the recency list
+type item struct {
+	key   Key
+	entry Entry
+}
+
+// A bounded cache of recent conversions. Once full, the least recently used entry is evicted.
+type Cache struct {
+	capacity int                   // Entries kept, or 0 if disabled
+	items    map[Key]*list.Element // Elements of the recency list, by key
+	recency  *list.List            // Items, most recently used first
+	hits     int64                 // Lookups that found an entry
+	misses   int64                 // Lookups that didn't
+	mutex    sync.Mutex            // Mutex to avoid concurrent map writes
+}
+
+// Creates a cache of the given capacity. A capacity of 0 disables the cache.
+func New(capacity int) *Cache {
+	return &Cache{
+		capacity: capacity,
+		items:    make(map[Key]*list.Element),
+		recency:  list.New(),
+	}
+}
+
+// Looks up a conversion, marking it as recently used
+func (cache *Cache) Get(key Key) (Entry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, found := cache.items[key]
+	if !found {
+		cache.misses++
+		return Entry{}, false
+	}
+
+	cache.hits++
+	cache.recency.MoveToFront(element)
+
+	return element.Value.(*item).entry, true
+}
+
+// Stores a conversion, evicting the least recently used ones if the cache is full
+func (cache *Cache) Add(key Key, entry Entry) {
+	if key.FileUniqueID == "" || entry.FileID == "" {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, found := cache.items[key]; found {
+		element.Value.(*item).entry = entry
+		cache.recency.MoveToFront(element)
+		return
+	}
+
+	if cache.capacity == 0 {
+		return
+	}
+
+	cache.items[key] = cache.recency.PushFront(&item{key: key, entry: entry})
+	cache.evict()
+}
+
+// Drops a conversion, e.g. once Telegram no longer accepts its file ID
+func (cache *Cache) Remove(key Key) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, found := cache.items[key]; found {
+		cache.recency.Remove(element)
+		delete(cache.items, key)
+	}
+}
+
+// Changes the capacity of the cache, evicting entries if it shrinks
+func (cache *Cache) SetCapacity(capacity int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.capacity = capacity
+	cache.evict()
+}
+
+// Evicts the least recently used entries over the capacity. Must be called with the mutex held.
+func (cache *Cache) evict() {
+	for cache.recency.Len() > cache.capacity {
+		oldest := cache.recency.Back()
+		cache.recency.Remove(oldest)
+		delete(cache.items, oldest.Value.(*item).key)
+	}
+}
+
+// Returns the amount of cached conversions, and the hits and misses of lookups since startup
+func (cache *Cache) Stats() (size int, hits int64, misses int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.recency.Len(), cache.hits, cache.misses
+}
+
+// Describes the cache's size and hit rate since startup, under a Markdown title
+func (cache *Cache) String(title string) string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.capacity == 0 {
+		return fmt.Sprintf("*%s*\nDisabled", title)
+	}
+
+	lookups := cache.hits + cache.misses
+	hitRate := "–"
+	if lookups != 0 {
+		hitRate = fmt.Sprintf("%.0f%%", 100*float64(cache.hits)/float64(lookups))
+	}
+
+	return fmt.Sprintf("*%s*\n", title) +
+		fmt.Sprintf("Size: %s of %s conversions\n", humanize.Comma(int64(cache.recency.Len())), humanize.Comma(int64(cache.capacity))) +
+		fmt.Sprintf("Hit rate: %s (%s of %s lookups)", hitRate, humanize.Comma(cache.hits), humanize.Comma(lookups))
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"testing"
+	"tg-resize-sticker-images/prefs"
+)
+
+func TestEviction(t *testing.T) {
+	cache := New(2)
+	first, second, third := Key{FileUniqueID: "a"}, Key{FileUniqueID: "b"}, Key{FileUniqueID: "c"}
+
+	cache.Add(first, Entry{FileID: "file-a"})
+	cache.Add(second, Entry{FileID: "file-b"})
+
+	// Using the first entry makes the second one the least recently used
+	if entry, found := cache.Get(first); !found || entry.FileID != "file-a" {
+		t.Fatalf("Expected the first entry to be cached, got %+v", entry)
+	}
+
+	cache.Add(third, Entry{FileID: "file-c"})
+
+	if _, found := cache.Get(second); found {
+		t.Errorf("Expected the least recently used entry to be evicted")
+	}
+
+	if _, found := cache.Get(first); !found {
+		t.Errorf("Expected the recently used entry to be kept")
+	}
+
+	if size, hits, misses := cache.Stats(); size != 2 || hits != 2 || misses != 1 {
+		t.Errorf("Expected 2 entries, 2 hits and 1 miss, got %d, %d and %d", size, hits, misses)
+	}
+
+	// Shrinking the cache evicts down to the new capacity, keeping the most recent entry
+	cache.SetCapacity(1)
+	if _, found := cache.Get(third); found {
+		t.Errorf("Expected the older entry to be evicted when shrinking")
+	}
+
+	if described := cache.String("Conversion cache"); described != "*Conversion cache*\nSize: 1 of 1 conversions\nHit rate: 50% (2 of 4 lookups)" {
+		t.Errorf("Expected the size and hit rate, got %q", described)
+	}
+
+	cache.Remove(first)
+	if size, _, _ := cache.Stats(); size != 0 {
+		t.Errorf("Expected the cache to be empty, got %d entries", size)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	cache := New(10)
+	sticker := NewKey("a", prefs.Preferences{})
+
+	// Captions are built per user, so preferences only affecting them share the entry
+	if NewKey("a", prefs.Preferences{ShortCaptions: true, Language: "de"}) != sticker {
+		t.Errorf("Expected caption preferences not to be part of the key")
+	}
+
+	if NewKey("a", prefs.Preferences{InEmojiMode: true}) == sticker || NewKey("a", prefs.Preferences{Format: prefs.FormatWebP}) == sticker {
+		t.Errorf("Expected the mode and format to be part of the key")
+	}
+
+	// Files without a unique ID can't be told apart, so they are never cached
+	cache.Add(NewKey("", prefs.Preferences{}), Entry{FileID: "file"})
+	if size, _, _ := cache.Stats(); size != 0 {
+		t.Errorf("Expected a key without a file ID not to be cached")
+	}
+
+	disabled := New(0)
+	disabled.Add(sticker, Entry{FileID: "file"})
+
+	if _, found := disabled.Get(sticker); found {
+		t.Errorf("Expected a disabled cache to store nothing")
+	}
+
+	if described := disabled.String("Conversion cache"); described != "*Conversion cache*\nDisabled" {
+		t.Errorf("Expected a disabled cache to be described as such, got %q", described)
+	}
+}
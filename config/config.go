@@ -2,15 +2,24 @@ package config
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"tg-resize-sticker-images/admission"
+	"tg-resize-sticker-images/alerts"
+	"tg-resize-sticker-images/analytics"
+	"tg-resize-sticker-images/broadcast"
+	"tg-resize-sticker-images/cache"
 	"tg-resize-sticker-images/daily"
+	"tg-resize-sticker-images/history"
+	"tg-resize-sticker-images/limits"
+	"tg-resize-sticker-images/prefs"
 	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/reports"
 	"tg-resize-sticker-images/spam"
 	"time"
 
@@ -20,117 +29,333 @@ import (
 
 // A superstruct to simplify passing around other structs
 type Session struct {
-	Bot      *tb.Bot                     // Bot this session runs
-	Config   *Config                     // Configuration for session
-	Spam     *spam.AntiSpam              // Anti-spam struct for session
-	Queue    *queue.SendQueue            // Message send queue for session
-	Daily    *daily.ConversionStatistics // Daily stats
-	LastUser int64                       // Keep track of the last user to convert an image
-	Vnum     string                      // Version number
-	Mutex    sync.Mutex                  // Avoid concurrent writes
+	Bot       *tb.Bot                     // Bot this session runs
+	Config    *Config                     // Configuration for session
+	Spam      *spam.AntiSpam              // Anti-spam struct for session
+	Queue     *queue.SendQueue            // Message send queue for session
+	Daily     *daily.ConversionStatistics // Daily stats
+	History   *history.History            // Hourly, daily and monthly stats, persisted
+	Prefs     *prefs.Store                // Per-user preferences
+	Broadcast *broadcast.Broadcaster      // Broadcasts to all users
+	Admission *admission.Controller       // Maintenance mode and load shedding
+	Reports   *reports.Collector          // Activity for the daily and weekly reports
+	Alerts    *alerts.Monitor             // Alerts admins of high error rates
+	Cache     *cache.Cache                // Recent conversions, resent instead of converting again
+	LastUser  int64                       // Keep track of the last user to convert an image
+	Vnum      string                      // Version number
+	Mutex     sync.Mutex                  // Avoid concurrent writes
 }
 
 type Config struct {
-	Token           string     // Bot API token
-	Owner           int64      // Owner of the bot: skips logging
-	ConversionRate  int64      // Rate-limit for conversions per hour
-	StatConverted   int        // Keep track of converted images
-	StatUniqueChats int        // Keep track of count of unique chats
-	StatStarted     int64      // Unix timestamp of startup time
-	UniqueUsers     []int64    // List of all unique chats
-	Mutex           sync.Mutex // Mutex to avoid concurrent writes
+	Version         int                  // Config schema version, used for migrations
+	Token           string               // Bot API token
+	Owner           int64                // Owner of the bot: skips logging, can use admin commands
+	Admins          []int64              // Additional users allowed to use admin commands
+	ConversionRate  int64                // Rate-limit for conversions per hour, for the default tier
+	Tiers           map[string]spam.Tier // Conversion limits of each tier
+	UserTiers       map[int64]string     // Users assigned to a tier other than the default
+	Penalties       spam.Penalties       // Escalating penalties for repeat offenders
+	LoadShedding    admission.Limits     // Thresholds above which conversions are refused
+	ImageLimits     limits.Limits        // Limits on received images, against decompression bombs
+	ConversionCache int                  // Conversions remembered to resend without converting; 0 disables the cache
+	Reports         reports.Settings     // Schedule of the daily and weekly reports sent to admins
+	Alerts          alerts.Settings      // Error rates above which admins are alerted
+	SendRate        float64              // Messages sent per second by the send queue
+	SendBurst       int                  // Burst size of the send queue's rate-limiter
+	LogLevel        string               // Minimum level of logged messages
+	StatConverted   int                  // Keep track of converted images
+	StatUniqueChats int                  // Keep track of count of unique chats
+	StatBreakdown   analytics.Breakdown  // Converted images by mode, input, outcome and latency
+	StatStarted     int64                // Unix timestamp of startup time
+	UniqueUsers     []int64              // List of all unique chats
+	Mutex           sync.Mutex           // Mutex to avoid concurrent writes
+
+	tokenOverride      string            // Token supplied outside the config file, never written to disk
+	fileOwner          int64             // Owner in the config file, written back instead of an overridden Owner
+	fileConversionRate int64             // ConversionRate in the config file, written back instead of an overridden one
+	sources            map[string]string // Where overridden settings came from
+	fileHash           [sha256.Size]byte // Hash of the config file as last loaded or dumped, to detect edits on disk
+}
+
+// Checks if the user is the owner or an admin of the bot
+func (config *Config) IsAdmin(id int64) bool {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
+
+	if config.Owner != 0 && id == config.Owner {
+		return true
+	}
+
+	for _, admin := range config.Admins {
+		if admin == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if the user is the owner of the bot
+func (config *Config) IsOwner(id int64) bool {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
+
+	return config.Owner != 0 && id == config.Owner
+}
+
+// Returns the owner and admins of the bot
+func (config *Config) AdminIds() []int64 {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
+
+	ids := []int64{}
+	if config.Owner != 0 {
+		ids = append(ids, config.Owner)
+	}
+
+	for _, admin := range config.Admins {
+		if admin != config.Owner {
+			ids = append(ids, admin)
+		}
+	}
+
+	return ids
+}
+
+// Returns a copy of the tiers and the users assigned to them. The default
+// tier's hourly limit is always the configured ConversionRate.
+func (config *Config) TierSettings() (map[string]spam.Tier, map[int64]string) {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
+
+	tiers := make(map[string]spam.Tier, len(config.Tiers))
+	for name, tier := range config.Tiers {
+		tiers[name] = tier
+	}
+
+	defaultTier := tiers[spam.DefaultTier]
+	defaultTier.HourlyLimit = config.ConversionRate
+	tiers[spam.DefaultTier] = defaultTier
+
+	userTiers := make(map[int64]string, len(config.UserTiers))
+	for user, name := range config.UserTiers {
+		userTiers[user] = name
+	}
+
+	return tiers, userTiers
+}
+
+// Returns the limits on received images
+func (config *Config) ImageLimitSettings() limits.Limits {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
+
+	return config.ImageLimits
 }
 
 // Dumps config to disk
 func DumpConfig(config *Config) {
-	jsonbytes, err := json.MarshalIndent(config, "", "\t")
-
-	if err != nil {
-		log.Error().Err(err).Msg("⚠️ Error marshaling json")
+	if err := dumpConfigTo(configFolder(), config); err != nil {
+		log.Error().Err(err).Msg("⚠️ Error dumping config to disk")
 	}
+}
 
-	wd, _ := os.Getwd()
-	configf := filepath.Join(wd, "config", "bot-config.json")
+// Sets the hourly conversion limit of the default tier, also in the config file if it's overridden
+func (config *Config) SetConversionRate(limit int64) {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
 
-	file, err := os.Create(configf)
+	config.ConversionRate = limit
+	config.fileConversionRate = limit
+}
 
-	if err != nil {
-		log.Fatal().Err(err).Msg("Creating configuration file failed")
+// Returns a config with default values, used as the base layer of the config
+func defaultConfig() *Config {
+	return &Config{
+		Version:         configVersion,
+		ConversionRate:  100,
+		Tiers:           spam.DefaultTiers(),
+		UserTiers:       make(map[int64]string),
+		Penalties:       spam.DefaultPenalties(),
+		LoadShedding:    admission.DefaultLimits(),
+		ImageLimits:     limits.DefaultLimits(),
+		ConversionCache: 10000,
+		Reports:         reports.DefaultSettings(),
+		Alerts:          alerts.DefaultSettings(),
+		SendRate:        20,
+		SendBurst:       2,
+		LogLevel:        "info",
+		UniqueUsers:     []int64{},
+		sources:         make(map[string]string),
 	}
+}
 
-	// Write, close
-	_, err = file.Write(jsonbytes)
-	if err != nil {
-		log.Error().Err(err).Msg("⚠️ Error writing config to disk")
+// Asks for the bot token on stdin, if stdin is an interactive terminal
+func promptToken() string {
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return ""
 	}
 
-	file.Close()
+	fmt.Print("Enter bot token: ")
+
+	reader := bufio.NewReader(os.Stdin)
+	inp, _ := reader.ReadString('\n')
+	return strings.TrimSpace(inp)
+}
+
+// Logs a fatal config error, also printing it to stderr as the log may go to a file
+func fatalConfigError(err error, msg string) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", msg, err)
+	log.Fatal().Err(err).Msg("⚠️ " + msg)
 }
 
-// Loads the config, returns a pointer to it
-func LoadConfig() *Config {
+// Loads the config, returns a pointer to it. Settings are layered as
+// defaults < config file < environment variables < command-line flags.
+func LoadConfig(flags *Flags) *Config {
+	// Environment and command-line overrides
+	overrides, err := collectOverrides(flags)
+	if err != nil {
+		fatalConfigError(err, "Error reading config overrides")
+	}
+
 	// Get log file's path relative to working dir
-	wd, _ := os.Getwd()
-	configPath := filepath.Join(wd, "config")
+	configPath := configFolder()
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		_ = os.Mkdir(configPath, os.ModePerm)
 	}
 
-	configf := filepath.Join(configPath, "bot-config.json")
-	if _, err := os.Stat(configf); os.IsNotExist(err) {
-		// Config doesn't exist: create
-		fmt.Print("Enter bot token: ")
-
-		reader := bufio.NewReader(os.Stdin)
-		inp, _ := reader.ReadString('\n')
-		botToken := strings.TrimSuffix(inp, "\n")
-
-		// Create, marshal
-		config := Config{
-			Token:           botToken,
-			Owner:           0,
-			ConversionRate:  100,
-			StatConverted:   0,
-			StatUniqueChats: 0,
-			StatStarted:     time.Now().Unix(),
-			UniqueUsers:     []int64{},
+	var config *Config
+
+	configf := filepath.Join(configPath, configFileName)
+	_, err = os.Stat(configf)
+	noBackups := len(listBackups(filepath.Join(configPath, backupFolderName))) == 0
+
+	if os.IsNotExist(err) && noBackups {
+		// Config doesn't exist: create from defaults
+		config = newConfig()
+
+		// Only prompt for the token if it isn't supplied otherwise
+		if _, ok := overrides[settingToken]; !ok {
+			config.Token = promptToken()
+			config.sources[settingToken] = "prompt"
 		}
 
-		fmt.Println("Success! Starting bot...")
+		// Set startup time
+		config.StatStarted = time.Now().Unix()
 
-		go DumpConfig(&config)
-		return &config
+		// Apply environment and command-line overrides, then verify the result
+		if err = applyOverrides(config, overrides); err != nil {
+			fatalConfigError(err, "Invalid config override")
+		}
+
+		if err = validateConfig(config); err != nil {
+			fatalConfigError(err, "Invalid config")
+		}
+
+		go DumpConfig(config)
+		return config
 	}
 
-	// Config exists: load
-	fbytes, err := os.ReadFile(configf)
+	// Config (or a backup of it) exists: load
+	config, err = ReadConfig(flags)
 	if err != nil {
-		log.Fatal().Err(err).Msg("⚠️ Error reading config file")
+		fatalConfigError(err, "Error loading config")
 	}
 
-	// New config struct
-	var config Config
+	// Set startup time
+	config.StatStarted = time.Now().Unix()
 
-	// Unmarshal into our config struct
-	err = json.Unmarshal(fbytes, &config)
+	// Sort UniqueChats, as they may be unsorted
+	// https://stackoverflow.com/a/48568680
+	sort.Slice(config.UniqueUsers, func(i, j int) bool {
+		return config.UniqueUsers[i] < config.UniqueUsers[j]
+	})
+
+	return config
+}
+
+// Returns the config a first start creates, before the token is asked for
+func newConfig() *Config {
+	config := defaultConfig()
+	config.sources[settingOwner] = "default"
+	config.sources[settingConversionRate] = "default"
+
+	return config
+}
+
+// Builds the effective config for --print-config, without prompting for the token, creating or
+// writing anything. The config is returned even if it fails validation, along with the error.
+func PreviewConfig(flags *Flags) (*Config, error) {
+	configPath := configFolder()
+
+	_, err := os.Stat(filepath.Join(configPath, configFileName))
+	if os.IsNotExist(err) && len(listBackups(filepath.Join(configPath, backupFolderName))) == 0 {
+		overrides, err := collectOverrides(flags)
+		if err != nil {
+			return nil, err
+		}
+
+		config := newConfig()
+		if err = applyOverrides(config, overrides); err != nil {
+			return nil, err
+		}
+
+		return config, validateConfig(config)
+	}
+
+	config, err := layerConfigFrom(configPath, flags)
 	if err != nil {
-		log.Fatal().Err(err).Msg("⚠️ Error unmarshaling config json")
+		return nil, err
 	}
 
-	// Set startup time
-	config.StatStarted = time.Now().Unix()
-	config.StatUniqueChats = len(config.UniqueUsers)
+	return config, validateConfig(config)
+}
+
+// Reads an existing config from disk and applies the overrides on top of it,
+// without prompting or creating anything. Used on startup and when reloading.
+func ReadConfig(flags *Flags) (*Config, error) {
+	return readConfigFrom(configFolder(), flags)
+}
+
+// Reads the config from the config folder at configPath, and applies the overrides on top of it
+func readConfigFrom(configPath string, flags *Flags) (*Config, error) {
+	config, err := layerConfigFrom(configPath, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Reads the config from the config folder at configPath and applies the overrides, without validating it
+func layerConfigFrom(configPath string, flags *Flags) (*Config, error) {
+	overrides, err := collectOverrides(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := loadConfigFrom(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring older configs up to date
+	migrateConfig(config)
 
 	// Set rate-limit if it has defaulted to 0
 	if config.ConversionRate == 0 {
 		config.ConversionRate = 60
 	}
 
-	// Sort UniqueChats, as they may be unsorted
-	// https://stackoverflow.com/a/48568680
-	sort.Slice(config.UniqueUsers, func(i, j int) bool {
-		return config.UniqueUsers[i] < config.UniqueUsers[j]
-	})
+	config.StatUniqueChats = len(config.UniqueUsers)
+
+	if err = applyOverrides(config, overrides); err != nil {
+		return nil, err
+	}
 
-	return &config
+	return config, nil
 }
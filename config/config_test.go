@@ -0,0 +1,287 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpAndLoadConfig(t *testing.T) {
+	configPath := t.TempDir()
+
+	config := &Config{Version: configVersion, Token: "12345:abcdefgh", Owner: 1, UniqueUsers: []int64{1, 2}}
+	if err := dumpConfigTo(configPath, config); err != nil {
+		t.Fatalf("Error dumping config: %s", err)
+	}
+
+	loaded, err := loadConfigFrom(configPath)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	if loaded.Token != config.Token || len(loaded.UniqueUsers) != 2 {
+		t.Errorf("Loaded config does not match the dumped config: %+v", loaded)
+	}
+
+	// No temp files should be left behind
+	entries, _ := os.ReadDir(configPath)
+	for _, entry := range entries {
+		if entry.Name() != configFileName && entry.Name() != backupFolderName {
+			t.Errorf("Unexpected file left in config folder: %s", entry.Name())
+		}
+	}
+}
+
+func TestLoadConfigFallsBackToBackup(t *testing.T) {
+	configPath := t.TempDir()
+
+	config := &Config{Version: configVersion, Token: "12345:abcdefgh"}
+	if err := dumpConfigTo(configPath, config); err != nil {
+		t.Fatalf("Error dumping config: %s", err)
+	}
+
+	// Simulate a truncated write
+	configf := filepath.Join(configPath, configFileName)
+	if err := os.WriteFile(configf, []byte(`{"Token": "123`), 0600); err != nil {
+		t.Fatalf("Error truncating config: %s", err)
+	}
+
+	loaded, err := loadConfigFrom(configPath)
+	if err != nil {
+		t.Fatalf("Expected config to be restored from backup, got error: %s", err)
+	}
+
+	if loaded.Token != config.Token {
+		t.Errorf("Expected token %s from backup, got %s", config.Token, loaded.Token)
+	}
+}
+
+func TestBackupRotation(t *testing.T) {
+	backupPath := filepath.Join(t.TempDir(), backupFolderName)
+	if err := os.MkdirAll(backupPath, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pre-populate more backups than are kept
+	for i := 0; i < maxBackups+5; i++ {
+		name := filepath.Join(backupPath, backupPrefix+"20200101-0000"+string(rune('a'+i))+".json")
+		if err := os.WriteFile(name, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeBackup(filepath.Dir(backupPath), []byte("{}"), time.Now()); err != nil {
+		t.Fatalf("Error writing backup: %s", err)
+	}
+
+	if backups := listBackups(backupPath); len(backups) != maxBackups {
+		t.Errorf("Expected %d backups, got %d", maxBackups, len(backups))
+	}
+}
+
+func TestBackupsAreDaily(t *testing.T) {
+	configPath := t.TempDir()
+	backupPath := filepath.Join(configPath, backupFolderName)
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Dumps every six hours for two weeks only keep a backup per day
+	for dump := 0; dump < 14*4; dump++ {
+		now := day.Add(time.Duration(dump) * 6 * time.Hour)
+		if err := writeBackup(configPath, []byte(now.Format(time.RFC3339)), now); err != nil {
+			t.Fatalf("Error writing backup: %s", err)
+		}
+	}
+
+	backups := listBackups(backupPath)
+	if len(backups) != maxBackups {
+		t.Fatalf("Expected %d daily backups, got %d", maxBackups, len(backups))
+	}
+
+	// Each day's backup holds the day's first dump, and isn't overwritten by later ones
+	if data, _ := os.ReadFile(backups[1]); string(data) != "2026-01-13T00:00:00Z" {
+		t.Errorf("Expected the previous day's backup to hold its first dump, got %s", data)
+	}
+
+	if data, _ := os.ReadFile(backups[0]); string(data) != "2026-01-14T00:00:00Z" {
+		t.Errorf("Expected the current day's backup to hold its first dump, got %s", data)
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	config := &Config{}
+	migrateConfig(config)
+
+	if config.Version != configVersion {
+		t.Errorf("Expected config version to be %d, got %d", configVersion, config.Version)
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	t.Setenv("TG_RESIZE_OWNER", "42")
+	t.Setenv("TG_RESIZE_CONVERSION_RATE", "10")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("12345:fromfile\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags take precedence over the environment
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"--token-file", tokenFile, "--conversion-rate", "20"}); err != nil {
+		t.Fatal(err)
+	}
+
+	overrides, err := collectOverrides(flags)
+	if err != nil {
+		t.Fatalf("Error collecting overrides: %s", err)
+	}
+
+	config := defaultConfig()
+	config.Token = "1:file"
+	if err = applyOverrides(config, overrides); err != nil {
+		t.Fatalf("Error applying overrides: %s", err)
+	}
+
+	if config.BotToken() != "12345:fromfile" {
+		t.Errorf("Expected token from token file, got %s", config.BotToken())
+	}
+
+	if config.Owner != 42 || config.ConversionRate != 20 {
+		t.Errorf("Expected owner 42 and rate 20, got %d and %d", config.Owner, config.ConversionRate)
+	}
+
+	if strings.Contains(config.Describe(), "fromfile") {
+		t.Errorf("Token was not redacted:\n%s", config.Describe())
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := defaultConfig()
+	if err := validateConfig(config); err == nil {
+		t.Errorf("Expected a missing token to fail validation")
+	}
+
+	config.Token = "12345:abcdefgh"
+	if err := validateConfig(config); err != nil {
+		t.Errorf("Expected config to be valid, got %s", err)
+	}
+
+	config.Reports.Timezone = "Nowhere/Special"
+	if err := validateConfig(config); err == nil {
+		t.Errorf("Expected an unknown report timezone to fail validation")
+	}
+
+	config.Reports.Timezone = "UTC"
+
+	config.Alerts.WindowMinutes = 0
+	if err := validateConfig(config); err == nil {
+		t.Errorf("Expected an empty alert window to fail validation")
+	}
+
+	config.Alerts.WindowMinutes = 10
+
+	config.ImageLimits.MaxMegapixels = -1
+	if err := validateConfig(config); err == nil {
+		t.Errorf("Expected a negative image limit to fail validation")
+	}
+
+	config.ImageLimits.MaxMegapixels = 50
+
+	config.ConversionCache = -1
+	if err := validateConfig(config); err == nil {
+		t.Errorf("Expected a negative cache size to fail validation")
+	}
+
+	config.ConversionCache = 0
+	if err := applyOverrides(config, map[string]override{settingOwner: {"abc", "env TG_RESIZE_OWNER"}}); err == nil {
+		t.Errorf("Expected a non-numeric owner to fail")
+	}
+}
+
+func TestDumpKeepsOverridesOutOfFile(t *testing.T) {
+	configPath := t.TempDir()
+
+	stored := defaultConfig()
+	stored.Token, stored.Owner = "12345:fromfile", 1
+	if err := dumpConfigTo(configPath, stored); err != nil {
+		t.Fatalf("Error dumping config: %s", err)
+	}
+
+	t.Setenv("TG_RESIZE_TOKEN", "12345:fromenv")
+	t.Setenv("TG_RESIZE_OWNER", "42")
+	t.Setenv("TG_RESIZE_CONVERSION_RATE", "10")
+
+	config, err := readConfigFrom(configPath, nil)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	if config.Owner != 42 || config.ConversionRate != 10 {
+		t.Fatalf("Expected the overrides to apply, got owner %d and rate %d", config.Owner, config.ConversionRate)
+	}
+
+	// Dumping writes the file's own values back, and keeps the overrides in effect
+	if err := dumpConfigTo(configPath, config); err != nil {
+		t.Fatalf("Error dumping config: %s", err)
+	}
+
+	dumped, err := readConfigFile(filepath.Join(configPath, configFileName))
+	if err != nil {
+		t.Fatalf("Error reading dumped config: %s", err)
+	}
+
+	if dumped.Token != "12345:fromfile" || dumped.Owner != 1 || dumped.ConversionRate != 100 {
+		t.Errorf("Expected overrides to stay out of the file, got token %s, owner %d and rate %d",
+			dumped.Token, dumped.Owner, dumped.ConversionRate)
+	}
+
+	if config.Owner != 42 || config.ConversionRate != 10 {
+		t.Errorf("Expected the overrides to stay in effect, got owner %d and rate %d", config.Owner, config.ConversionRate)
+	}
+
+	// Runtime changes are written to the file
+	config.SetConversionRate(50)
+	if err := dumpConfigTo(configPath, config); err != nil {
+		t.Fatalf("Error dumping config: %s", err)
+	}
+
+	if dumped, err = readConfigFile(filepath.Join(configPath, configFileName)); err != nil || dumped.ConversionRate != 50 {
+		t.Errorf("Expected the changed limit to be written, got %+v (%v)", dumped, err)
+	}
+}
+
+func TestPreviewConfigWritesNothing(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	// Without a token, the config is still described, along with why it can't be used
+	config, err := PreviewConfig(nil)
+	if err == nil || config == nil {
+		t.Errorf("Expected a config without a token to be described and refused, got %v", err)
+	}
+
+	t.Setenv("TG_RESIZE_TOKEN", "12345:fromenv")
+
+	config, err = PreviewConfig(nil)
+	if err != nil {
+		t.Fatalf("Error previewing config: %s", err)
+	}
+
+	if !strings.Contains(config.Describe(), "12345:<redacted> (env TG_RESIZE_TOKEN)") {
+		t.Errorf("Expected the token from the environment, got:\n%s", config.Describe())
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing to be written, found %d entries", len(entries))
+	}
+}
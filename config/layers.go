@@ -0,0 +1,334 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"tg-resize-sticker-images/spam"
+
+	"github.com/rs/zerolog"
+)
+
+// Names of the settings that can be overridden outside the config file
+const (
+	settingToken          = "Token"
+	settingOwner          = "Owner"
+	settingConversionRate = "ConversionRate"
+)
+
+// Environment variables for each overridable setting
+var settingEnvs = map[string]string{
+	settingToken:          "TG_RESIZE_TOKEN",
+	settingOwner:          "TG_RESIZE_OWNER",
+	settingConversionRate: "TG_RESIZE_CONVERSION_RATE",
+}
+
+// Environment variable pointing to a file containing the bot token
+const tokenFileEnv = "TG_RESIZE_TOKEN_FILE"
+
+// Command-line flags that override the config file and the environment
+type Flags struct {
+	Token          string // --token
+	TokenFile      string // --token-file
+	Owner          string // --owner
+	ConversionRate string // --conversion-rate
+	PrintConfig    bool   // --print-config
+	fs             *flag.FlagSet
+}
+
+// An overridden value for a setting, and where it came from
+type override struct {
+	value  string
+	source string
+}
+
+// Registers the config flags on a flag set. Must be called before the flag set is parsed.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	flags := &Flags{fs: fs}
+
+	fs.StringVar(&flags.Token, "token", "", "Bot API token (env "+settingEnvs[settingToken]+")")
+	fs.StringVar(&flags.TokenFile, "token-file", "", "Path to a file containing the bot API token (env "+tokenFileEnv+")")
+	fs.StringVar(&flags.Owner, "owner", "", "Telegram user ID of the bot owner (env "+settingEnvs[settingOwner]+")")
+	fs.StringVar(&flags.ConversionRate, "conversion-rate", "", "Conversions allowed per hour (env "+settingEnvs[settingConversionRate]+")")
+	fs.BoolVar(&flags.PrintConfig, "print-config", false, "Print the effective config with the token redacted, then exit")
+
+	return flags
+}
+
+// Reads a token from a file, ignoring surrounding whitespace
+func readTokenFile(path string) (string, error) {
+	fbytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading token file: %w", err)
+	}
+
+	return strings.TrimSpace(string(fbytes)), nil
+}
+
+// Collects overrides from the environment and the command line, the latter taking precedence
+func collectOverrides(flags *Flags) (map[string]override, error) {
+	overrides := make(map[string]override)
+
+	// Environment variables
+	if path := os.Getenv(tokenFileEnv); path != "" {
+		token, err := readTokenFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", tokenFileEnv, err)
+		}
+
+		overrides[settingToken] = override{token, "env " + tokenFileEnv}
+	}
+
+	for setting, env := range settingEnvs {
+		if value, ok := os.LookupEnv(env); ok {
+			overrides[setting] = override{value, "env " + env}
+		}
+	}
+
+	if flags == nil || flags.fs == nil {
+		return overrides, nil
+	}
+
+	// Command-line flags, only those explicitly set
+	var err error
+	flags.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "token":
+			overrides[settingToken] = override{flags.Token, "flag --token"}
+		case "token-file":
+			token, tokenErr := readTokenFile(flags.TokenFile)
+			if tokenErr != nil {
+				err = fmt.Errorf("--token-file: %w", tokenErr)
+			}
+
+			overrides[settingToken] = override{token, "flag --token-file"}
+		case "owner":
+			overrides[settingOwner] = override{flags.Owner, "flag --owner"}
+		case "conversion-rate":
+			overrides[settingConversionRate] = override{flags.ConversionRate, "flag --conversion-rate"}
+		}
+	})
+
+	return overrides, err
+}
+
+// Applies the overrides on top of the config, recording where each setting came from
+func applyOverrides(config *Config, overrides map[string]override) error {
+	var errs []error
+
+	for setting, o := range overrides {
+		switch setting {
+		case settingToken:
+			config.tokenOverride = o.value
+		case settingOwner:
+			owner, err := strconv.ParseInt(strings.TrimSpace(o.value), 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s (%s): %q is not a valid user ID", setting, o.source, o.value))
+				continue
+			}
+
+			config.fileOwner, config.Owner = config.Owner, owner
+		case settingConversionRate:
+			rate, err := strconv.ParseInt(strings.TrimSpace(o.value), 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s (%s): %q is not a valid number", setting, o.source, o.value))
+				continue
+			}
+
+			config.fileConversionRate, config.ConversionRate = config.ConversionRate, rate
+		}
+
+		config.sources[setting] = o.source
+	}
+
+	return errors.Join(errs...)
+}
+
+// Verifies the effective config is usable
+func validateConfig(config *Config) error {
+	var errs []error
+
+	token := config.BotToken()
+	if token == "" {
+		errs = append(errs, fmt.Errorf("%s is not set: set it in the config file, with %s, %s or --token",
+			settingToken, settingEnvs[settingToken], tokenFileEnv))
+	} else if !strings.Contains(token, ":") {
+		errs = append(errs, fmt.Errorf("%s (%s) does not look like a bot API token (expected <id>:<secret>)",
+			settingToken, config.source(settingToken)))
+	}
+
+	if config.Owner < 0 {
+		errs = append(errs, fmt.Errorf("%s (%s) must not be negative, got %d",
+			settingOwner, config.source(settingOwner), config.Owner))
+	}
+
+	if config.ConversionRate <= 0 {
+		errs = append(errs, fmt.Errorf("%s (%s) must be positive, got %d",
+			settingConversionRate, config.source(settingConversionRate), config.ConversionRate))
+	}
+
+	if _, ok := config.Tiers[spam.DefaultTier]; !ok {
+		errs = append(errs, fmt.Errorf("Tiers must include the %q tier", spam.DefaultTier))
+	}
+
+	for name, tier := range config.Tiers {
+		if tier.HourlyLimit < 0 || tier.DailyLimit < 0 || tier.BatchSize < 0 {
+			errs = append(errs, fmt.Errorf("Tier %q has negative limits: use 0 for unlimited", name))
+		}
+	}
+
+	for user, name := range config.UserTiers {
+		if _, ok := config.Tiers[name]; !ok {
+			errs = append(errs, fmt.Errorf("UserTiers: user %d is assigned to unknown tier %q", user, name))
+		}
+	}
+
+	for _, hours := range config.Penalties.CooldownHours {
+		if hours <= 0 {
+			errs = append(errs, fmt.Errorf("Penalties: cooldowns must be positive, got %d hours", hours))
+		}
+	}
+
+	if config.Penalties.StrikeWindowHours < 0 || config.Penalties.FloodImages < 0 || config.Penalties.FloodSeconds < 0 {
+		errs = append(errs, fmt.Errorf("Penalties: the strike window and flood limits must not be negative"))
+	}
+
+	if config.LoadShedding.MaxConversions < 0 || config.LoadShedding.MaxBacklog < 0 {
+		errs = append(errs, fmt.Errorf("LoadShedding: thresholds must not be negative: use 0 to disable them"))
+	}
+
+	if err := config.ImageLimits.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("ImageLimits: %w", err))
+	}
+
+	if config.ConversionCache < 0 {
+		errs = append(errs, fmt.Errorf("ConversionCache must not be negative: use 0 to disable it"))
+	}
+
+	if err := config.Reports.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("Reports: %w", err))
+	}
+
+	if err := config.Alerts.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("Alerts: %w", err))
+	}
+
+	for _, admin := range config.Admins {
+		if admin <= 0 {
+			errs = append(errs, fmt.Errorf("Admins must be valid user IDs, got %d", admin))
+		}
+	}
+
+	if config.SendRate <= 0 {
+		errs = append(errs, fmt.Errorf("SendRate must be positive, got %g", config.SendRate))
+	}
+
+	// Documents take two tokens from the send limiter
+	if config.SendBurst < 2 {
+		errs = append(errs, fmt.Errorf("SendBurst must be at least 2, got %d", config.SendBurst))
+	}
+
+	if _, err := zerolog.ParseLevel(config.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LogLevel %q is not a valid log level", config.LogLevel))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacts the secret part of a bot token
+func redactToken(token string) string {
+	if id, _, found := strings.Cut(token, ":"); found {
+		return id + ":<redacted>"
+	}
+
+	if token == "" {
+		return ""
+	}
+
+	return "<redacted>"
+}
+
+// Returns where a setting's effective value came from
+func (config *Config) source(setting string) string {
+	if src, ok := config.sources[setting]; ok {
+		return src
+	}
+
+	return "file"
+}
+
+// Returns where a setting is overridden, e.g. "env TG_RESIZE_OWNER", or an empty string if
+// its value comes from the config file or the defaults
+func (config *Config) overrideSource(setting string) string {
+	if src := config.source(setting); strings.HasPrefix(src, "env ") || strings.HasPrefix(src, "flag ") {
+		return src
+	}
+
+	return ""
+}
+
+// Returns where the conversion rate is overridden, or an empty string if it isn't.
+// An override takes precedence again over /limits on the next reload or restart.
+func (config *Config) ConversionRateOverride() string {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
+
+	return config.overrideSource(settingConversionRate)
+}
+
+// Marshals the config as it's stored in the config file: overridden settings are written with
+// their value from the file, so overrides never end up in it. Mutex must be held.
+func (config *Config) marshalFileLayer() ([]byte, error) {
+	owner, conversionRate := config.Owner, config.ConversionRate
+
+	if config.overrideSource(settingOwner) != "" {
+		config.Owner = config.fileOwner
+	}
+
+	if config.overrideSource(settingConversionRate) != "" {
+		config.ConversionRate = config.fileConversionRate
+	}
+
+	jsonbytes, err := json.MarshalIndent(config, "", "\t")
+	config.Owner, config.ConversionRate = owner, conversionRate
+
+	return jsonbytes, err
+}
+
+// Returns the token the bot should use, preferring overrides to the config file
+func (config *Config) BotToken() string {
+	if config.tokenOverride != "" {
+		return config.tokenOverride
+	}
+
+	return config.Token
+}
+
+// Describes the effective config with the token redacted, for --print-config
+func (config *Config) Describe() string {
+	config.Mutex.Lock()
+	defer config.Mutex.Unlock()
+
+	return fmt.Sprintf(
+		"Token:          %s (%s)\n"+
+			"Owner:          %d (%s)\n"+
+			"Admins:         %v\n"+
+			"ConversionRate: %d (%s)\n"+
+			"SendRate:       %g/s, burst %d\n"+
+			"LogLevel:       %s\n"+
+			"Version:        %d\n"+
+			"StatConverted:  %d\n"+
+			"UniqueUsers:    %d",
+		redactToken(config.BotToken()), config.source(settingToken),
+		config.Owner, config.source(settingOwner),
+		config.Admins,
+		config.ConversionRate, config.source(settingConversionRate),
+		config.SendRate, config.SendBurst, config.LogLevel,
+		config.Version, config.StatConverted, len(config.UniqueUsers),
+	)
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// Checks if two lists of user IDs are identical
+func equalIds(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sets the global log level. The level has been validated with the rest of the config.
+func ApplyLogLevel(level string) {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		log.Error().Err(err).Msgf("Invalid log level %s", level)
+		return
+	}
+
+	zerolog.SetGlobalLevel(lvl)
+}
+
+// Re-reads the config from disk and applies the settings that can be changed
+// while the bot is running. In-memory statistics are kept as they are, and
+// changes to settings that require a restart are ignored with a warning.
+//
+// Environment and command-line overrides are applied on top of the file again, so
+// they take precedence over changes made at runtime with /limits, just as on a restart.
+// Changes made with /limits and /tier are written to the file as they're made.
+func (session *Session) ReloadConfig(flags *Flags) error {
+	return session.reloadConfigFrom(configFolder(), flags)
+}
+
+// Reloads the config from the config folder at configPath
+func (session *Session) reloadConfigFrom(configPath string, flags *Flags) error {
+	fresh, err := readConfigFrom(configPath, flags)
+	if err != nil {
+		return err
+	}
+
+	conf := session.Config
+	conf.Mutex.Lock()
+
+	// The bot is already connected with the old token. The new one is kept, so that
+	// dumps don't undo the change before the restart.
+	if fresh.BotToken() != conf.BotToken() {
+		log.Warn().Msg("⚠️ Token changed in config: a restart is required for it to take effect")
+	}
+
+	conf.Token, conf.tokenOverride, conf.sources = fresh.Token, fresh.tokenOverride, fresh.sources
+	conf.fileOwner, conf.fileConversionRate = fresh.fileOwner, fresh.fileConversionRate
+
+	// Dumps may overwrite the file again, now that its changes are applied
+	conf.fileHash = fresh.fileHash
+
+	if fresh.Owner != conf.Owner {
+		log.Info().Msgf("🔧 Owner changed from %d to %d", conf.Owner, fresh.Owner)
+		conf.Owner = fresh.Owner
+	}
+
+	if !equalIds(fresh.Admins, conf.Admins) {
+		log.Info().Msgf("🔧 Admins changed from %v to %v", conf.Admins, fresh.Admins)
+		conf.Admins = fresh.Admins
+	}
+
+	if fresh.ConversionRate != conf.ConversionRate {
+		log.Info().Msgf("🔧 Conversion rate changed from %d to %d", conf.ConversionRate, fresh.ConversionRate)
+		conf.ConversionRate = fresh.ConversionRate
+	}
+
+	// Tiers and penalties are always re-applied, as comparing them is more work than replacing them
+	conf.Tiers, conf.UserTiers, conf.Penalties = fresh.Tiers, fresh.UserTiers, fresh.Penalties
+	conf.LoadShedding = fresh.LoadShedding
+	conf.ImageLimits = fresh.ImageLimits
+	conf.ConversionCache = fresh.ConversionCache
+	conf.Reports = fresh.Reports
+	conf.Alerts = fresh.Alerts
+
+	limiterChanged := fresh.SendRate != conf.SendRate || fresh.SendBurst != conf.SendBurst
+	if limiterChanged {
+		log.Info().Msgf("🔧 Send rate changed from %g/%d to %g/%d",
+			conf.SendRate, conf.SendBurst, fresh.SendRate, fresh.SendBurst)
+		conf.SendRate, conf.SendBurst = fresh.SendRate, fresh.SendBurst
+	}
+
+	if fresh.LogLevel != conf.LogLevel {
+		log.Info().Msgf("🔧 Log level changed from %s to %s", conf.LogLevel, fresh.LogLevel)
+		conf.LogLevel = fresh.LogLevel
+	}
+
+	conf.Mutex.Unlock()
+
+	// Push the new values to the components using them
+	session.Spam.SetTiers(conf.TierSettings())
+	session.Spam.SetPenalties(fresh.Penalties)
+	session.Admission.SetLimits(fresh.LoadShedding)
+	session.Alerts.SetSettings(fresh.Alerts)
+	session.Cache.SetCapacity(fresh.ConversionCache)
+
+	if err := session.Reports.Schedule(fresh.Reports); err != nil {
+		log.Error().Err(err).Msg("⚠️ Rescheduling reports failed")
+	}
+
+	if limiterChanged {
+		session.Queue.Limiter.SetLimit(rate.Limit(fresh.SendRate))
+		session.Queue.Limiter.SetBurst(fresh.SendBurst)
+	}
+
+	ApplyLogLevel(fresh.LogLevel)
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tg-resize-sticker-images/admission"
+	"tg-resize-sticker-images/alerts"
+	"tg-resize-sticker-images/cache"
+	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/reports"
+	"tg-resize-sticker-images/spam"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// Dumps a valid config to a temporary config folder, and starts a session with it as loaded from disk
+func newReloadSession(t *testing.T) (*Session, string) {
+	configPath := t.TempDir()
+
+	initial := defaultConfig()
+	initial.Token = "12345:abcdefgh"
+	initial.Reports.Enabled = false
+
+	if err := dumpConfigTo(configPath, initial); err != nil {
+		t.Fatalf("Error dumping config: %s", err)
+	}
+
+	conf, err := readConfigFrom(configPath, nil)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	aspam := spam.NewAntiSpam()
+	aspam.SetTiers(conf.TierSettings())
+
+	session := &Session{
+		Config:    conf,
+		Spam:      aspam,
+		Queue:     &queue.SendQueue{Limiter: rate.NewLimiter(rate.Limit(conf.SendRate), conf.SendBurst)},
+		Admission: admission.NewController(filepath.Join(t.TempDir(), "maintenance.json"), conf.LoadShedding, func() uint64 { return 0 }),
+		Reports:   reports.NewCollector(filepath.Join(t.TempDir(), "reports.json")),
+		Alerts:    alerts.NewMonitor(conf.Alerts),
+		Cache:     cache.New(conf.ConversionCache),
+	}
+
+	return session, configPath
+}
+
+// Edits the config file on disk, like an admin would
+func editConfigFile(t *testing.T, configPath string, edit func(config *Config)) {
+	configf := filepath.Join(configPath, configFileName)
+
+	config, err := readConfigFile(configf)
+	if err != nil {
+		t.Fatalf("Error reading config: %s", err)
+	}
+
+	edit(config)
+
+	jsonbytes, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(configf, jsonbytes, 0600); err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	session, configPath := newReloadSession(t)
+	session.Config.StatConverted = 3
+
+	editConfigFile(t, configPath, func(config *Config) {
+		config.ConversionRate = 50
+		config.Admins = []int64{7}
+		config.SendRate = 5
+		config.StatConverted = 999
+	})
+
+	// The edit isn't overwritten before it's applied
+	if err := dumpConfigTo(configPath, session.Config); !errors.Is(err, errChangedOnDisk) {
+		t.Fatalf("Expected dumping over an edited config to be refused, got %v", err)
+	}
+
+	if err := session.reloadConfigFrom(configPath, nil); err != nil {
+		t.Fatalf("Error reloading config: %s", err)
+	}
+
+	conf := session.Config
+	if conf.ConversionRate != 50 || !conf.IsAdmin(7) || conf.SendRate != 5 {
+		t.Errorf("Expected the edited settings to be applied, got %+v", conf)
+	}
+
+	if conf.StatConverted != 3 {
+		t.Errorf("Expected in-memory statistics to be kept, got %d", conf.StatConverted)
+	}
+
+	if _, tier := session.Spam.TierOf(1); tier.HourlyLimit != 50 {
+		t.Errorf("Expected the default tier's limit to be updated, got %d", tier.HourlyLimit)
+	}
+
+	if limit := session.Queue.Limiter.Limit(); limit != 5 {
+		t.Errorf("Expected the send rate to be updated, got %g", limit)
+	}
+
+	// Once applied, the config is dumped again
+	if err := dumpConfigTo(configPath, conf); err != nil {
+		t.Errorf("Expected dumping to succeed after reloading, got %s", err)
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	session, configPath := newReloadSession(t)
+
+	editConfigFile(t, configPath, func(config *Config) {
+		config.ConversionRate = 50
+		config.ConversionCache = -1
+	})
+
+	if err := session.reloadConfigFrom(configPath, nil); err == nil {
+		t.Fatalf("Expected an invalid config to be rejected")
+	}
+
+	// The running config is kept as it was
+	if session.Config.ConversionRate != 100 || session.Config.ConversionCache != 10000 {
+		t.Errorf("Expected the previous config to be kept, got %+v", session.Config)
+	}
+
+	if _, tier := session.Spam.TierOf(1); tier.HourlyLimit != 100 {
+		t.Errorf("Expected the default tier's limit to be kept, got %d", tier.HourlyLimit)
+	}
+}
+
+func TestReloadWarnsOnTokenChange(t *testing.T) {
+	session, configPath := newReloadSession(t)
+
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = previous })
+
+	editConfigFile(t, configPath, func(config *Config) {
+		config.Token = "67890:ijklmnop"
+	})
+
+	if err := session.reloadConfigFrom(configPath, nil); err != nil {
+		t.Fatalf("Error reloading config: %s", err)
+	}
+
+	if !strings.Contains(logs.String(), "a restart is required") {
+		t.Errorf("Expected a warning that the token needs a restart, got logs:\n%s", logs.String())
+	}
+
+	// The new token is kept for the restart, instead of being overwritten by the next dump
+	if err := dumpConfigTo(configPath, session.Config); err != nil {
+		t.Fatalf("Error dumping config: %s", err)
+	}
+
+	if dumped, err := readConfigFile(filepath.Join(configPath, configFileName)); err != nil || dumped.Token != "67890:ijklmnop" {
+		t.Errorf("Expected the new token to be dumped, got %+v (%v)", dumped, err)
+	}
+}
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tg-resize-sticker-images/storage"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	configFileName   = "bot-config.json" // Name of the config file under the config folder
+	backupFolderName = "backups"         // Folder under the config folder the backups are stored in
+	backupPrefix     = "bot-config-"     // Prefix for dated backup files
+	backupDateFormat = "20060102"        // Lexically sortable date for backup file names
+	maxBackups       = 10                // How many days of backups are kept around
+)
+
+// Returned when dumping would overwrite edits made to the config file since it was loaded
+var errChangedOnDisk = errors.New("config file was changed on disk: send SIGHUP to apply the changes, or restart")
+
+// Serializes dumps, so that another dump can't write between checking the file and writing it
+var dumpMutex sync.Mutex
+
+// Migrations from one config schema version to the next: migrations[i]
+// upgrades a config from version i to version i+1.
+var migrations = []func(config *Config){
+	// 0 -> 1: version field introduced, nothing to convert
+	func(config *Config) {},
+}
+
+// Current version of the config schema
+var configVersion = len(migrations)
+
+// Returns the path of the folder the config is stored in
+func configFolder() string {
+	wd, _ := os.Getwd()
+	return filepath.Join(wd, "config")
+}
+
+// Lists the backup files in the backup folder, newest first
+func listBackups(backupPath string) []string {
+	entries, err := os.ReadDir(backupPath)
+	if err != nil {
+		return nil
+	}
+
+	backups := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, ".json") {
+			backups = append(backups, filepath.Join(backupPath, name))
+		}
+	}
+
+	// Timestamps in the file names sort lexically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
+}
+
+// Writes the backup of the config for the day, unless it was already written, and removes backups
+// beyond maxBackups. The config is dumped every half hour and on every admin change, so each backup
+// keeps the config as it was at the day's first dump, and a bad change is never backed up over the
+// config it replaced on the same day.
+func writeBackup(configPath string, data []byte, now time.Time) error {
+	backupPath := filepath.Join(configPath, backupFolderName)
+	if err := os.MkdirAll(backupPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(backupPath, fmt.Sprintf("%s%s.json", backupPrefix, now.UTC().Format(backupDateFormat)))
+	if _, err := os.Stat(fileName); errors.Is(err, os.ErrNotExist) {
+		if err := storage.WriteFileAtomic(fileName, data); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// Rotate: drop the oldest backups
+	backups := listBackups(backupPath)
+	for i := maxBackups; i < len(backups); i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			log.Warn().Err(err).Msgf("Removing old config backup %s failed", backups[i])
+		}
+	}
+
+	return nil
+}
+
+// Returns the hash of a file's contents, or a zero hash if the file doesn't exist
+func hashFile(path string) ([sha256.Size]byte, error) {
+	fbytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return [sha256.Size]byte{}, nil
+	} else if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	return sha256.Sum256(fbytes), nil
+}
+
+// Writes the config atomically to the config folder, plus a daily rotating backup. Refuses
+// to overwrite a config file that was edited since it was loaded, until it's reloaded.
+func dumpConfigTo(configPath string, config *Config) error {
+	dumpMutex.Lock()
+	defer dumpMutex.Unlock()
+
+	configf := filepath.Join(configPath, configFileName)
+	onDisk, err := hashFile(configf)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	config.Mutex.Lock()
+	jsonbytes, err := config.marshalFileLayer()
+	changed := onDisk != config.fileHash
+	config.Mutex.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("marshaling config: %w", err)
+	}
+
+	if changed {
+		return errChangedOnDisk
+	}
+
+	if err = storage.WriteFileAtomic(configf, jsonbytes); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+
+	config.Mutex.Lock()
+	config.fileHash = sha256.Sum256(jsonbytes)
+	config.Mutex.Unlock()
+
+	if err = writeBackup(configPath, jsonbytes, time.Now()); err != nil {
+		return fmt.Errorf("writing config backup: %w", err)
+	}
+
+	return nil
+}
+
+// Reads and unmarshals a single config file
+func readConfigFile(path string) (*Config, error) {
+	fbytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal on top of the defaults, so missing fields keep their default values
+	config := defaultConfig()
+
+	// Files without a version field predate versioning
+	config.Version = 0
+
+	if err = json.Unmarshal(fbytes, config); err != nil {
+		return nil, err
+	}
+
+	config.fileHash = sha256.Sum256(fbytes)
+	return config, nil
+}
+
+// Loads the config from the config folder. If the config file is missing or
+// corrupted, the newest valid backup is used instead.
+func loadConfigFrom(configPath string) (*Config, error) {
+	configf := filepath.Join(configPath, configFileName)
+
+	config, err := readConfigFile(configf)
+	if err == nil {
+		return config, nil
+	}
+
+	log.Error().Err(err).Msgf("⚠️ Error loading %s, attempting to restore from backups", configf)
+
+	for _, backup := range listBackups(filepath.Join(configPath, backupFolderName)) {
+		config, backupErr := readConfigFile(backup)
+		if backupErr != nil {
+			log.Warn().Err(backupErr).Msgf("Config backup %s is not usable", backup)
+			continue
+		}
+
+		// The broken config file is replaced by the next dump
+		config.fileHash, err = hashFile(configf)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %w", err)
+		}
+
+		log.Warn().Msgf("♻️ Config restored from backup %s", backup)
+		return config, nil
+	}
+
+	return nil, fmt.Errorf("no usable config or backup found: %w", err)
+}
+
+// Runs every migration needed to bring the config to the current schema version
+func migrateConfig(config *Config) {
+	if config.Version > configVersion {
+		log.Warn().Msgf("Config schema version %d is newer than supported version %d",
+			config.Version, configVersion)
+		return
+	}
+
+	for config.Version < configVersion {
+		log.Info().Msgf("🔧 Migrating config from version %d to %d", config.Version, config.Version+1)
+		migrations[config.Version](config)
+		config.Version++
+	}
+}
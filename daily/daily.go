@@ -6,6 +6,8 @@ import (
 	"sync"
 	"time"
 
+	"tg-resize-sticker-images/analytics"
+
 	"github.com/dustin/go-humanize"
 )
 
@@ -13,6 +15,7 @@ type HourlyStatistic struct {
 	hour      int
 	count     int
 	timestamp int64
+	breakdown analytics.Breakdown // Details of the hour's conversions
 }
 
 type ConversionStatistics struct {
@@ -37,6 +40,16 @@ func NewConversionStatistics() *ConversionStatistics {
 }
 
 func (cs *ConversionStatistics) AddConversionByUser(userId int64) {
+	cs.addConversion(userId, nil)
+}
+
+// Adds a conversion by a user, including its details in the daily breakdown
+func (cs *ConversionStatistics) AddConversion(userId int64, conversion analytics.Conversion) {
+	cs.addConversion(userId, &conversion)
+}
+
+// Counts a conversion in the current hour, and its details if known
+func (cs *ConversionStatistics) addConversion(userId int64, conversion *analytics.Conversion) {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
 
@@ -50,10 +63,15 @@ func (cs *ConversionStatistics) AddConversionByUser(userId int64) {
 	if isOlderThan24Hours(now, cs.stats[currentHour].timestamp) {
 		cs.stats[currentHour].count = 0
 		cs.stats[currentHour].timestamp = now
+		cs.stats[currentHour].breakdown = analytics.Breakdown{}
 	}
 
 	cs.stats[currentHour].count++
 
+	if conversion != nil {
+		cs.stats[currentHour].breakdown.Add(*conversion)
+	}
+
 	// Store the user interaction
 	cs.users[userId] = now
 }
@@ -74,6 +92,7 @@ func (cs *ConversionStatistics) AddConversionAt(userId int64, unixTime int64) {
 	if isOlderThan24Hours(now, cs.stats[currentHour].timestamp) {
 		cs.stats[currentHour].count = 0
 		cs.stats[currentHour].timestamp = unixTime
+		cs.stats[currentHour].breakdown = analytics.Breakdown{}
 	}
 
 	// Only increment the count if the conversion was within the past 24 hours
@@ -106,6 +125,26 @@ func (cs *ConversionStatistics) CountConversions() int {
 	return total
 }
 
+// Returns the details of the conversions during the trailing 24 hours
+func (cs *ConversionStatistics) Breakdown() analytics.Breakdown {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	var breakdown analytics.Breakdown
+	now := time.Now().UTC().Unix()
+
+	for i := 0; i < 24; i++ {
+		// Ignore statistics older than 24 hours
+		if isOlderThan24Hours(now, cs.stats[i].timestamp) {
+			continue
+		}
+
+		breakdown.Merge(cs.stats[i].breakdown)
+	}
+
+	return breakdown
+}
+
 func (cs *ConversionStatistics) CountUniqueUsers() int {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
@@ -2,6 +2,7 @@ package daily
 
 import (
 	"testing"
+	"tg-resize-sticker-images/analytics"
 	"time"
 )
 
@@ -111,3 +112,20 @@ func TestStatisticsString(t *testing.T) {
 	// Output:
 	t.Logf("%s", cs.StatisticsString())
 }
+
+func TestBreakdown(t *testing.T) {
+	cs := NewConversionStatistics()
+
+	cs.AddConversion(1, analytics.Conversion{Mode: "emoji", MediaType: "sticker"})
+	cs.AddConversion(2, analytics.Conversion{Mode: "sticker", MediaType: "photo", CompressionFailed: true})
+	cs.AddConversionByUser(3)
+
+	if cs.CountConversions() != 3 {
+		t.Errorf("Expected count to be 3, got %d", cs.CountConversions())
+	}
+
+	breakdown := cs.Breakdown()
+	if breakdown.Total != 2 || breakdown.Modes["emoji"] != 1 || breakdown.CompressionFailed != 1 {
+		t.Errorf("Expected a breakdown of 2 conversions, got %+v", breakdown)
+	}
+}
@@ -0,0 +1,195 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"tg-resize-sticker-images/storage"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	hourRetention = 7 * 24 * time.Hour   // How long per-hour buckets are kept
+	dayRetention  = 400 * 24 * time.Hour // How long per-day buckets are kept; monthly ones are kept forever
+)
+
+// Conversions during an hour, day or month, starting at Start (UTC)
+type Bucket struct {
+	Start int64 // Unix timestamp the bucket starts at
+	Count int64 // Conversions during the bucket
+}
+
+// Returns the time the bucket starts at
+func (bucket Bucket) Time() time.Time {
+	return time.Unix(bucket.Start, 0).UTC()
+}
+
+// Time series of conversions, persisted to disk
+type series struct {
+	Hours       []Bucket // Per-hour buckets, sorted
+	Days        []Bucket // Per-day buckets, sorted
+	Months      []Bucket // Per-month buckets, sorted
+	BusiestHour Bucket   // Hour with the most conversions ever
+	BusiestDay  Bucket   // Day with the most conversions ever
+}
+
+// Durable statistics of conversions beyond the trailing day. Each conversion
+// is counted in its hour, which rolls up into its day and month.
+type History struct {
+	path  string     // Path of the persisted statistics
+	data  series     // Conversions over time
+	mutex sync.Mutex // Mutex to avoid concurrent writes
+}
+
+// Creates the history, restoring it from path. A missing file starts an empty history.
+func New(path string) *History {
+	history := &History{path: path}
+
+	if err := storage.ReadJSON(path, &history.data); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error().Err(err).Msg("⚠️ Restoring statistics history failed, starting from scratch")
+		history.data = series{}
+	}
+
+	return history
+}
+
+// Writes the history to disk
+func (history *History) Save() error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	return storage.WriteJSON(history.path, history.data)
+}
+
+// Start of the hour, day and month of a time, in UTC
+func bucketStarts(at time.Time) (int64, int64, int64) {
+	at = at.UTC()
+
+	hour := at.Truncate(time.Hour)
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return hour.Unix(), day.Unix(), month.Unix()
+}
+
+// Adds a conversion to the bucket starting at start, keeping the buckets sorted.
+// Returns the buckets and the updated bucket.
+func increment(buckets []Bucket, start int64) ([]Bucket, Bucket) {
+	// Conversions nearly always land in the newest bucket
+	i := len(buckets)
+	for i > 0 && buckets[i-1].Start > start {
+		i--
+	}
+
+	if i > 0 && buckets[i-1].Start == start {
+		buckets[i-1].Count++
+		return buckets, buckets[i-1]
+	}
+
+	buckets = append(buckets, Bucket{})
+	copy(buckets[i+1:], buckets[i:])
+	buckets[i] = Bucket{Start: start, Count: 1}
+
+	return buckets, buckets[i]
+}
+
+// Drops the buckets starting before since
+func prune(buckets []Bucket, since int64) []Bucket {
+	i := 0
+	for i < len(buckets) && buckets[i].Start < since {
+		i++
+	}
+
+	return buckets[i:]
+}
+
+// Records a conversion at the given time
+func (history *History) AddConversion(at time.Time) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	hourStart, dayStart, monthStart := bucketStarts(at)
+	data := &history.data
+
+	var hour, day Bucket
+	data.Hours, hour = increment(data.Hours, hourStart)
+	data.Days, day = increment(data.Days, dayStart)
+	data.Months, _ = increment(data.Months, monthStart)
+
+	if hour.Count > data.BusiestHour.Count {
+		data.BusiestHour = hour
+	}
+
+	if day.Count > data.BusiestDay.Count {
+		data.BusiestDay = day
+	}
+
+	// Forget buckets that have been rolled up into longer ones
+	now := time.Now()
+	data.Hours = prune(data.Hours, now.Add(-hourRetention).Unix())
+	data.Days = prune(data.Days, now.Add(-dayRetention).Unix())
+}
+
+// Returns the conversions during the last n days, including today
+func (history *History) LastDays(n int) int64 {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	_, today, _ := bucketStarts(time.Now())
+	since := time.Unix(today, 0).UTC().AddDate(0, 0, 1-n).Unix()
+
+	total := int64(0)
+	for _, day := range history.data.Days {
+		if day.Start >= since {
+			total += day.Count
+		}
+	}
+
+	return total
+}
+
+// Returns the hour and the day with the most conversions
+func (history *History) Records() (Bucket, Bucket) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	return history.data.BusiestHour, history.data.BusiestDay
+}
+
+// Spreads the buckets over n slots of step seconds, oldest first, the last slot
+// starting at last
+func slots(buckets []Bucket, last int64, step int64, n int) []int64 {
+	counts := make([]int64, n)
+
+	for _, bucket := range buckets {
+		age := (last - bucket.Start) / step
+		if bucket.Start <= last && age < int64(n) {
+			counts[int64(n)-1-age] += bucket.Count
+		}
+	}
+
+	return counts
+}
+
+// Returns the conversions during each of the last n hours, oldest first, ending
+// with the current hour
+func (history *History) Hourly(n int) []int64 {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	hour, _, _ := bucketStarts(time.Now())
+	return slots(history.data.Hours, hour, int64(time.Hour/time.Second), n)
+}
+
+// Returns the conversions during each of the last n days, oldest first, ending
+// with today
+func (history *History) Daily(n int) []int64 {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	_, today, _ := bucketStarts(time.Now())
+	return slots(history.data.Days, today, int64(24*time.Hour/time.Second), n)
+}
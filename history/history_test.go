@@ -0,0 +1,96 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRollUp(t *testing.T) {
+	history := New(filepath.Join(t.TempDir(), "history.json"))
+	now := time.Now()
+
+	// Three conversions this hour, one yesterday, one ten days ago
+	for i := 0; i < 3; i++ {
+		history.AddConversion(now)
+	}
+	history.AddConversion(now.Add(-24 * time.Hour))
+	history.AddConversion(now.Add(-10 * 24 * time.Hour))
+
+	if total := history.LastDays(7); total != 4 {
+		t.Errorf("Expected 4 conversions during the last 7 days, got %d", total)
+	}
+
+	if total := history.LastDays(30); total != 5 {
+		t.Errorf("Expected 5 conversions during the last 30 days, got %d", total)
+	}
+
+	hour, day := history.Records()
+	if hour.Count != 3 || day.Count != 3 {
+		t.Errorf("Expected records of 3 conversions, got %d per hour and %d per day", hour.Count, day.Count)
+	}
+
+	// Hours older than the retention are rolled up into days and months only
+	if len(history.data.Hours) != 2 {
+		t.Errorf("Expected 2 hourly buckets to be kept, got %d", len(history.data.Hours))
+	}
+
+	months := int64(0)
+	for _, month := range history.data.Months {
+		months += month.Count
+	}
+
+	if months != 5 {
+		t.Errorf("Expected months to add up to 5 conversions, got %d", months)
+	}
+}
+
+func TestOutOfOrderConversions(t *testing.T) {
+	history := New(filepath.Join(t.TempDir(), "history.json"))
+	now := time.Now()
+
+	history.AddConversion(now)
+	history.AddConversion(now.Add(-2 * time.Hour))
+	history.AddConversion(now.Add(-time.Hour))
+
+	for i := 1; i < len(history.data.Hours); i++ {
+		if history.data.Hours[i-1].Start >= history.data.Hours[i].Start {
+			t.Fatalf("Expected hourly buckets to stay sorted, got %v", history.data.Hours)
+		}
+	}
+}
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+
+	history := New(path)
+	history.AddConversion(time.Now())
+
+	if err := history.Save(); err != nil {
+		t.Fatalf("Error saving history: %s", err)
+	}
+
+	if total := New(path).LastDays(1); total != 1 {
+		t.Errorf("Expected the conversion to be restored, got %d conversions", total)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	history := New(filepath.Join(t.TempDir(), "history.json"))
+	now := time.Now()
+
+	history.AddConversion(now)
+	history.AddConversion(now)
+	history.AddConversion(now.Add(-3 * time.Hour))
+	history.AddConversion(now.Add(-48 * time.Hour))
+
+	hourly := history.Hourly(24)
+	if len(hourly) != 24 || hourly[23] != 2 || hourly[20] != 1 {
+		t.Errorf("Expected 2 conversions this hour and 1 three hours ago, got %v", hourly)
+	}
+
+	daily := history.Daily(30)
+	if len(daily) != 30 || daily[27] != 1 || daily[26]+daily[28]+daily[29] != 3 {
+		t.Errorf("Expected 1 conversion two days ago and 3 since, got %v", daily)
+	}
+}
@@ -0,0 +1,140 @@
+package limits
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Counts the frames of an image by walking its container, without decoding any
+// pixels. Still images, and formats that can't be animated, have one frame.
+func Frames(data []byte) int {
+	var frames int
+
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		frames = gifFrames(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		frames = apngFrames(data)
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		frames = webpFrames(data)
+	}
+
+	if frames < 1 {
+		return 1
+	}
+
+	return frames
+}
+
+// Skips a GIF's data sub-blocks, returning the offset after the terminating block
+func skipSubBlocks(data []byte, offset int) int {
+	for offset < len(data) {
+		size := int(data[offset])
+		offset++
+
+		if size == 0 {
+			break
+		}
+
+		offset += size
+	}
+
+	return offset
+}
+
+// Counts the image descriptors of a GIF
+func gifFrames(data []byte) int {
+	// Header and logical screen descriptor
+	if len(data) < 13 {
+		return 0
+	}
+
+	offset := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		offset += 3 << ((flags & 0x07) + 1)
+	}
+
+	frames := 0
+	for offset < len(data) {
+		switch data[offset] {
+		case 0x2c:
+			// Image descriptor, with an optional local color table, then the LZW code size
+			frames++
+
+			if offset+10 > len(data) {
+				return frames
+			}
+
+			flags := data[offset+9]
+			offset += 10
+
+			if flags&0x80 != 0 {
+				offset += 3 << ((flags & 0x07) + 1)
+			}
+
+			offset = skipSubBlocks(data, offset+1)
+
+		case 0x21:
+			// Extension: label, then sub-blocks
+			offset = skipSubBlocks(data, offset+2)
+
+		default:
+			// Trailer, or garbage
+			return frames
+		}
+	}
+
+	return frames
+}
+
+// Reads the frame count of an animated PNG from its acTL chunk, which comes before the image data
+func apngFrames(data []byte) int {
+	offset := 8
+
+	for offset+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		kind := string(data[offset+4 : offset+8])
+
+		if kind == "IDAT" || length < 0 {
+			break
+		}
+
+		if kind == "acTL" && length >= 4 && offset+12 <= len(data) {
+			frames := binary.BigEndian.Uint32(data[offset+8:])
+			if frames > 1<<30 {
+				return 1 << 30
+			}
+
+			return int(frames)
+		}
+
+		// Length, type, data and CRC
+		offset += 12 + length
+	}
+
+	return 1
+}
+
+// Counts the ANMF chunks of an animated WebP
+func webpFrames(data []byte) int {
+	offset := 12
+	frames := 0
+
+	for offset+8 <= len(data) {
+		kind := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+
+		if size < 0 {
+			break
+		}
+
+		if kind == "ANMF" {
+			frames++
+		}
+
+		// Chunks are padded to an even size
+		offset += 8 + size + size%2
+	}
+
+	return frames
+}
@@ -0,0 +1,113 @@
+package limits
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Errors returned when a received image exceeds a limit
+var (
+	ErrTooLarge      = errors.New("file is over the download limit")
+	ErrTooManyPixels = errors.New("image has too many pixels")
+	ErrTooManyFrames = errors.New("animation has too many frames")
+	ErrTimeout       = errors.New("conversion timed out")
+)
+
+// Limits on received images, so that a small file declaring a huge image (a
+// decompression bomb) can't exhaust memory. A limit of zero is disabled.
+type Limits struct {
+	MaxDownloadMB  int64 // Size of a downloaded file, in megabytes
+	MaxMegapixels  int64 // Pixels declared in the image's header, in millions
+	MaxFrames      int   // Frames of an animated image
+	TimeoutSeconds int   // Time a conversion may take
+}
+
+// The limits a config starts out with
+func DefaultLimits() Limits {
+	return Limits{
+		MaxDownloadMB:  20,
+		MaxMegapixels:  50,
+		MaxFrames:      100,
+		TimeoutSeconds: 30,
+	}
+}
+
+// Checks that the limits are usable
+func (limits Limits) Validate() error {
+	if limits.MaxDownloadMB < 0 || limits.MaxMegapixels < 0 || limits.MaxFrames < 0 || limits.TimeoutSeconds < 0 {
+		return fmt.Errorf("limits must not be negative: use 0 to disable them")
+	}
+
+	return nil
+}
+
+// Returns the download limit in bytes, or 0 if disabled
+func (limits Limits) MaxDownloadBytes() int64 {
+	return limits.MaxDownloadMB * 1024 * 1024
+}
+
+// Returns the time a conversion may take, or 0 if unlimited
+func (limits Limits) Timeout() time.Duration {
+	return time.Duration(limits.TimeoutSeconds) * time.Second
+}
+
+// Checks the size of a file before downloading it. A size of 0 is unknown, and allowed.
+func (limits Limits) CheckDownload(size int64) error {
+	if max := limits.MaxDownloadBytes(); max != 0 && size > max {
+		return fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
+	}
+
+	return nil
+}
+
+// Reads a download, stopping with ErrTooLarge as soon as it goes over the limit,
+// instead of reading it whole first
+func (limits Limits) Read(reader io.Reader) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+
+	max := limits.MaxDownloadBytes()
+	if max == 0 {
+		_, err := io.Copy(&buf, reader)
+		return &buf, err
+	}
+
+	// Read a byte more than allowed, to tell a file of exactly the limit from a larger one
+	n, err := io.Copy(&buf, io.LimitReader(reader, max+1))
+	if err != nil {
+		return &buf, err
+	}
+
+	if n > max {
+		return &bytes.Buffer{}, fmt.Errorf("%w: over %d bytes", ErrTooLarge, max)
+	}
+
+	return &buf, nil
+}
+
+// Checks the dimensions declared in an image's header
+func (limits Limits) CheckPixels(width int, height int) error {
+	if limits.MaxMegapixels != 0 && int64(width)*int64(height) > limits.MaxMegapixels*1000*1000 {
+		return fmt.Errorf("%w: %dx%d", ErrTooManyPixels, width, height)
+	}
+
+	return nil
+}
+
+// Checks the frames of an animated image. bimg only decodes an image's first frame, so unlike
+// CheckPixels this doesn't bound the memory decoding takes: it bounds the work done before that,
+// as vips' GIF and WebP loaders walk every frame of an animation to read its header. Only the
+// first frame is converted, so refusing long animations costs users nothing they'd get back.
+func (limits Limits) CheckFrames(data []byte) error {
+	if limits.MaxFrames == 0 {
+		return nil
+	}
+
+	if frames := Frames(data); frames > limits.MaxFrames {
+		return fmt.Errorf("%w: %d", ErrTooManyFrames, frames)
+	}
+
+	return nil
+}
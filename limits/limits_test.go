@@ -0,0 +1,136 @@
+package limits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	limits := Limits{MaxDownloadMB: 1}
+	max := limits.MaxDownloadBytes()
+
+	buf, err := limits.Read(bytes.NewReader(make([]byte, max)))
+	if err != nil || int64(buf.Len()) != max {
+		t.Errorf("Expected a file of exactly the limit to be read, got %d bytes (%v)", buf.Len(), err)
+	}
+
+	// The reader is endless, so reading it whole would never stop
+	_, err = limits.Read(endless{})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected a file over the limit to fail, got %v", err)
+	}
+
+	if err := limits.CheckDownload(max + 1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected a declared size over the limit to fail, got %v", err)
+	}
+
+	if err := (Limits{}).CheckDownload(max + 1); err != nil {
+		t.Errorf("Expected a disabled limit to allow anything, got %v", err)
+	}
+}
+
+// A reader of endless zeros
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+func TestCheckPixels(t *testing.T) {
+	limits := Limits{MaxMegapixels: 50}
+
+	if err := limits.CheckPixels(8000, 6000); err != nil {
+		t.Errorf("Expected 48 megapixels to be allowed, got %v", err)
+	}
+
+	// A decompression bomb declaring 2.5 gigapixels
+	if err := limits.CheckPixels(50000, 50000); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("Expected 2500 megapixels to fail, got %v", err)
+	}
+}
+
+// Builds a PNG chunk, with a zero CRC as it isn't checked
+func chunk(kind string, data []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	out = append(out, kind...)
+	out = append(out, data...)
+
+	return append(out, 0, 0, 0, 0)
+}
+
+// Builds a WebP chunk
+func webpChunk(kind string, size int) []byte {
+	out := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(size))...)
+	return append(out, make([]byte, size+size%2)...)
+}
+
+func TestFrames(t *testing.T) {
+	// GIF, with a local color table on every frame
+	animation := &gif.GIF{}
+	for i := 0; i < 7; i++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9))
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	var gifData bytes.Buffer
+	if err := gif.EncodeAll(&gifData, animation); err != nil {
+		t.Fatal(err)
+	}
+
+	// Still PNG
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Animated PNG declaring a million frames
+	apng := []byte("\x89PNG\r\n\x1a\n")
+	apng = append(apng, chunk("IHDR", make([]byte, 13))...)
+	apng = append(apng, chunk("acTL", []byte{0, 0x0f, 0x42, 0x40, 0, 0, 0, 0})...)
+	apng = append(apng, chunk("IDAT", nil)...)
+
+	// Animated WebP of three frames
+	webp := []byte("RIFF\x00\x00\x00\x00WEBP")
+	webp = append(webp, webpChunk("VP8X", 10)...)
+	webp = append(webp, webpChunk("ANIM", 6)...)
+	for i := 0; i < 3; i++ {
+		webp = append(webp, webpChunk("ANMF", 17)...)
+	}
+
+	cases := map[string]struct {
+		data   []byte
+		frames int
+	}{
+		"gif":     {gifData.Bytes(), 7},
+		"png":     {pngData.Bytes(), 1},
+		"apng":    {apng, 1000000},
+		"webp":    {webp, 3},
+		"garbage": {[]byte(strings.Repeat("\x00", 64)), 1},
+	}
+
+	for name, c := range cases {
+		if frames := Frames(c.data); frames != c.frames {
+			t.Errorf("Expected %d frames in %s, got %d", c.frames, name, frames)
+		}
+	}
+
+	// A truncated GIF counts the frames it has
+	if frames := Frames(gifData.Bytes()[:gifData.Len()/2]); frames < 1 || frames > 7 {
+		t.Errorf("Expected 1-7 frames in a truncated GIF, got %d", frames)
+	}
+
+	if err := (Limits{MaxFrames: 100}).CheckFrames(apng); !errors.Is(err, ErrTooManyFrames) {
+		t.Errorf("Expected too many frames, got %v", err)
+	}
+}
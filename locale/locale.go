@@ -0,0 +1,227 @@
+package locale
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Language used when the user's language is not translated
+const Default = "en"
+
+// Translations, one file per language, e.g. locales/en.json
+//
+//go:embed locales/*.json
+var files embed.FS
+
+// Values substituted for {name} placeholders in messages
+type Args map[string]any
+
+// A translated message: either plain text, or a set of plural forms
+type message struct {
+	Text  string            // Text of the message, if it has no plural forms
+	Forms map[string]string // Plural forms, e.g. "one" and "other"
+}
+
+// Decodes a message from either a string, or an object of plural forms
+func (msg *message) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &msg.Text); err == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, &msg.Forms)
+}
+
+// Picks the plural form for a count, following the CLDR plural categories
+type pluralRule func(n int) string
+
+// Plural rules of the translated languages
+var pluralRules = map[string]pluralRule{
+	"en": oneOther,
+	"de": oneOther,
+}
+
+// Plural rule for languages that only distinguish between one and many
+func oneOther(n int) string {
+	if n == 1 {
+		return "one"
+	}
+
+	return "other"
+}
+
+// Messages in one language
+type Localizer struct {
+	Language string             // Language code, e.g. "en"
+	messages map[string]message // Messages keyed by message ID
+	plural   pluralRule         // Picks plural forms
+}
+
+// Loaded translations, keyed by language code
+var catalog = mustLoad()
+
+// Loads the embedded translations. The files are compiled in, so a broken file is a bug.
+func mustLoad() map[string]*Localizer {
+	entries, err := files.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	localizers := make(map[string]*Localizer)
+	for _, entry := range entries {
+		data, err := files.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		language := strings.TrimSuffix(entry.Name(), ".json")
+		localizer := &Localizer{Language: language, plural: pluralRules[language]}
+
+		if err := json.Unmarshal(data, &localizer.messages); err != nil {
+			panic(fmt.Errorf("parsing %s: %w", entry.Name(), err))
+		}
+
+		if localizer.plural == nil {
+			panic(fmt.Errorf("no plural rule for language %q", language))
+		}
+
+		localizers[language] = localizer
+	}
+
+	return localizers
+}
+
+// Returns the codes of the translated languages, sorted
+func Languages() []string {
+	languages := make([]string, 0, len(catalog))
+	for language := range catalog {
+		languages = append(languages, language)
+	}
+
+	sort.Strings(languages)
+	return languages
+}
+
+// Checks if a language is translated
+func Has(language string) bool {
+	_, ok := catalog[language]
+	return ok
+}
+
+// Returns the localizer for an IETF language tag, e.g. "de" or "pt-br", as sent
+// by Telegram clients. Falls back to the base language, then to English.
+func For(languageCode string) *Localizer {
+	tag := strings.ToLower(languageCode)
+
+	if localizer, ok := catalog[tag]; ok {
+		return localizer
+	}
+
+	base, _, _ := strings.Cut(tag, "-")
+	if localizer, ok := catalog[base]; ok {
+		return localizer
+	}
+
+	return catalog[Default]
+}
+
+// Looks up a message, falling back to English if it isn't translated
+func (loc *Localizer) lookup(key string) (message, bool) {
+	if msg, ok := loc.messages[key]; ok {
+		return msg, true
+	}
+
+	msg, ok := catalog[Default].messages[key]
+	if !ok {
+		log.Error().Msgf("⚠️ Message %q is missing from the catalog", key)
+	}
+
+	return msg, ok
+}
+
+// Returns a message, with its placeholders substituted
+func (loc *Localizer) Text(key string, args Args) string {
+	msg, ok := loc.lookup(key)
+	if !ok {
+		return key
+	}
+
+	return substitute(msg.Text, args)
+}
+
+// Returns the plural form of a message for a count, with {n} set to the count
+func (loc *Localizer) Plural(key string, n int, args Args) string {
+	msg, ok := loc.lookup(key)
+	if !ok {
+		return key
+	}
+
+	form, ok := msg.Forms[loc.plural(n)]
+	if !ok {
+		form = msg.Forms["other"]
+	}
+
+	withCount := Args{"n": n}
+	for name, value := range args {
+		withCount[name] = value
+	}
+
+	return substitute(form, withCount)
+}
+
+// Describes a time relative to now, e.g. "in 3 hours" or "5 minutes ago"
+func (loc *Localizer) RelativeTime(t time.Time) string {
+	delta := time.Until(t)
+
+	future := delta > 0
+	if !future {
+		delta = -delta
+	}
+
+	units := []struct {
+		key    string
+		length time.Duration
+	}{
+		{"time.years", 365 * 24 * time.Hour},
+		{"time.months", 30 * 24 * time.Hour},
+		{"time.weeks", 7 * 24 * time.Hour},
+		{"time.days", 24 * time.Hour},
+		{"time.hours", time.Hour},
+		{"time.minutes", time.Minute},
+	}
+
+	for _, unit := range units {
+		if delta < unit.length {
+			continue
+		}
+
+		duration := loc.Plural(unit.key, int(delta/unit.length), nil)
+		if future {
+			return loc.Text("time.future", Args{"duration": duration})
+		}
+
+		return loc.Text("time.past", Args{"duration": duration})
+	}
+
+	return loc.Text("time.now", nil)
+}
+
+// Replaces the {name} placeholders in text
+func substitute(text string, args Args) string {
+	if len(args) == 0 {
+		return text
+	}
+
+	pairs := make([]string, 0, 2*len(args))
+	for name, value := range args {
+		pairs = append(pairs, "{"+name+"}", fmt.Sprint(value))
+	}
+
+	return strings.NewReplacer(pairs...).Replace(text)
+}
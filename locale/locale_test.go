@@ -0,0 +1,87 @@
+package locale
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var placeholder = regexp.MustCompile(`\{[a-z]+\}`)
+
+// Returns the sorted placeholders used in a text
+func placeholders(text string) []string {
+	found := placeholder.FindAllString(text, -1)
+	sort.Strings(found)
+	return found
+}
+
+func TestEveryKeyInEveryLocale(t *testing.T) {
+	reference := catalog[Default]
+
+	for _, language := range Languages() {
+		localizer := catalog[language]
+
+		for key, msg := range reference.messages {
+			translated, ok := localizer.messages[key]
+			if !ok {
+				t.Errorf("%s: missing message %q", language, key)
+				continue
+			}
+
+			if (msg.Forms == nil) != (translated.Forms == nil) {
+				t.Errorf("%s: message %q must be plural if and only if it is plural in %s", language, key, Default)
+				continue
+			}
+
+			if msg.Forms == nil {
+				if got, want := placeholders(translated.Text), placeholders(msg.Text); strings.Join(got, "") != strings.Join(want, "") {
+					t.Errorf("%s: message %q has placeholders %v, expected %v", language, key, got, want)
+				}
+				continue
+			}
+
+			// Every plural category the language uses needs a form
+			for _, n := range []int{0, 1, 2, 5, 11, 21, 101} {
+				if _, ok := translated.Forms[localizer.plural(n)]; !ok {
+					t.Errorf("%s: message %q is missing the %q form", language, key, localizer.plural(n))
+				}
+			}
+		}
+
+		for key := range localizer.messages {
+			if _, ok := reference.messages[key]; !ok {
+				t.Errorf("%s: message %q is not in %s", language, key, Default)
+			}
+		}
+	}
+}
+
+func TestLocaleSelection(t *testing.T) {
+	for code, expected := range map[string]string{"de": "de", "de-AT": "de", "en-US": "en", "": "en", "xx": "en"} {
+		if got := For(code).Language; got != expected {
+			t.Errorf("Expected language code %q to pick %s, got %s", code, expected, got)
+		}
+	}
+}
+
+func TestPluralsAndRelativeTime(t *testing.T) {
+	en, de := For("en"), For("de")
+
+	if got := en.Plural("help.conversions", 1, nil); got != "1 conversion" {
+		t.Errorf("Unexpected singular: %q", got)
+	}
+
+	if got := de.Plural("help.conversions", 3, nil); got != "3 Konvertierungen" {
+		t.Errorf("Unexpected plural: %q", got)
+	}
+
+	if got := en.RelativeTime(time.Now().Add(3*time.Hour + time.Minute)); got != "in 3 hours" {
+		t.Errorf("Unexpected relative time: %q", got)
+	}
+
+	if got := de.RelativeTime(time.Now().Add(-2*24*time.Hour - time.Minute)); got != "vor 2 Tagen" {
+		t.Errorf("Unexpected relative time: %q", got)
+	}
+}
@@ -0,0 +1,280 @@
+package prefs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/storage"
+
+	"github.com/rs/zerolog/log"
+	tb "gopkg.in/telebot.v3"
+)
+
+// Output formats
+const (
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+// Strategies for fitting an image into the target dimensions
+const (
+	FitScale = "scale" // Scale to the target size, distorting in emoji mode
+	FitPad   = "pad"   // Scale to fit inside a square, pad the rest
+	FitCrop  = "crop"  // Scale to fill a square, crop the rest
+)
+
+// Per-user preferences, persisted across restarts. Zero values are the defaults.
+type Preferences struct {
+	InEmojiMode   bool   // Defaults to false, i.e. sticker mode
+	Format        string // Output format, defaults to FormatPNG
+	Fit           string // Fitting strategy, defaults to FitScale
+	HideWarnings  bool   // Don't add quality warnings to captions
+	ShortCaptions bool   // Only include the essentials in captions
+	Language      string // Language of messages, empty to follow the Telegram client
+}
+
+// Returns the output format, falling back to the default
+func (prefs Preferences) OutputFormat() string {
+	if prefs.Format == FormatWebP {
+		return FormatWebP
+	}
+
+	return FormatPNG
+}
+
+// Returns the fitting strategy, falling back to the default
+func (prefs Preferences) FitStrategy() string {
+	switch prefs.Fit {
+	case FitPad, FitCrop:
+		return prefs.Fit
+	}
+
+	return FitScale
+}
+
+// Returns the localizer for the user's language, falling back to the language of their Telegram client
+func (prefs Preferences) Locale(languageCode string) *locale.Localizer {
+	if prefs.Language != "" && locale.Has(prefs.Language) {
+		return locale.For(prefs.Language)
+	}
+
+	return locale.For(languageCode)
+}
+
+// Preferences kept in memory: the rest are read back from disk when needed
+const maxLoaded = 10000
+
+// A user's loaded preferences, as stored in the recency list
+type loaded struct {
+	id    int64       // User the preferences belong to
+	prefs Preferences // The user's preferences
+}
+
+// A lock serializing disk access to a user's preference file
+type userLock struct {
+	mutex   sync.Mutex // Held while reading or writing the file
+	holders int        // Goroutines holding or waiting for the lock
+}
+
+// Store of per-user preferences. Preferences are loaded from disk lazily on first access, and
+// written through to disk whenever they change. Disk access is serialized per user, outside of
+// the store's mutex, so looking up preferences never waits for another user's file. Only the
+// most recently used preferences are kept in memory.
+type Store struct {
+	path     string                  // Folder the preferences are stored in, one file per user
+	capacity int                     // Preferences kept in memory
+	users    map[int64]*list.Element // Elements of the recency list, by user
+	recency  *list.List              // Loaded preferences, most recently used first
+	locks    map[int64]*userLock     // Locks of the users whose files are being read or written
+	mutex    sync.Mutex              // Mutex to avoid concurrent map writes
+}
+
+// Creates a preference store backed by the given folder
+func NewStore(path string) *Store {
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		log.Error().Err(err).Msgf("Creating preference folder %s failed", path)
+	}
+
+	return &Store{
+		path:     path,
+		capacity: maxLoaded,
+		users:    make(map[int64]*list.Element),
+		recency:  list.New(),
+		locks:    make(map[int64]*userLock),
+	}
+}
+
+// Path of a user's preference file
+func (store *Store) userPath(id int64) string {
+	return filepath.Join(store.path, fmt.Sprintf("%d.json", id))
+}
+
+// Takes the lock of a user's preference file
+func (store *Store) lockUser(id int64) {
+	store.mutex.Lock()
+	lock, ok := store.locks[id]
+	if !ok {
+		lock = &userLock{}
+		store.locks[id] = lock
+	}
+
+	lock.holders++
+	store.mutex.Unlock()
+
+	lock.mutex.Lock()
+}
+
+// Releases the lock of a user's preference file, dropping it once nobody holds or waits for it
+func (store *Store) unlockUser(id int64) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	lock := store.locks[id]
+	lock.mutex.Unlock()
+
+	lock.holders--
+	if lock.holders == 0 {
+		delete(store.locks, id)
+	}
+}
+
+// Returns a user's preferences if they are loaded, marking them as recently used. Mutex must be held.
+func (store *Store) lookup(id int64) (*Preferences, bool) {
+	element, ok := store.users[id]
+	if !ok {
+		return nil, false
+	}
+
+	store.recency.MoveToFront(element)
+	return &element.Value.(*loaded).prefs, true
+}
+
+// Keeps a user's preferences in memory, evicting the least recently used ones over the capacity.
+// Preferences whose file is being read or written are kept, so they can't be read back stale.
+// Mutex must be held.
+func (store *Store) insert(id int64, prefs Preferences) *Preferences {
+	element := store.recency.PushFront(&loaded{id: id, prefs: prefs})
+	store.users[id] = element
+
+	for oldest := store.recency.Back(); oldest != nil && store.recency.Len() > store.capacity; {
+		previous := oldest.Prev()
+
+		if user := oldest.Value.(*loaded).id; store.locks[user] == nil {
+			store.recency.Remove(oldest)
+			delete(store.users, user)
+		}
+
+		oldest = previous
+	}
+
+	return &element.Value.(*loaded).prefs
+}
+
+// Returns a user's preferences, reading them from disk if they aren't loaded. The user's lock must
+// be held, and the store's mutex must not be: the returned preferences may only be used with it held.
+func (store *Store) load(id int64) *Preferences {
+	store.mutex.Lock()
+	if prefs, ok := store.lookup(id); ok {
+		store.mutex.Unlock()
+		return prefs
+	}
+	store.mutex.Unlock()
+
+	prefs := Preferences{}
+	err := storage.ReadJSON(store.userPath(id), &prefs)
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		// Fall back to defaults, the file gets rewritten on the next change
+		log.Error().Err(err).Msgf("Loading preferences for %d failed", id)
+		prefs = Preferences{}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.insert(id, prefs)
+}
+
+// Returns a copy of a user's preferences
+func (store *Store) Get(id int64) Preferences {
+	store.mutex.Lock()
+	if prefs, ok := store.lookup(id); ok {
+		copied := *prefs
+		store.mutex.Unlock()
+
+		return copied
+	}
+	store.mutex.Unlock()
+
+	store.lockUser(id)
+	defer store.unlockUser(id)
+
+	prefs := store.load(id)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return *prefs
+}
+
+// Modifies a user's preferences and writes them to disk. Returns the updated preferences.
+func (store *Store) Update(id int64, modify func(prefs *Preferences)) (Preferences, error) {
+	// Held until written, so the user's updates reach the disk in order
+	store.lockUser(id)
+	defer store.unlockUser(id)
+
+	prefs := store.load(id)
+
+	store.mutex.Lock()
+	modify(prefs)
+	updated := *prefs
+	store.mutex.Unlock()
+
+	return updated, storage.WriteJSON(store.userPath(id), updated)
+}
+
+// Get the current conversion mode the user is in
+func (store *Store) GetConversionMode(id int64) bool {
+	return store.Get(id).InEmojiMode
+}
+
+// Toggle the conversion mode the user is in. The language code of the user's
+// Telegram client is used for the messages, unless they have chosen a language.
+func (store *Store) ToggleConversionMode(id int64, languageCode string) (bool, string, string, tb.SendOptions) {
+	prefs, err := store.Update(id, func(prefs *Preferences) {
+		prefs.InEmojiMode = !prefs.InEmojiMode
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msgf("Saving conversion mode for %d failed", id)
+	}
+
+	// Callback string based on new mode
+	loc := prefs.Locale(languageCode)
+
+	var cb_string, confirmation, btnText string
+	if prefs.InEmojiMode {
+		cb_string = loc.Text("mode.emoji", nil)
+		confirmation = loc.Text("mode.now_emoji", nil)
+		btnText = loc.Text("mode.switch_to_sticker", nil)
+	} else {
+		cb_string = loc.Text("mode.sticker", nil)
+		confirmation = loc.Text("mode.now_sticker", nil)
+		btnText = loc.Text("mode.switch_to_emoji", nil)
+	}
+
+	// New send-options for the confirmation message
+	sopts := tb.SendOptions{
+		ParseMode: "Markdown",
+		ReplyMarkup: &tb.ReplyMarkup{
+			InlineKeyboard: [][]tb.InlineButton{{tb.InlineButton{Text: btnText, Data: "mode/switch"}}},
+		},
+	}
+
+	return prefs.InEmojiMode, cb_string, confirmation, sopts
+}
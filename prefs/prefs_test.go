@@ -0,0 +1,79 @@
+package prefs
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPreferencesPersist(t *testing.T) {
+	path := t.TempDir()
+	store := NewStore(path)
+
+	if store.GetConversionMode(1) {
+		t.Errorf("Expected new users to default to sticker mode")
+	}
+
+	if inEmojiMode, _, _, _ := store.ToggleConversionMode(1, "en"); !inEmojiMode {
+		t.Errorf("Expected toggle to switch to emoji mode")
+	}
+
+	// A fresh store reads the preferences back from disk
+	reloaded := NewStore(path)
+	if !reloaded.GetConversionMode(1) {
+		t.Errorf("Expected emoji mode to persist across stores")
+	}
+
+	if reloaded.GetConversionMode(2) {
+		t.Errorf("Expected other users to be unaffected")
+	}
+}
+
+func TestLoadedPreferencesAreBounded(t *testing.T) {
+	store := NewStore(t.TempDir())
+	store.capacity = 2
+
+	for id := int64(1); id <= 3; id++ {
+		if _, err := store.Update(id, func(prefs *Preferences) { prefs.Format = FormatWebP }); err != nil {
+			t.Fatalf("Saving preferences failed: %s", err)
+		}
+	}
+
+	if len(store.users) != 2 || store.recency.Len() != 2 {
+		t.Errorf("Expected 2 loaded users, got %d", len(store.users))
+	}
+
+	// The least recently used user was evicted, and is read back from disk
+	if _, loaded := store.users[1]; loaded {
+		t.Errorf("Expected the least recently used user to be evicted")
+	}
+
+	if store.Get(1).Format != FormatWebP {
+		t.Errorf("Expected evicted preferences to be read back from disk")
+	}
+
+	if len(store.locks) != 0 {
+		t.Errorf("Expected no locks to be left over, got %d", len(store.locks))
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	path := t.TempDir()
+	store := NewStore(path)
+
+	// Every toggle is written in order, so an even number of them ends where it started
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.ToggleConversionMode(1, "en")
+			store.Get(1)
+		}()
+	}
+
+	wg.Wait()
+
+	if store.GetConversionMode(1) || NewStore(path).GetConversionMode(1) {
+		t.Errorf("Expected 20 toggles to end in sticker mode, in memory and on disk")
+	}
+}
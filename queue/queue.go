@@ -2,6 +2,8 @@ package queue
 
 import (
 	"sync"
+	"sync/atomic"
+	"tg-resize-sticker-images/analytics"
 
 	"golang.org/x/time/rate"
 	tb "gopkg.in/telebot.v3"
@@ -9,10 +11,22 @@ import (
 
 // A message that is created for SendQueue
 type Message struct {
-	Recipient *tb.User       // Recipient of the message
-	Bytes     *[]byte        // Photo, as a byte array
-	Caption   string         // Caption for the photo
-	Sopts     tb.SendOptions // Send options
+	Recipient *tb.User                          // Recipient of the message
+	Bytes     *[]byte                           // Photo, as a byte array
+	FileType  string                            // File extension of the photo, defaults to png
+	Media     tb.Sendable                       // Media sent by reference (e.g. a file ID) instead of bytes
+	Caption   string                            // Caption for the photo
+	Sopts     tb.SendOptions                    // Send options
+	Callback  func(sent *tb.Message, err error) // Called with the outcome once sent, if set
+	Details   *analytics.Conversion             // Details of the conversion the photo is the result of, if any
+	Broadcast bool                              // Part of a broadcast, which expects recipients that blocked the bot
+}
+
+// Reports the outcome of sending the message to its callback, if any
+func (message *Message) Done(sent *tb.Message, err error) {
+	if message.Callback != nil {
+		message.Callback(sent, err)
+	}
 }
 
 // Enforces a rate-limiter to stay within Telegram's send-rate boundaries
@@ -20,11 +34,37 @@ type SendQueue struct {
 	MessageQueue []Message     // Queue of messages to send
 	Limiter      *rate.Limiter // Rate-limiter
 	Mutex        sync.Mutex    // Mutex to avoid concurrent writes
+	backlog      atomic.Int64  // Messages added, but not sent yet
+	peak         atomic.Int64  // Largest backlog since the peak was last taken
 }
 
 // Adds a message to the send-queue
 func (queue *SendQueue) AddToQueue(message *Message) {
 	queue.Mutex.Lock()
 	queue.MessageQueue = append(queue.MessageQueue, *message)
+
+	if backlog := queue.backlog.Add(1); backlog > queue.peak.Load() {
+		queue.peak.Store(backlog)
+	}
+
 	queue.Mutex.Unlock()
 }
+
+// Marks a message as sent, or dropped after failing to send
+func (queue *SendQueue) MarkSent() {
+	queue.backlog.Add(-1)
+}
+
+// Returns the amount of messages waiting to be sent. Unlike reading MessageQueue,
+// this doesn't wait for the sender to finish its batch.
+func (queue *SendQueue) Backlog() int64 {
+	return queue.backlog.Load()
+}
+
+// Returns the largest backlog since the last call, and starts tracking a new peak
+func (queue *SendQueue) TakePeak() int64 {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+
+	return queue.peak.Swap(queue.backlog.Load())
+}
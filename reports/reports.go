@@ -0,0 +1,280 @@
+package reports
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"tg-resize-sticker-images/storage"
+
+	"github.com/dustin/go-humanize"
+	"github.com/go-co-op/gocron"
+	"github.com/rs/zerolog/log"
+)
+
+// Period a report covers
+type Period int
+
+const (
+	Daily  Period = iota // Reports sent every day
+	Weekly               // Reports sent once a week
+)
+
+// Returns the name of the period, e.g. "daily"
+func (period Period) String() string {
+	if period == Weekly {
+		return "weekly"
+	}
+
+	return "daily"
+}
+
+// Activity during a period
+type Counters struct {
+	Conversions    int64            // Images converted
+	NewUsers       int64            // Users that converted an image for the first time
+	ReturningUsers int64            // Users seen before that converted an image
+	RateLimited    int64            // Users that hit a rate-limit
+	PeakQueue      int64            // Most messages waiting in the send queue at once
+	Errors         map[string]int64 // Errors by kind, e.g. "download"
+}
+
+// Activity during the current period, tracking users so they are only counted once
+type tracker struct {
+	Since       int64            // Unix timestamp the period started at
+	Conversions int64            // Images converted
+	Users       map[int64]bool   // Users that converted an image, and whether they were new
+	RateLimited map[int64]bool   // Users that hit a rate-limit
+	PeakQueue   int64            // Most messages waiting in the send queue at once
+	Errors      map[string]int64 // Errors by kind
+}
+
+// Starts tracking a period
+func newTracker(since time.Time) tracker {
+	return tracker{
+		Since:       since.Unix(),
+		Users:       make(map[int64]bool),
+		RateLimited: make(map[int64]bool),
+		Errors:      make(map[string]int64),
+	}
+}
+
+// Sums up the period's activity
+func (tracker *tracker) counters() Counters {
+	counters := Counters{
+		Conversions: tracker.Conversions,
+		RateLimited: int64(len(tracker.RateLimited)),
+		PeakQueue:   tracker.PeakQueue,
+		Errors:      make(map[string]int64, len(tracker.Errors)),
+	}
+
+	for _, isNew := range tracker.Users {
+		if isNew {
+			counters.NewUsers++
+		} else {
+			counters.ReturningUsers++
+		}
+	}
+
+	for kind, n := range tracker.Errors {
+		counters.Errors[kind] = n
+	}
+
+	return counters
+}
+
+// State of the collector, persisted so that a restart doesn't lose a period's activity
+type collectorState struct {
+	Periods  [2]tracker   // Activity during the current day and week
+	Previous [2]*Counters // Activity during the previous day and week, if reported
+}
+
+// Collects activity for the daily and weekly reports, and schedules them
+type Collector struct {
+	path      string            // Path of the persisted state
+	state     collectorState    // Activity during the current and previous periods
+	settings  Settings          // Schedule of the reports
+	location  *time.Location    // Timezone of the schedule, used for the reports' times
+	scheduler *gocron.Scheduler // Runs the reports, in the configured timezone
+	send      func(Period)      // Sends a report, called by the scheduler
+	mutex     sync.Mutex        // Mutex to avoid concurrent writes
+}
+
+// Creates a collector, restoring the activity of the current periods from path
+func NewCollector(path string) *Collector {
+	collector := &Collector{path: path, location: time.UTC}
+
+	err := storage.ReadJSON(path, &collector.state)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error().Err(err).Msg("⚠️ Restoring report counters failed, starting from scratch")
+		collector.state = collectorState{}
+	}
+
+	// Start periods that were never started, or restored from a file missing fields
+	for i := range collector.state.Periods {
+		tracker := &collector.state.Periods[i]
+
+		if tracker.Since == 0 {
+			*tracker = newTracker(time.Now())
+		}
+
+		if tracker.Users == nil || tracker.RateLimited == nil || tracker.Errors == nil {
+			restored := newTracker(time.Unix(tracker.Since, 0))
+			restored.Conversions, restored.PeakQueue = tracker.Conversions, tracker.PeakQueue
+			*tracker = restored
+		}
+	}
+
+	return collector
+}
+
+// Writes the activity of the current periods to disk
+func (collector *Collector) Save() error {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	return storage.WriteJSON(collector.path, collector.state)
+}
+
+// Runs fn on the tracker of every period
+func (collector *Collector) each(fn func(tracker *tracker)) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	for i := range collector.state.Periods {
+		fn(&collector.state.Periods[i])
+	}
+}
+
+// Records a conversion by a user. isNew tells if the user was never seen before.
+func (collector *Collector) AddConversion(user int64, isNew bool) {
+	collector.each(func(tracker *tracker) {
+		tracker.Conversions++
+
+		// A user that was new during the period stays new
+		tracker.Users[user] = tracker.Users[user] || isNew
+	})
+}
+
+// Records a user hitting a rate-limit
+func (collector *Collector) AddRateLimited(user int64) {
+	collector.each(func(tracker *tracker) {
+		tracker.RateLimited[user] = true
+	})
+}
+
+// Records an error of the given kind, e.g. "download"
+func (collector *Collector) AddError(kind string) {
+	collector.each(func(tracker *tracker) {
+		tracker.Errors[kind]++
+	})
+}
+
+// Records the amount of messages waiting in the send queue
+func (collector *Collector) ObserveQueue(backlog int64) {
+	collector.each(func(tracker *tracker) {
+		if backlog > tracker.PeakQueue {
+			tracker.PeakQueue = backlog
+		}
+	})
+}
+
+// Ends the current period, returning its report, and starts the next one
+func (collector *Collector) Close(period Period, now time.Time) Report {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	tracker := &collector.state.Periods[period]
+	report := Report{
+		Period:   period,
+		From:     time.Unix(tracker.Since, 0).In(collector.location),
+		To:       now.In(collector.location),
+		Current:  tracker.counters(),
+		Previous: collector.state.Previous[period],
+	}
+
+	collector.state.Previous[period] = &report.Current
+	*tracker = newTracker(now)
+
+	return report
+}
+
+// Digest of the activity during a period
+type Report struct {
+	Period   Period    // Period the report covers
+	From     time.Time // Start of the period
+	To       time.Time // End of the period
+	Current  Counters  // Activity during the period
+	Previous *Counters // Activity during the previous period, if it was reported
+}
+
+// Formats a count, with its change from the previous period if known
+func withDelta(current int64, previous *Counters, get func(Counters) int64) string {
+	text := humanize.Comma(current)
+	if previous == nil {
+		return text
+	}
+
+	delta := current - get(*previous)
+	if delta >= 0 {
+		return fmt.Sprintf("%s (+%s)", text, humanize.Comma(delta))
+	}
+
+	return fmt.Sprintf("%s (%s)", text, humanize.Comma(delta))
+}
+
+// Sums up errors of all kinds
+func totalErrors(counters Counters) int64 {
+	total := int64(0)
+	for _, n := range counters.Errors {
+		total += n
+	}
+
+	return total
+}
+
+// Formats the report as a Markdown message
+func (report Report) String() string {
+	current, previous := report.Current, report.Previous
+
+	title := "📬 *Daily report*"
+	if report.Period == Weekly {
+		title = "📬 *Weekly report*"
+	}
+
+	msg := title + "\n" +
+		fmt.Sprintf("_%s – %s_\n\n", report.From.Format("2006-01-02 15:04"), report.To.Format("2006-01-02 15:04 MST")) +
+		fmt.Sprintf("Images converted: %s\n", withDelta(current.Conversions, previous, func(c Counters) int64 { return c.Conversions })) +
+		fmt.Sprintf("New users: %s\n", withDelta(current.NewUsers, previous, func(c Counters) int64 { return c.NewUsers })) +
+		fmt.Sprintf("Returning users: %s\n", withDelta(current.ReturningUsers, previous, func(c Counters) int64 { return c.ReturningUsers })) +
+		fmt.Sprintf("Rate-limited users: %s\n", withDelta(current.RateLimited, previous, func(c Counters) int64 { return c.RateLimited })) +
+		fmt.Sprintf("Peak queue depth: %s\n", withDelta(current.PeakQueue, previous, func(c Counters) int64 { return c.PeakQueue })) +
+		fmt.Sprintf("Errors: %s", withDelta(totalErrors(current), previous, totalErrors))
+
+	// Break errors down by kind, most frequent first
+	kinds := make([]string, 0, len(current.Errors))
+	for kind := range current.Errors {
+		kinds = append(kinds, kind)
+	}
+
+	sort.Slice(kinds, func(i, j int) bool {
+		if current.Errors[kinds[i]] != current.Errors[kinds[j]] {
+			return current.Errors[kinds[i]] > current.Errors[kinds[j]]
+		}
+
+		return kinds[i] < kinds[j]
+	})
+
+	for _, kind := range kinds {
+		msg += fmt.Sprintf("\n  %s: %s", kind, humanize.Comma(current.Errors[kind]))
+	}
+
+	if previous == nil {
+		msg += "\n\n_No previous report to compare with_"
+	}
+
+	return msg
+}
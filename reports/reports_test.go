@@ -0,0 +1,85 @@
+package reports
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	collector := NewCollector(filepath.Join(t.TempDir(), "reports.json"))
+
+	collector.AddConversion(1, true)
+	collector.AddConversion(1, false)
+	collector.AddConversion(2, false)
+	collector.AddRateLimited(3)
+	collector.AddRateLimited(3)
+	collector.AddError("download")
+	collector.ObserveQueue(7)
+	collector.ObserveQueue(4)
+
+	report := collector.Close(Daily, time.Now())
+	current := report.Current
+
+	if current.Conversions != 3 || current.NewUsers != 1 || current.ReturningUsers != 1 {
+		t.Errorf("Expected 3 conversions by 1 new and 1 returning user, got %+v", current)
+	}
+
+	if current.RateLimited != 1 || current.PeakQueue != 7 || current.Errors["download"] != 1 {
+		t.Errorf("Expected 1 rate-limited user, a peak of 7 and 1 error, got %+v", current)
+	}
+
+	if report.Previous != nil {
+		t.Errorf("Expected no previous period for the first report")
+	}
+
+	// The weekly period is unaffected by the daily report
+	collector.AddConversion(2, false)
+
+	if daily := collector.Close(Daily, time.Now()); daily.Current.Conversions != 1 || daily.Previous.Conversions != 3 {
+		t.Errorf("Expected 1 conversion after 3 the previous day, got %+v", daily)
+	} else if !strings.Contains(daily.String(), "Images converted: 1 (-2)") {
+		t.Errorf("Expected the report to include the change in conversions, got %q", daily.String())
+	}
+
+	if weekly := collector.Close(Weekly, time.Now()); weekly.Current.Conversions != 4 {
+		t.Errorf("Expected 4 conversions during the week, got %d", weekly.Current.Conversions)
+	}
+}
+
+func TestCountersSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.json")
+
+	collector := NewCollector(path)
+	collector.AddConversion(1, true)
+
+	if err := collector.Save(); err != nil {
+		t.Fatalf("Error saving report counters: %s", err)
+	}
+
+	restored := NewCollector(path)
+	restored.AddConversion(1, false)
+
+	if report := restored.Close(Weekly, time.Now()); report.Current.Conversions != 2 || report.Current.NewUsers != 1 {
+		t.Errorf("Expected 2 conversions by 1 new user to be restored, got %+v", report.Current)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	if err := DefaultSettings().Validate(); err != nil {
+		t.Errorf("Expected the default settings to be valid, got %s", err)
+	}
+
+	invalid := []Settings{
+		{Time: "9am", Timezone: "UTC", Weekday: "Monday"},
+		{Time: "09:00", Timezone: "Mars/Olympus_Mons", Weekday: "Monday"},
+		{Time: "09:00", Timezone: "UTC", Weekday: "Caturday"},
+	}
+
+	for _, settings := range invalid {
+		if err := settings.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", settings)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package reports
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Embed the timezone database, in case the host has none
+	_ "time/tzdata"
+
+	"github.com/go-co-op/gocron"
+	"github.com/rs/zerolog/log"
+)
+
+// When the daily and weekly reports are sent to admins
+type Settings struct {
+	Enabled  bool   // Are reports sent?
+	Time     string // Time of day the reports are sent at, e.g. "09:00"
+	Timezone string // IANA timezone of Time, e.g. "Europe/Helsinki"
+	Weekday  string // Day the weekly report is sent on, e.g. "Monday"
+}
+
+// The schedule a config starts out with
+func DefaultSettings() Settings {
+	return Settings{
+		Enabled:  true,
+		Time:     "09:00",
+		Timezone: "UTC",
+		Weekday:  "Monday",
+	}
+}
+
+// Parses the timezone and the weekday of the settings
+func (settings Settings) parse() (*time.Location, time.Weekday, error) {
+	if _, err := time.Parse("15:04", settings.Time); err != nil {
+		return nil, 0, fmt.Errorf("time %q is not of the form HH:MM", settings.Time)
+	}
+
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unknown timezone %q", settings.Timezone)
+	}
+
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(settings.Weekday, day.String()) {
+			return location, day, nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("unknown weekday %q", settings.Weekday)
+}
+
+// Checks that the settings can be scheduled
+func (settings Settings) Validate() error {
+	_, _, err := settings.parse()
+	return err
+}
+
+// Sets the function sending reports, called by the scheduler
+func (collector *Collector) SetSender(send func(Period)) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.send = send
+}
+
+// Runs the sender for a period, if one is set
+func (collector *Collector) sendReport(period Period) {
+	collector.mutex.Lock()
+	send := collector.send
+	collector.mutex.Unlock()
+
+	if send != nil {
+		send(period)
+	}
+}
+
+// Schedules the reports, replacing the previous schedule. Does nothing if the
+// schedule is unchanged.
+func (collector *Collector) Schedule(settings Settings) error {
+	location, weekday, err := settings.parse()
+	if err != nil {
+		return err
+	}
+
+	collector.mutex.Lock()
+	if settings == collector.settings {
+		collector.mutex.Unlock()
+		return nil
+	}
+
+	previous := collector.scheduler
+	collector.scheduler = nil
+	collector.settings = settings
+	collector.location = location
+	collector.mutex.Unlock()
+
+	// Stop without holding the mutex, as a running report needs it
+	if previous != nil {
+		previous.Stop()
+	}
+
+	if !settings.Enabled {
+		log.Info().Msg("📬 Reports are disabled")
+		return nil
+	}
+
+	scheduler := gocron.NewScheduler(location)
+
+	_, err = scheduler.Every(1).Day().At(settings.Time).Do(collector.sendReport, Daily)
+	if err != nil {
+		return fmt.Errorf("scheduling daily report: %w", err)
+	}
+
+	_, err = scheduler.Every(1).Week().Weekday(weekday).At(settings.Time).Do(collector.sendReport, Weekly)
+	if err != nil {
+		return fmt.Errorf("scheduling weekly report: %w", err)
+	}
+
+	scheduler.StartAsync()
+
+	collector.mutex.Lock()
+	collector.scheduler = scheduler
+	collector.mutex.Unlock()
+
+	log.Info().Msgf("📬 Reports scheduled daily at %s, and weekly on %s (%s)", settings.Time, weekday, location)
+	return nil
+}
@@ -13,11 +13,20 @@ import (
 	"syscall"
 	"time"
 
+	"tg-resize-sticker-images/admission"
+	"tg-resize-sticker-images/alerts"
 	"tg-resize-sticker-images/bots"
+	"tg-resize-sticker-images/broadcast"
+	"tg-resize-sticker-images/cache"
 	"tg-resize-sticker-images/config"
 	"tg-resize-sticker-images/daily"
+	"tg-resize-sticker-images/history"
+	"tg-resize-sticker-images/prefs"
 	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/reports"
+	"tg-resize-sticker-images/resize"
 	"tg-resize-sticker-images/spam"
+	"tg-resize-sticker-images/templates"
 
 	"github.com/go-co-op/gocron"
 	"github.com/h2non/bimg"
@@ -32,9 +41,9 @@ import (
 // Variables injected at build-time
 var GitSHA = "0000000"
 
-func setupSignalHandler(session *config.Session) {
+func setupSignalHandler(session *config.Session, configFlags *config.Flags, spamStatePath string, templatesPath string) {
 	// Listens for incoming interrupt signals, dumps config if detected
-	channel := make(chan os.Signal)
+	channel := make(chan os.Signal, 1)
 	signal.Notify(channel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
 	go func() {
@@ -42,14 +51,45 @@ func setupSignalHandler(session *config.Session) {
 		// Log shutdown
 		log.Info().Msg("🚦 Received interrupt signal: dumping config...")
 
-		// Dump config, close bot connection
+		// Dump config and broadcast progress, close bot connection
 		config.DumpConfig(session.Config)
+		session.Broadcast.Save()
+
+		if err := session.History.Save(); err != nil {
+			log.Error().Err(err).Msg("⚠️ Saving statistics history failed")
+		}
+
+		if err := session.Reports.Save(); err != nil {
+			log.Error().Err(err).Msg("⚠️ Saving report counters failed")
+		}
+
+		if err := session.Spam.SaveState(spamStatePath); err != nil {
+			log.Error().Err(err).Msg("⚠️ Saving anti-spam state failed")
+		}
 		session.Bot.Close()
 
 		// Shutdown bimg, exit
 		bimg.Shutdown()
 		os.Exit(0)
 	}()
+
+	// Listens for SIGHUP, reloads config if detected
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	go func() {
+		for range reload {
+			log.Info().Msg("🔄 Received SIGHUP: reloading config...")
+
+			if err := session.ReloadConfig(configFlags); err != nil {
+				log.Error().Err(err).Msg("⚠️ Reloading config failed, keeping the current config")
+			}
+
+			if err := templates.Load(templatesPath); err != nil {
+				log.Error().Err(err).Msg("⚠️ Reloading message templates failed, keeping the current templates")
+			}
+		}
+	}()
 }
 
 func main() {
@@ -60,14 +100,30 @@ func main() {
 	wd, _ := os.Getwd()
 	logPath := filepath.Join(wd, "logs")
 
-	if _, err := os.Stat(logPath); os.IsNotExist(err) {
-		_ = os.Mkdir(logPath, os.ModePerm)
-	}
-
 	var debug bool
 	flag.BoolVar(&debug, "debug", false, "Specify to show logs in the console")
+	configFlags := config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
+	// If only printing the config, do so without prompting or writing anything, and exit
+	if configFlags.PrintConfig {
+		conf, err := config.PreviewConfig(configFlags)
+		if conf != nil {
+			fmt.Println(conf.Describe())
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config: %s\n", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if _, err := os.Stat(logPath); os.IsNotExist(err) {
+		_ = os.Mkdir(logPath, os.ModePerm)
+	}
+
 	if !debug {
 		// If not debugging, log to file
 		logFilePath := filepath.Join(logPath, "bot-log.log")
@@ -87,22 +143,34 @@ func main() {
 	log.Info().Msgf("🤖 [%s] Bot started with vips version %s", vnum, bimg.VipsVersion)
 
 	// Load (or create) config
-	conf := config.LoadConfig()
+	conf := config.LoadConfig(configFlags)
 
-	// Setup anti-spam
-	Spam := spam.AntiSpam{
-		ChatBannedUntilTimestamp: make(map[int64]int64),
-		ChatConversionLog:        make(map[int64]*spam.ConversionLog),
-		ChatBanned:               make(map[int64]bool),
-		Rules:                    make(map[string]int64),
+	// Set log level from config
+	config.ApplyLogLevel(conf.LogLevel)
+
+	// Load the message templates edited by the operator, refusing to start with broken ones
+	templatesPath := filepath.Join(wd, "config", "templates")
+	if err := templates.Load(templatesPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid message templates in %s:\n%s\n", templatesPath, err)
+		log.Fatal().Err(err).Msgf("Invalid message templates in %s", templatesPath)
 	}
 
-	// Add rules
-	Spam.Rules["ConversionsPerHour"] = conf.ConversionRate
+	// Setup anti-spam
+	Spam := spam.NewAntiSpam()
+
+	// Add rules: conversion limits of each tier, and penalties for repeat offenders
+	Spam.SetTiers(conf.TierSettings())
+	Spam.SetPenalties(conf.Penalties)
+
+	// Restore bans and rate-limits from before the restart
+	spamStatePath := filepath.Join(wd, "config", "anti-spam.json")
+	if err := Spam.LoadState(spamStatePath); err != nil {
+		log.Error().Err(err).Msg("⚠️ Restoring anti-spam state failed")
+	}
 
 	// Create bot
 	bot, err := tb.NewBot(tb.Settings{
-		Token:  conf.Token,
+		Token:  conf.BotToken(),
 		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
 	})
 
@@ -120,31 +188,62 @@ func main() {
 
 	// Setup messageSender
 	sendQueue := queue.SendQueue{
-		Limiter: rate.NewLimiter(20, 2),
+		Limiter: rate.NewLimiter(rate.Limit(conf.SendRate), conf.SendBurst),
 	}
 
 	// Create daily, trailing in-memory statistics
 	daily_stats := daily.NewConversionStatistics()
 
+	// Hourly, daily and monthly statistics, persisted so they survive restarts
+	statsHistory := history.New(filepath.Join(wd, "config", "history.json"))
+
+	// Per-user preferences, persisted next to the config
+	userPrefs := prefs.NewStore(filepath.Join(wd, "config", "preferences"))
+
+	// Broadcasts to all users, with state persisted so they survive restarts
+	broadcaster := broadcast.NewBroadcaster(filepath.Join(wd, "config", "broadcast.json"), bot, &sendQueue)
+
+	// Maintenance mode and load shedding, with maintenance mode persisted across deploys
+	admissions := admission.NewController(filepath.Join(wd, "config", "maintenance.json"), conf.LoadShedding, resize.MemoryInUse)
+
+	// Activity for the daily and weekly reports, persisted so a restart doesn't lose it
+	reportCollector := reports.NewCollector(filepath.Join(wd, "config", "reports.json"))
+
+	// Alerts admins when error rates are too high
+	alertMonitor := alerts.NewMonitor(conf.Alerts)
+
+	// Recent conversions, kept in memory only: Telegram's file IDs outlive a restart, but losing them is cheap
+	conversionCache := cache.New(conf.ConversionCache)
+
 	// Define session: used to throw around structs that are needed frequently
 	session := config.Session{
-		Bot:    bot,
-		Config: conf,
-		Spam:   &Spam,
-		Queue:  &sendQueue,
-		Daily:  daily_stats,
-		Vnum:   vnum,
+		Bot:       bot,
+		Config:    conf,
+		Spam:      Spam,
+		Queue:     &sendQueue,
+		Daily:     daily_stats,
+		History:   statsHistory,
+		Prefs:     userPrefs,
+		Broadcast: broadcaster,
+		Admission: admissions,
+		Reports:   reportCollector,
+		Alerts:    alertMonitor,
+		Cache:     conversionCache,
+		Vnum:      vnum,
 	}
 
 	// Setup signal handler
-	setupSignalHandler(&session)
+	setupSignalHandler(&session, configFlags, spamStatePath, templatesPath)
 
-	// Run MessageSender in a goroutine
-	go bots.MessageSender(&session)
+	// Run MessageSender in a goroutine, until the process exits
+	go bots.MessageSender(&session, nil)
 
 	// Setup bot
 	bots.SetupBot(&session)
 
+	// Continue a broadcast interrupted by a restart
+	session.Broadcast.Resume()
+
 	// Create scheduler
 	scheduler := gocron.NewScheduler(time.UTC)
 
@@ -154,15 +253,56 @@ func main() {
 		log.Fatal().Err(err).Msg("Starting config saver job failed")
 	}
 
+	// Save statistics history every half-hour
+	_, err = scheduler.Every(30).Minutes().Do(func() {
+		if err := statsHistory.Save(); err != nil {
+			log.Error().Err(err).Msg("⚠️ Saving statistics history failed")
+		}
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Starting statistics history saver job failed")
+	}
+
+	// Save report counters every half-hour
+	_, err = scheduler.Every(30).Minutes().Do(func() {
+		if err := reportCollector.Save(); err != nil {
+			log.Error().Err(err).Msg("⚠️ Saving report counters failed")
+		}
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Starting report counter saver job failed")
+	}
+
 	// Clean conversion logs once an hour
-	_, err = scheduler.Every(60).Minutes().Do(spam.CleanConversionLogs, &Spam)
+	_, err = scheduler.Every(60).Minutes().Do(spam.CleanConversionLogs, Spam)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Starting conversion log cleaner job failed")
 	}
 
+	// Notify chats whose rate-limit has ended once a minute
+	_, err = scheduler.Every(1).Minute().Do(bots.NotifyUnbannedChats, &session)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Starting rate-limit notifier job failed")
+	}
+
+	// Snapshot anti-spam state every five minutes
+	_, err = scheduler.Every(5).Minutes().Do(func() {
+		if err := Spam.SaveState(spamStatePath); err != nil {
+			log.Error().Err(err).Msg("⚠️ Saving anti-spam state failed")
+		}
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Starting anti-spam state saver job failed")
+	}
+
 	// Run scheduler
 	scheduler.StartAsync()
 
+	// Send reports to admins, in the configured timezone
+	if err := reportCollector.Schedule(conf.Reports); err != nil {
+		log.Fatal().Err(err).Msg("Scheduling reports failed")
+	}
+
 	// Start Telegram bot instance
 	session.Bot.Start()
 }
@@ -0,0 +1,159 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+// Test images are generated instead of being stored in the repository, so the
+// expected outputs only depend on the dimensions and traits below.
+
+// An opaque image with a diagonal gradient, which compresses well
+func gradient(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(255 * x / width),
+				G: uint8(255 * y / height),
+				B: uint8(255 * (x + y) / (width + height)),
+				A: 255,
+			})
+		}
+	}
+
+	return img
+}
+
+// An opaque image of random pixels, which compresses badly
+func noise(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	random := rand.New(rand.NewSource(int64(width * height)))
+
+	random.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+
+	return img
+}
+
+// A gradient with a transparent border a quarter of the image wide
+func transparent(width int, height int) *image.NRGBA {
+	img := gradient(width, height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/4 || x >= width*3/4 || y < height/4 || y >= height*3/4 {
+				img.SetNRGBA(x, y, color.NRGBA{})
+			}
+		}
+	}
+
+	return img
+}
+
+// Encodes an image as a PNG
+func encodePNG(tb testing.TB, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		tb.Fatalf("Encoding PNG fixture failed: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Encodes an image as a JPEG
+func encodeJPEG(tb testing.TB, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		tb.Fatalf("Encoding JPEG fixture failed: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Encodes a JPEG in the CMYK colourspace. The standard library can't write
+// CMYK JPEGs, so vips converts an sRGB one.
+func encodeCMYK(tb testing.TB, img image.Image) []byte {
+	cmyk, err := bimg.NewImage(encodeJPEG(tb, img)).Process(bimg.Options{
+		Type:           bimg.JPEG,
+		Interpretation: bimg.InterpretationCMYK,
+	})
+
+	if err != nil {
+		tb.Fatalf("Converting fixture to CMYK failed: %s", err)
+	}
+
+	return cmyk
+}
+
+// Encodes an animated GIF of frames gradients, each shifted from the last
+func encodeAnimatedGIF(tb testing.TB, width int, height int, frames int) []byte {
+	animation := &gif.GIF{}
+
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9)
+		source := gradient(width, height)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				frame.Set(x, y, source.At((x+i*width/frames)%width, y))
+			}
+		}
+
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		tb.Fatalf("Encoding GIF fixture failed: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Bytes that start like a PNG, followed by garbage
+func corrupt() []byte {
+	data := []byte("\x89PNG\r\n\x1a\n")
+	random := rand.New(rand.NewSource(1))
+
+	garbage := make([]byte, 1024)
+	random.Read(garbage)
+
+	return append(data, garbage...)
+}
+
+// Appends a PNG chunk to data
+func appendChunk(data []byte, kind string, contents []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(contents)))
+	data = append(data, kind...)
+	data = append(data, contents...)
+
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(append([]byte(kind), contents...)))
+}
+
+// A tiny PNG whose header declares a huge grayscale image: a decompression bomb
+func bomb(width int, height int) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(width))
+	header = binary.BigEndian.AppendUint32(header, uint32(height))
+	header = append(header, 8, 0, 0, 0, 0)
+
+	data := appendChunk([]byte("\x89PNG\r\n\x1a\n"), "IHDR", header)
+	data = appendChunk(data, "IDAT", []byte{0x78, 0x9c, 0x03, 0x00, 0x00, 0x00, 0x00, 0x01})
+
+	return appendChunk(data, "IEND", nil)
+}
@@ -4,7 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"runtime"
+	"tg-resize-sticker-images/analytics"
+	"tg-resize-sticker-images/limits"
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/prefs"
 	"tg-resize-sticker-images/queue"
+	"tg-resize-sticker-images/templates"
 
 	"github.com/h2non/bimg"
 	"github.com/rs/zerolog/log"
@@ -46,8 +52,44 @@ func stickerResizeOptions(options bimg.Options, size bimg.ImageSize) bimg.Option
 	return options
 }
 
-// Resizes an image in a byte buffer using libvips through bimg.
-func ResizeImage(imgBuffer *bytes.Buffer, inEmojiMode bool) (*queue.Message, error) {
+// Resize options for fitting the image into a square: either the image is
+// scaled to fit inside the square and padded, or scaled to fill it and cropped.
+func squareResizeOptions(options bimg.Options, size bimg.ImageSize, side int, fit string, hasAlpha bool) bimg.Options {
+	options.Width = side
+	options.Height = side
+	options.Force = false
+
+	widthFactor := float64(side) / float64(size.Width)
+	heightFactor := float64(side) / float64(size.Height)
+
+	switch fit {
+	case prefs.FitPad:
+		// Pad transparent images with transparency, and opaque ones with white
+		options.Embed = true
+		options.Gravity = bimg.GravityCentre
+
+		if hasAlpha {
+			options.Extend = bimg.ExtendBackground
+		} else {
+			options.Extend = bimg.ExtendWhite
+		}
+
+		// Enlarge if the longer side is shorter than the square
+		options.Enlarge = math.Min(widthFactor, heightFactor) > 1.0
+	case prefs.FitCrop:
+		// Crop the least interesting parts
+		options.Crop = true
+
+		// Enlarge if the shorter side is shorter than the square
+		options.Enlarge = math.Max(widthFactor, heightFactor) > 1.0
+	}
+
+	return options
+}
+
+// Resizes an image in a byte buffer using libvips through bimg. Captions are in the localizer's language.
+// Images over the pixel or frame limits are refused before any pixels are decoded.
+func ResizeImage(imgBuffer *bytes.Buffer, userPrefs prefs.Preferences, loc *locale.Localizer, imageLimits limits.Limits) (*queue.Message, error) {
 	// Build image from buffer
 	image := bimg.NewImage(imgBuffer.Bytes())
 
@@ -59,10 +101,40 @@ func ResizeImage(imgBuffer *bytes.Buffer, inEmojiMode bool) (*queue.Message, err
 		return &queue.Message{
 			Recipient: nil,
 			Bytes:     nil,
-			Caption:   "⚠️ Error reading image! Please send JPG/PNG/WebP images.",
+			Caption:   loc.Text("resize.error_reading", nil),
 		}, err
 	}
 
+	// Refuse decompression bombs: the size is read from the header, without decoding the image
+	if err := imageLimits.CheckPixels(size.Width, size.Height); err != nil {
+		log.Warn().Err(err).Msg("⚠️ Refused image over the pixel limit")
+
+		return &queue.Message{
+			Recipient: nil,
+			Bytes:     nil,
+			Caption: loc.Text("limits.pixels", locale.Args{
+				"megapixels": int64(size.Width) * int64(size.Height) / 1000000,
+				"max":        imageLimits.MaxMegapixels,
+			}),
+		}, err
+	}
+
+	if err := imageLimits.CheckFrames(imgBuffer.Bytes()); err != nil {
+		log.Warn().Err(err).Msg("⚠️ Refused animation over the frame limit")
+
+		return &queue.Message{
+			Recipient: nil,
+			Bytes:     nil,
+			Caption: loc.Text("limits.frames", locale.Args{
+				"frames": limits.Frames(imgBuffer.Bytes()),
+				"max":    imageLimits.MaxFrames,
+			}),
+		}, err
+	}
+
+	// Processing replaces the image's buffer, so read the input format first
+	inputFormat := image.Type()
+
 	// Scaling factor and options for processing
 	options := bimg.Options{
 		Type:          bimg.PNG,          // ImageType(3) == PNG
@@ -71,27 +143,51 @@ func ResizeImage(imgBuffer *bytes.Buffer, inEmojiMode bool) (*queue.Message, err
 		Force:         true,              // Force resize to go through
 	}
 
-	// Set mode based on inEmojiMode
+	format := userPrefs.OutputFormat()
+	if format == prefs.FormatWebP {
+		options.Type = bimg.WEBP
+		options.Quality = 90
+	}
+
+	// Set mode based on the user's preferences
 	mode := "sticker"
-	if inEmojiMode {
+	if userPrefs.InEmojiMode {
 		mode = "emoji"
 	}
 
+	fit := userPrefs.FitStrategy()
+
+	// Padding needs to know whether the image has transparency
+	hasAlpha := false
+	if fit == prefs.FitPad {
+		if metadata, err := image.Metadata(); err == nil {
+			hasAlpha = metadata.Alpha
+		}
+	}
+
 	switch mode {
 	case "sticker":
 		// Resize options for sticker mode
-		options = stickerResizeOptions(options, size)
+		if fit == prefs.FitScale {
+			options = stickerResizeOptions(options, size)
+		} else {
+			options = squareResizeOptions(options, size, 512, fit, hasAlpha)
+		}
 
 	case "emoji":
 		// Resize options for emoji mode
-		options = emojiResizeOptions(options, size)
+		if fit == prefs.FitScale {
+			options = emojiResizeOptions(options, size)
+		} else {
+			options = squareResizeOptions(options, size, 100, fit, hasAlpha)
+		}
 
 	default:
 		// If mode is not 'sticker' or 'emoji', return error
 		return &queue.Message{
 			Recipient: nil,
 			Bytes:     nil,
-			Caption:   fmt.Sprintf("⚠️ Invalid mode '%s'!", mode),
+			Caption:   loc.Text("resize.error_mode", locale.Args{"mode": mode}),
 		}, fmt.Errorf("Invalid mode '%s'!", mode)
 	}
 
@@ -105,13 +201,25 @@ func ResizeImage(imgBuffer *bytes.Buffer, inEmojiMode bool) (*queue.Message, err
 		return &queue.Message{
 			Recipient: nil,
 			Bytes:     nil,
-			Caption:   "⚠️ Error processing image!",
+			Caption:   loc.Text("resize.error_processing", nil),
 		}, err
 	}
 
 	if len(imageBytes)/1024 >= 512 {
-		// Compress image if size is over 512 kibibytes
-		imageBytes, err = pngquant.CompressBytes(imageBytes, "6")
+		if format == prefs.FormatWebP {
+			// Re-encode WebP images at a lower quality
+			for _, quality := range []int{75, 50} {
+				options.Quality = quality
+				imageBytes, err = image.Process(options)
+
+				if err != nil || len(imageBytes)/1024 < 512 {
+					break
+				}
+			}
+		} else {
+			// Compress image if size is over 512 kibibytes
+			imageBytes, err = pngquant.CompressBytes(imageBytes, "6")
+		}
 
 		if err != nil {
 			// If compression process fails, notify user
@@ -120,46 +228,59 @@ func ResizeImage(imgBuffer *bytes.Buffer, inEmojiMode bool) (*queue.Message, err
 			return &queue.Message{
 				Recipient: nil,
 				Bytes:     nil,
-				Caption:   "⚠️ Error during image compression!",
+				Caption:   loc.Text("resize.error_compressing", nil),
 			}, err
 		}
 	}
 
-	// Construct the caption
-	imgCaption := fmt.Sprintf(
-		"🖼 Here's your %s-ready image (%dx%d)! Forward this to @Stickers.",
-		mode, options.Width, options.Height,
-	)
-
-	// Notify user if the image was not compressed enough
+	// Notify user if the image was not compressed enough: the image is unusable, so this is always shown
 	// TODO add a "recompress" method
-	if len(imageBytes)/1024 >= 512 {
+	compressionFailed := len(imageBytes)/1024 >= 512
+	if compressionFailed {
 		log.Warn().Msgf("⚠️ Image compression failed, buffer length %d KB", len(imageBytes)/1024)
-		imgCaption += "\n\n⚠️ Image compression failed (≥512 KB): you must manually compress the image!"
 	}
 
-	inlineBtnText := ""
-	switch mode {
-	case "sticker":
-		// Warn user if image was upscaled
-		if options.Enlarge {
-			imgCaption += "\n\n⚠️ Image upscaled! Quality may have been lost: consider using a larger image."
-		}
+	// Only distorted when scaling a non-square image into a square
+	distorted := mode == "emoji" && fit == prefs.FitScale && size.Width != size.Height
 
-		// User is in sticker mode: add text to inline button
-		inlineBtnText = "Switch to emoji-mode"
-	case "emoji":
-		// Warn user if image was upscaled or distorted
-		if (options.Enlarge) && (size.Width != size.Height) {
-			imgCaption += "\n\n⚠️ Image distorted and upscaled! Consider using a larger, square image."
-		} else if options.Enlarge {
-			imgCaption += "\n\n⚠️ Image upscaled! Quality may have been lost: consider using a larger image."
-		} else if size.Width != size.Height {
-			imgCaption += "\n\n⚠️ Image distorted! Consider using a square image."
-		}
+	// Details for statistics and the caption: the caller knows the media type and latency
+	details := &analytics.Conversion{
+		Mode:              mode,
+		InputFormat:       inputFormat,
+		Width:             options.Width,
+		Height:            options.Height,
+		Upscaled:          options.Enlarge,
+		Distorted:         distorted,
+		CompressionFailed: compressionFailed,
+	}
+
+	// Construct the caption, and the keyboard to switch modes
+	imgCaption, sopts := Reply(loc, userPrefs, *details)
+
+	return &queue.Message{Recipient: nil, Bytes: &imageBytes, FileType: format, Caption: imgCaption, Sopts: sopts, Details: details}, nil
+}
 
-		// User is in emoji mode: add text to inline button
-		inlineBtnText = "Switch to sticker-mode"
+// Builds the caption and mode-switching keyboard sent with a converted image, warning the user if the
+// image was upscaled or distorted. Conversions resent from the cache reuse their original details.
+func Reply(loc *locale.Localizer, userPrefs prefs.Preferences, details analytics.Conversion) (string, tb.SendOptions) {
+	warnings := !userPrefs.HideWarnings
+
+	// Construct the caption
+	caption := templates.CaptionMessage(loc, templates.CaptionData{
+		Mode:              details.Mode,
+		Width:             details.Width,
+		Height:            details.Height,
+		Format:            userPrefs.OutputFormat(),
+		Short:             userPrefs.ShortCaptions,
+		Upscaled:          warnings && details.Upscaled,
+		Distorted:         warnings && details.Distorted,
+		CompressionFailed: details.CompressionFailed,
+	})
+
+	// Add text to inline button for switching to the other mode
+	inlineBtnText := loc.Text("mode.switch_to_emoji", nil)
+	if details.Mode == "emoji" {
+		inlineBtnText = loc.Text("mode.switch_to_sticker", nil)
 	}
 
 	// Add send-options to change mode
@@ -170,5 +291,14 @@ func ResizeImage(imgBuffer *bytes.Buffer, inEmojiMode bool) (*queue.Message, err
 		},
 	}
 
-	return &queue.Message{Recipient: nil, Bytes: &imageBytes, Caption: imgCaption, Sopts: sopts}, nil
+	return caption, sopts
+}
+
+// Returns the memory held by images in bytes: what libvips allocated, plus the Go heap in use, where
+// downloads and converted images are buffered. Both go back down once conversions are done.
+func MemoryInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return uint64(bimg.VipsMemory().Memory) + stats.HeapInuse
 }
@@ -2,73 +2,225 @@ package resize
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"os"
-	"path/filepath"
 	"testing"
 
+	"tg-resize-sticker-images/limits"
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/prefs"
+	"tg-resize-sticker-images/templates"
+
 	"github.com/h2non/bimg"
 )
 
-func TestResizeFunction(t *testing.T) {
-	// Set vips operating parameters, defer shutdown
+func TestMain(m *testing.M) {
+	// Set vips operating parameters, shut vips down once every test has run
 	bimg.VipsCacheSetMax(250)
-	defer bimg.Shutdown()
+	code := m.Run()
+	bimg.Shutdown()
+
+	os.Exit(code)
+}
 
-	// Set default mode to "sticker"
-	mode := false
+// Expected output of converting a fixture
+type goldenCase struct {
+	fixture     string // Name of the fixture converted
+	emoji       bool   // Convert in emoji mode instead of sticker mode?
+	inputFormat string // Format vips detects the fixture as
+	width       int    // Width of the output
+	height      int    // Height of the output
+	upscaled    bool   // Is the image enlarged?
+	distorted   bool   // Is the image's aspect ratio changed?
+	alpha       bool   // Are the fixture's transparent pixels kept?
+}
 
-	// Folder containing large test images
-	folders := []string{
-		"test-images-large/",
+func TestGoldenImages(t *testing.T) {
+	fixtures := map[string][]byte{
+		"tall":        encodePNG(t, gradient(600, 1200)),
+		"wide":        encodePNG(t, gradient(1200, 600)),
+		"square":      encodePNG(t, gradient(800, 800)),
+		"tiny":        encodePNG(t, gradient(32, 16)),
+		"huge":        encodePNG(t, noise(4000, 3000)),
+		"transparent": encodePNG(t, transparent(300, 600)),
+		"cmyk":        encodeCMYK(t, gradient(640, 480)),
+		"animated":    encodeAnimatedGIF(t, 200, 100, 4),
 	}
 
-	for _, imageFolder := range folders {
-		files, err := os.ReadDir(imageFolder)
-		if err != nil {
-			t.Log("Error opening test image dir:", err)
-			t.Fail()
+	cases := []goldenCase{
+		{fixture: "tall", inputFormat: "png", width: 256, height: 512},
+		{fixture: "wide", inputFormat: "png", width: 512, height: 256},
+		{fixture: "square", inputFormat: "png", width: 512, height: 512},
+		{fixture: "tiny", inputFormat: "png", width: 512, height: 256, upscaled: true},
+		{fixture: "huge", inputFormat: "png", width: 512, height: 384},
+		{fixture: "transparent", inputFormat: "png", width: 256, height: 512, alpha: true},
+		{fixture: "cmyk", inputFormat: "jpeg", width: 512, height: 384},
+		{fixture: "animated", inputFormat: "gif", width: 512, height: 256, upscaled: true},
+
+		{fixture: "tall", emoji: true, inputFormat: "png", width: 100, height: 100, distorted: true},
+		{fixture: "square", emoji: true, inputFormat: "png", width: 100, height: 100},
+		{fixture: "tiny", emoji: true, inputFormat: "png", width: 100, height: 100, upscaled: true, distorted: true},
+		{fixture: "huge", emoji: true, inputFormat: "png", width: 100, height: 100, distorted: true},
+		{fixture: "transparent", emoji: true, inputFormat: "png", width: 100, height: 100, distorted: true, alpha: true},
+		{fixture: "animated", emoji: true, inputFormat: "gif", width: 100, height: 100, upscaled: false, distorted: true},
+	}
+
+	loc := locale.For(locale.Default)
+
+	for _, golden := range cases {
+		mode := "sticker"
+		if golden.emoji {
+			mode = "emoji"
 		}
 
-		for _, file := range files {
-			// Skip non-image files
-			if file.Name()[0] == '.' {
-				continue
+		t.Run(mode+"/"+golden.fixture, func(t *testing.T) {
+			msg, err := ResizeImage(bytes.NewBuffer(fixtures[golden.fixture]), prefs.Preferences{InEmojiMode: golden.emoji}, loc, limits.DefaultLimits())
+			if err != nil {
+				t.Fatalf("Resizing failed: %s (caption %q)", err, msg.Caption)
 			}
 
-			// Create path, load image from disk
-			filePath := filepath.Join(imageFolder, file.Name())
-			file, err := os.Open(filePath)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return
+			output := *msg.Bytes
+			img, format, err := image.Decode(bytes.NewReader(output))
+
+			if err != nil || format != "png" {
+				t.Fatalf("Expected a PNG, got format %q (error %v)", format, err)
+			}
+
+			if bounds := img.Bounds(); bounds.Dx() != golden.width || bounds.Dy() != golden.height {
+				t.Errorf("Expected %dx%d, got %dx%d", golden.width, golden.height, bounds.Dx(), bounds.Dy())
 			}
 
-			// Defer closing
-			defer file.Close()
+			if len(output) > 512*1024 {
+				t.Errorf("Expected at most 512 KB, got %d KB", len(output)/1024)
+			}
 
-			// Create buffer
-			var imgBuf bytes.Buffer
-			_, err = imgBuf.ReadFrom(file)
+			// The border is transparent, the centre opaque
+			if golden.alpha {
+				_, _, _, corner := img.At(0, 0).RGBA()
+				_, _, _, centre := img.At(golden.width/2, golden.height/2).RGBA()
 
-			if err != nil {
-				t.Logf("Error reading image from file! %s", err.Error())
-				t.Fail()
+				if corner != 0 || centre != 0xffff {
+					t.Errorf("Expected transparency to be kept, got alpha %d in the corner and %d in the centre", corner, centre)
+				}
 			}
 
-			// Resize
-			_, err = ResizeImage(&imgBuf, mode)
+			details := msg.Details
+			if details.Mode != mode || details.InputFormat != golden.inputFormat || details.CompressionFailed {
+				t.Errorf("Expected a %s conversion of a %s, got %+v", mode, golden.inputFormat, details)
+			}
 
-			if err != nil {
-				t.Logf("Error resizing image (%s): %s", file.Name(), err)
-				t.Fail()
+			if details.Upscaled != golden.upscaled || details.Distorted != golden.distorted {
+				t.Errorf("Expected upscaled=%t and distorted=%t, got %+v", golden.upscaled, golden.distorted, details)
+			}
+
+			// The caption warns of the same
+			caption := templates.CaptionMessage(loc, templates.CaptionData{
+				Mode:      mode,
+				Width:     golden.width,
+				Height:    golden.height,
+				Format:    prefs.FormatPNG,
+				Upscaled:  golden.upscaled,
+				Distorted: golden.distorted,
+			})
+
+			if msg.Caption != caption {
+				t.Errorf("Expected caption %q, got %q", caption, msg.Caption)
+			}
+		})
+	}
+}
+
+func TestCorruptImage(t *testing.T) {
+	loc := locale.For(locale.Default)
+	msg, err := ResizeImage(bytes.NewBuffer(corrupt()), prefs.Preferences{}, loc, limits.DefaultLimits())
+
+	if err == nil {
+		t.Fatalf("Expected resizing a corrupt image to fail")
+	}
+
+	if msg.Bytes != nil || msg.Caption != loc.Text("resize.error_reading", nil) {
+		t.Errorf("Expected the user to be told the image couldn't be read, got %q", msg.Caption)
+	}
+}
+
+func TestImageLimits(t *testing.T) {
+	loc := locale.For(locale.Default)
+	imageLimits := limits.Limits{MaxMegapixels: 50, MaxFrames: 3}
+
+	// A PNG of a few bytes declaring 2.5 gigapixels is refused before vips decodes it
+	msg, err := ResizeImage(bytes.NewBuffer(bomb(50000, 50000)), prefs.Preferences{}, loc, imageLimits)
+	if !errors.Is(err, limits.ErrTooManyPixels) {
+		t.Fatalf("Expected the decompression bomb to be refused, got %v", err)
+	}
+
+	if msg.Caption != loc.Text("limits.pixels", locale.Args{"megapixels": 2500, "max": 50}) {
+		t.Errorf("Expected the user to be told the image has too many pixels, got %q", msg.Caption)
+	}
+
+	msg, err = ResizeImage(bytes.NewBuffer(encodeAnimatedGIF(t, 16, 16, 5)), prefs.Preferences{}, loc, imageLimits)
+	if !errors.Is(err, limits.ErrTooManyFrames) {
+		t.Fatalf("Expected the animation to be refused, got %v", err)
+	}
+
+	if msg.Caption != loc.Text("limits.frames", locale.Args{"frames": 5, "max": 3}) {
+		t.Errorf("Expected the user to be told the animation has too many frames, got %q", msg.Caption)
+	}
+}
+
+func FuzzResizeImage(f *testing.F) {
+	f.Add(encodePNG(f, gradient(16, 16)))
+	f.Add(encodePNG(f, transparent(8, 24)))
+	f.Add(encodeJPEG(f, gradient(24, 8)))
+	f.Add(encodeAnimatedGIF(f, 8, 8, 2))
+	f.Add(corrupt())
+	f.Add([]byte{})
+
+	loc := locale.For(locale.Default)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ResizeImage(bytes.NewBuffer(data), prefs.Preferences{}, loc, limits.DefaultLimits())
+		if msg == nil {
+			t.Fatalf("Expected a message, even on failure")
+		}
+
+		if err != nil {
+			if msg.Bytes != nil || msg.Caption == "" {
+				t.Errorf("Expected only an error caption on failure, got %+v", msg)
 			}
 
-			fmt.Printf("Successfully resized image %s\n", file.Name())
+			return
+		}
+
+		// Whatever the input, a successful conversion is a PNG sticker
+		config, err := png.DecodeConfig(bytes.NewReader(*msg.Bytes))
+		if err != nil {
+			t.Fatalf("Expected a PNG: %s", err)
+		}
 
-			// Memory stats
-			vipsMem := bimg.VipsMemory()
-			fmt.Printf("Allocs: %d | Mem: %d | MemHighW: %d\n\n", vipsMem.Allocations, vipsMem.Memory, vipsMem.MemoryHighwater)
+		if config.Width > 512 || config.Height > 512 || (config.Width != 512 && config.Height != 512) {
+			t.Errorf("Expected a side of 512 pixels, got %dx%d", config.Width, config.Height)
 		}
+	})
+}
+
+func BenchmarkResizeImage(b *testing.B) {
+	loc := locale.For(locale.Default)
+
+	// Photos are sent as JPEGs
+	for _, side := range []int{256, 1024, 2048, 4096} {
+		data := encodeJPEG(b, gradient(side, side*3/4))
+
+		b.Run(fmt.Sprintf("%dx%d", side, side*3/4), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+
+			for i := 0; i < b.N; i++ {
+				if _, err := ResizeImage(bytes.NewBuffer(data), prefs.Preferences{}, loc, limits.DefaultLimits()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
@@ -3,116 +3,82 @@ package spam
 import (
 	"context"
 	"fmt"
-	"sort"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/time/rate"
-	tb "gopkg.in/telebot.v3"
 )
 
-// In-memory struct keeping track of banned chats and per-chat activity
-type AntiSpam struct {
-	ChatBanned               map[int64]bool           // Simple "if ChatBanned[chat] { do }" checks
-	ChatBannedUntilTimestamp map[int64]int64          // How long banned chats are banned for
-	ChatConversionLog        map[int64]*ConversionLog // Map chat ID to a ConversionLog struct
-	Rules                    map[string]int64         // Arbitrary rules for code flexibility
-	Mutex                    sync.Mutex               // Mutex to avoid concurrent map writes
-}
+// Ban timestamp for bans that last until lifted by an admin
+const PermanentBan = math.MaxInt64
 
-// Per-chat struct keeping track of activity for spam management
-type ConversionLog struct {
-	ConversionCount        int     // Image conversion count
-	ConversionTimestamps   []int64 // Trailing timestamps of converted images
-	LastCommandSendTime    time.Time
-	UserLimiter            rate.Limiter
-	RateLimitMessageSent   bool // Has the user been notified that they're rate-limited?
-	RateLimitMessageSentAt time.Time
-	InEmojiMode            bool // Defaults to false, i.e. sticker mode
+// Concurrency-safe store keeping track of banned chats and per-chat activity.
+// Per-chat state is sharded by chat ID, so that chats rarely contend for the same
+// lock. The policy (tiers and penalties) is guarded separately; it is always read
+// before a shard is locked, never while holding one.
+type AntiSpam struct {
+	shards       [shardCount]shard // Per-chat state
+	policy       sync.RWMutex      // Guards the fields below
+	rules        map[string]Tier   // Conversion limits of each tier
+	chatTier     map[int64]string  // Tiers of chats not in the default tier
+	penalties    Penalties         // Policy for escalating penalties
+	onTopPenalty PenaltyHook       // Called when a chat gets the harshest penalty
 }
 
-// Enforce a token-based rate-limiter on a per-chat basis
-func (spam *AntiSpam) RunUserLimiter(id int64, tokens int) {
-	if spam.ChatConversionLog[id] == nil {
-		spam.ChatConversionLog[id] = &ConversionLog{
-			UserLimiter: *rate.NewLimiter(1, 1),
-		}
+// Creates an anti-spam store with the default tiers and penalties
+func NewAntiSpam() *AntiSpam {
+	spam := &AntiSpam{
+		rules:     DefaultTiers(),
+		chatTier:  make(map[int64]string),
+		penalties: DefaultPenalties(),
 	}
 
-	// Run limiter
-	err := spam.ChatConversionLog[id].UserLimiter.WaitN(
-		context.Background(), tokens,
-	)
-
-	if err != nil {
-		log.Error().Err(err).Msg("Running user-limiter failed")
+	for i := range spam.shards {
+		spam.shards[i].chats = make(map[int64]*chatState)
 	}
 
-	spam.ChatConversionLog[id].LastCommandSendTime = time.Now()
+	return spam
 }
 
-// Get the current conversion mode the user is in
-func (spam *AntiSpam) GetConversionMode(id int64) bool {
-	if spam.ChatConversionLog[id] == nil {
-		// This should never occur due to ConversionPreHandler
-		return false
-	}
+// Enforce a token-based rate-limiter on a per-chat basis
+func (spam *AntiSpam) RunUserLimiter(id int64, tokens int) {
+	var limiter *rate.Limiter
 
-	return spam.ChatConversionLog[id].InEmojiMode
-}
+	spam.withChat(id, func(state *chatState) {
+		limiter = state.limiter
+		state.lastCommand = time.Now()
+	})
 
-// Toggle the conversion mode the user is in
-func (spam *AntiSpam) ToggleConversionMode(id int64) (bool, string, string, tb.SendOptions) {
-	if spam.ChatConversionLog[id] == nil {
-		// Initialize the ConversionLog struct
-		spam.ChatConversionLog[id] = &ConversionLog{
-			UserLimiter: *rate.NewLimiter(1, 1),
-			InEmojiMode: false,
-		}
-	} else {
-		spam.ChatConversionLog[id].InEmojiMode = !spam.ChatConversionLog[id].InEmojiMode
-	}
-
-	// Callback string based on new mode
-	var cb_string, confirmation, btnText string
-	if spam.ChatConversionLog[id].InEmojiMode {
-		cb_string = "✨ Emoji mode (100x100 px)"
-		confirmation = "✨ *Now in emoji-mode!* Call /mode any time to switch back."
-		btnText = "Switch to sticker-mode"
-	} else {
-		cb_string = "🖼️ Sticker mode (512 px)"
-		confirmation = "🖼️ *Now in sticker mode!* Call /mode any time to switch back."
-		btnText = "Switch to emoji-mode"
-	}
+	// Wait without holding the shard, so only this chat is slowed down
+	err := limiter.WaitN(context.Background(), tokens)
 
-	// New send-options for the confirmation message
-	sopts := tb.SendOptions{
-		ParseMode: "Markdown",
-		ReplyMarkup: &tb.ReplyMarkup{
-			InlineKeyboard: [][]tb.InlineButton{{tb.InlineButton{Text: btnText, Data: "mode/switch"}}},
-		},
+	if err != nil {
+		log.Error().Err(err).Msg("Running user-limiter failed")
 	}
-
-	return spam.ChatConversionLog[id].InEmojiMode, cb_string, confirmation, sopts
 }
 
 // A simple function that prints some insights of the AntiSpam struct
 func SpamInspectionString(spam *AntiSpam) string {
-	// Amount of chats in AntiSpam
-	chatCount := len(spam.ChatConversionLog)
-
 	// Track some insights
+	chatCount := 0          // Amount of chats in AntiSpam
 	totalConversions := 0   // Total conversion across all chats
 	maxConversionCount := 0 // Most per-chat conversions in the last 60 minutes
 
 	// Iterate over all chats that are tracked
-	for chat := range spam.ChatConversionLog {
-		totalConversions += spam.ChatConversionLog[chat].ConversionCount
-		if spam.ChatConversionLog[chat].ConversionCount > maxConversionCount {
-			maxConversionCount = spam.ChatConversionLog[chat].ConversionCount
+	since := time.Now().Unix() - 3600
+	spam.eachChat(func(chat int64, state *chatState) bool {
+		conversions := int(countSince(state.conversions, since))
+
+		chatCount++
+		totalConversions += conversions
+		if conversions > maxConversionCount {
+			maxConversionCount = conversions
 		}
-	}
+
+		return true
+	})
 
 	// Construct the spam message
 	return "🖼 *Hourly statistics*\n" +
@@ -124,154 +90,145 @@ func SpamInspectionString(spam *AntiSpam) string {
 // Used to periodically clean the conversion log, because
 // many users may never reach the x-image hourly conversion limit.
 func CleanConversionLogs(spam *AntiSpam) {
-	// Lock struct to avoid concurrent writes
-	spam.Mutex.Lock()
+	penalties := spam.Penalties()
+	now := time.Now().Unix()
 
-	// Iterate all chats, run RefreshConversions
-	for chat := range spam.ChatConversionLog {
-		RefreshConversions(spam, chat)
-	}
+	spam.eachChat(func(chat int64, state *chatState) bool {
+		// Forget conversions older than a day, and strikes that have decayed
+		state.pruneConversions(now, penalties.FloodSeconds)
+		penalties.decayStrikes(state, now)
 
-	// Unlock struct
-	spam.Mutex.Unlock()
+		if state.liftExpiredBan(now) {
+			log.Info().Msgf("⌛️ Chat %d unbanned in CleanConversionLogs", chat)
+		}
+
+		// Forget chats with no recent activity
+		return !state.idle()
+	})
 }
 
-// Count the amount of conversions in the last hour.
-// Used by /help and /spam, plus periodically ran automatically.
-func RefreshConversions(spam *AntiSpam, chat int64) {
-	// Extract chat's conversion log for cleaner code
-	chatLog := spam.ChatConversionLog[chat]
-
-	// Mutex has already been locked, so modifying is safe
-	if chatLog.ConversionCount == 0 {
-		// If more than 3600 seconds since last command, remove entry
-		if time.Since(chatLog.LastCommandSendTime) > time.Hour {
-			delete(spam.ChatConversionLog, chat)
+// When a conversion is requested, ConversionPreHandler verifies the
+// chat is not banned and has not exceeded the limits of its tier. Album
+// is the media group of the image, if it was sent as part of one.
+func ConversionPreHandler(spam *AntiSpam, chat int64, album string) bool {
+	// Read the policy before locking the chat's shard
+	tier, penalties, hook := spam.policyOf(chat)
+
+	allowed := false
+	spam.withChat(chat, func(state *chatState) {
+		now := time.Now().Unix()
+		state.lastCommand = time.Now()
+
+		// Check if user is banned
+		if state.banned {
+			if !state.liftExpiredBan(now) {
+				// Chat is still banned
+				return
+			}
+
+			// Chat's ban period has ended, ban was lifted
+			log.Info().Msgf("⌛️ Chat %d unbanned", chat)
 		}
 
-		return
-	}
+		// If chat has broken any of its tier's limits, ban it until it may convert again
+		until, volumeExceeded := tier.limitedUntil(state.conversions, now)
+		flooding := tier != Tier{} && penalties.isFlooding(state.sends, now)
 
-	// Search for last index outside of the trailing 3600 seconds
-	trailingHour := time.Now().Unix() - 3600
+		if until > now || flooding {
+			// Exceeding the hourly or daily volume, or flooding, earns a strike and an escalated cooldown
+			if flooding {
+				until = penalties.strike(state, chat, now, until, "flooding", hook)
+			} else if volumeExceeded {
+				until = penalties.strike(state, chat, now, until, "exceeding limits", hook)
+			}
 
-	// Last time stamp that is out of range (OOR)
-	lastOOR := sort.Search(
-		len(chatLog.ConversionTimestamps),
-		func(i int) bool { return chatLog.ConversionTimestamps[i] > trailingHour },
-	)
+			state.banned = true
+			state.bannedUntil = until
+			return
+		}
 
-	if lastOOR == len(chatLog.ConversionTimestamps) {
-		// If we go over the last index, clear the array
-		chatLog.ConversionTimestamps = []int64{}
-	} else if lastOOR == 0 {
-		// Nothing to do if all timestamps are within the last trailing hour
-	} else {
-		// Otherwise, we're somewhere inside the array: truncate
-		chatLog.ConversionTimestamps = chatLog.ConversionTimestamps[lastOOR:len(chatLog.ConversionTimestamps)]
-	}
+		// No rules broken: update spam log. The images of an album are sent at once,
+		// so they only count as one send towards flooding.
+		state.conversions = append(state.conversions, now)
+		if album == "" || album != state.lastAlbum {
+			state.sends = append(state.sends, now)
+		}
 
-	// Check if user is banned
-	if spam.ChatBanned[chat] {
-		if spam.ChatBannedUntilTimestamp[chat] <= time.Now().Unix() {
-			// If user should be unbanned, do it now
-			spam.ChatBanned[chat] = false
-			spam.ChatBannedUntilTimestamp[chat] = -1
-			chatLog.RateLimitMessageSent = false
-			chatLog.RateLimitMessageSentAt = time.Time{}
+		state.lastAlbum = album
+		allowed = true
+	})
 
-			log.Info().Msgf("⌛️ Chat %d unbanned in RefreshConversions", chat)
-		}
-	}
+	return allowed
+}
+
+// Checks if the chat should be told it's rate-limited, and records that it was.
+// Avoids spamming the same rate-limit message 50 times.
+func (spam *AntiSpam) ShouldSendRateLimitMessage(chat int64) bool {
+	send := false
 
-	// If the chat has 0 conversions after refresh, and no fresh command calls, delete it
-	if len(chatLog.ConversionTimestamps) == 0 {
-		if time.Since(chatLog.LastCommandSendTime) > time.Hour {
-			delete(spam.ChatConversionLog, chat)
+	spam.withChat(chat, func(state *chatState) {
+		if time.Since(state.noticeSentAt) < time.Minute {
 			return
 		}
-	}
 
-	// Update ConversionCount, push ConversionLog to spam struct
-	chatLog.ConversionCount = len(chatLog.ConversionTimestamps)
+		state.noticeSentAt = time.Now()
+		send = true
+	})
+
+	return send
 }
 
-// When a conversion is requested, ConversionPreHandler verifies the
-// chat is not banned and has not exceeded the hourly conversion limit.
-func ConversionPreHandler(spam *AntiSpam, chat int64) bool {
-	// Lock spam struct to avoid concurrent writes
-	spam.Mutex.Lock()
-	defer spam.Mutex.Unlock()
-
-	// Check if user is banned
-	if spam.ChatBanned[chat] {
-		if spam.ChatBannedUntilTimestamp[chat] <= time.Now().Unix() {
-			// Chat's ban period has ended, lift ban
-			log.Info().Msgf("⌛️ Chat %d unbanned", chat)
-			spam.ChatBanned[chat] = false
-			spam.ChatBannedUntilTimestamp[chat] = -1
-		} else {
-			// Chat is still banned
-			return false
-		}
-	}
+// Bans a chat by an admin until the given Unix timestamp. Use PermanentBan to
+// ban until unbanned. Unlike rate-limits, manual bans are never lifted early.
+func (spam *AntiSpam) BanChat(chat int64, until int64) {
+	spam.withChat(chat, func(state *chatState) {
+		state.banned = true
+		state.bannedUntil = until
+		state.manual = true
+	})
+}
 
-	// Check that user's spam log exists
-	if spam.ChatConversionLog[chat] == nil {
-		spam.ChatConversionLog[chat] = &ConversionLog{
-			UserLimiter: *rate.NewLimiter(1, 2),
-		}
-	}
+// Lifts a chat's ban. Returns false if the chat was not banned.
+func (spam *AntiSpam) UnbanChat(chat int64) bool {
+	unbanned := false
 
-	// Pointer to chat's spam log
-	ccLog := spam.ChatConversionLog[chat]
+	spam.peekChat(chat, func(state *chatState) {
+		if !state.banned {
+			return
+		}
 
-	// Remove every timestamp older than an hour, if chat seems like they might be bannable
-	if ccLog.ConversionCount >= int(spam.Rules["ConversionsPerHour"]) {
-		RefreshConversions(spam, chat)
-	}
+		// Forget conversions that led to an automatic ban, and allow notifying the chat again
+		state.lift()
+		state.conversions, state.sends = nil, nil
+		unbanned = true
+	})
 
-	// If chat has too many conversion within trailing hour, update ChatBannedUntilTimestamp
-	if ccLog.ConversionCount >= int(spam.Rules["ConversionsPerHour"]) {
-		spam.ChatBanned[chat] = true
+	return unbanned
+}
 
-		if len(ccLog.ConversionTimestamps) != 0 {
-			spam.ChatBannedUntilTimestamp[chat] = ccLog.ConversionTimestamps[0] + 3600
-		} else {
-			spam.ChatBannedUntilTimestamp[chat] = time.Now().Unix() + 3600
-		}
-	} else {
-		// Otherwise, update ban status
-		if spam.ChatBanned[chat] {
-			spam.ChatBanned[chat] = false
-			spam.ChatBannedUntilTimestamp[chat] = 0
-			ccLog.RateLimitMessageSent = false
-			ccLog.RateLimitMessageSentAt = time.Time{}
-
-			log.Info().Msgf("🚦 %d unratelimited! %d conversions remaining in log",
-				chat, len(ccLog.ConversionTimestamps))
-		}
-	}
+// Returns the chat's conversions during the trailing hour, whether (and until
+// when) the chat is banned, and whether the ban was set by an admin
+func (spam *AntiSpam) ChatStatus(chat int64) (int, bool, int64, bool) {
+	var (
+		conversions int
+		banned      bool
+		until       int64
+		manual      bool
+	)
 
-	if spam.ChatBanned[chat] {
-		// Return if chat was banned
-		return false
-	}
+	spam.peekChat(chat, func(state *chatState) {
+		now := time.Now().Unix()
+		state.liftExpiredBan(now)
 
-	// No rules broken: update spam log
-	ccLog.ConversionCount++
-	ccLog.ConversionTimestamps = append(ccLog.ConversionTimestamps, time.Now().Unix())
+		conversions = int(countSince(state.conversions, now-3600))
+		banned, until, manual = state.banned, state.bannedUntil, state.manual
+	})
 
-	return true
+	return conversions, banned, until, manual
 }
 
-func (spam *AntiSpam) ChatReceivedRateLimitMessage(chat int64) {
-	// Lock spam struct to avoid concurrent writes
-	spam.Mutex.Lock()
-	defer spam.Mutex.Unlock()
-
-	// Update flag
-	ccLog := spam.ChatConversionLog[chat]
-	ccLog.RateLimitMessageSent = true
-	ccLog.RateLimitMessageSentAt = time.Now()
+// Returns the chat's conversions during the trailing hour
+func (spam *AntiSpam) ConversionCount(chat int64) int {
+	conversions, _, _, _ := spam.ChatStatus(chat)
+	return conversions
 }
@@ -0,0 +1,41 @@
+package spam
+
+import "time"
+
+// Subscribes a rate-limited chat to a notification once its current rate-limit
+// ends. Returns false if the chat is not rate-limited, or banned by an admin.
+func (spam *AntiSpam) NotifyWhenUnbanned(chat int64) bool {
+	subscribed := false
+
+	spam.peekChat(chat, func(state *chatState) {
+		if !state.banned || state.manual {
+			return
+		}
+
+		// Repeated subscriptions to the same rate-limit are merged
+		state.notifyUntil = state.bannedUntil
+		subscribed = true
+	})
+
+	return subscribed
+}
+
+// Returns the subscribed chats whose rate-limit has ended, removing their subscriptions
+// so that each rate-limit produces at most one notification.
+func (spam *AntiSpam) DueUnbanNotifications() []int64 {
+	now := time.Now().Unix()
+	due := []int64{}
+
+	spam.eachChat(func(chat int64, state *chatState) bool {
+		// Follow the chat's current ban, as it may have been lifted early or extended
+		if state.notifyUntil == 0 || (state.banned && state.bannedUntil > now) {
+			return true
+		}
+
+		due = append(due, chat)
+		state.notifyUntil = 0
+		return true
+	})
+
+	return due
+}
@@ -0,0 +1,41 @@
+package spam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnbanNotification(t *testing.T) {
+	aspam := newTestAntiSpam()
+	now := time.Now().Unix()
+
+	// Manual bans can't be subscribed to
+	aspam.BanChat(1, now+3600)
+	if aspam.NotifyWhenUnbanned(1) {
+		t.Errorf("Subscribed to a manual ban")
+	}
+
+	// Hit the rate-limit with chat 2, and subscribe twice
+	for i := 0; i < 3; i++ {
+		ConversionPreHandler(aspam, 2, "")
+	}
+
+	if !aspam.NotifyWhenUnbanned(2) || !aspam.NotifyWhenUnbanned(2) {
+		t.Fatalf("Could not subscribe to a rate-limit")
+	}
+
+	if due := aspam.DueUnbanNotifications(); len(due) != 0 {
+		t.Errorf("Notified before the rate-limit ended: %v", due)
+	}
+
+	// End the rate-limit
+	aspam.withChat(2, func(state *chatState) { state.bannedUntil = now - 1 })
+
+	if due := aspam.DueUnbanNotifications(); len(due) != 1 || due[0] != 2 {
+		t.Errorf("Expected one notification for chat 2, got %v", due)
+	}
+
+	if due := aspam.DueUnbanNotifications(); len(due) != 0 {
+		t.Errorf("Notified twice of the same rate-limit: %v", due)
+	}
+}
@@ -0,0 +1,121 @@
+package spam
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Policy for escalating the cooldowns of chats that keep hitting their limits
+type Penalties struct {
+	CooldownHours     []int64 // Cooldown for the first, second, ... strike within the window
+	StrikeWindowHours int64   // How long a strike counts towards escalation
+	FloodImages       int64   // Images sent within FloodSeconds that count as flooding
+	FloodSeconds      int64   // Window for flood detection
+}
+
+// Function called when a chat reaches the harshest penalty
+type PenaltyHook func(chat int64, strikes int, until int64)
+
+// The penalty policy a config starts out with
+func DefaultPenalties() Penalties {
+	return Penalties{
+		CooldownHours:     []int64{1, 6, 24},
+		StrikeWindowHours: 72,
+		FloodImages:       15,
+		FloodSeconds:      5,
+	}
+}
+
+// Checks if the chat is sending images faster than any person would
+func (penalties Penalties) isFlooding(timestamps []int64, now int64) bool {
+	if penalties.FloodImages == 0 {
+		return false
+	}
+
+	return countSince(timestamps, now-penalties.FloodSeconds) >= penalties.FloodImages
+}
+
+// Drops the chat's strikes that have decayed, returning the remaining ones
+func (penalties Penalties) decayStrikes(state *chatState, now int64) []int64 {
+	fresh := countSince(state.strikes, now-penalties.StrikeWindowHours*3600)
+	state.strikes = state.strikes[len(state.strikes)-int(fresh):]
+
+	if len(state.strikes) == 0 {
+		state.strikes = nil
+	}
+
+	return state.strikes
+}
+
+// Records a strike against the chat, and returns when its escalated cooldown
+// ends. The cooldown never ends before until. The chat's shard must be locked.
+func (penalties Penalties) strike(state *chatState, chat int64, now int64, until int64, reason string, hook PenaltyHook) int64 {
+	strikes := append(penalties.decayStrikes(state, now), now)
+	state.strikes = strikes
+
+	cooldowns := penalties.CooldownHours
+	if len(cooldowns) == 0 {
+		return until
+	}
+
+	// Repeat offenders get the harshest cooldown
+	level := len(strikes)
+	if level > len(cooldowns) {
+		level = len(cooldowns)
+	}
+
+	if escalated := now + cooldowns[level-1]*3600; escalated > until {
+		until = escalated
+	}
+
+	log.Info().Msgf("🚦 Chat %d received strike %d for %s, cooling down for %s",
+		chat, len(strikes), reason, time.Until(time.Unix(until, 0)).Round(time.Minute))
+
+	// Let admins know about chats at the top of the escalation ladder
+	if level == len(cooldowns) {
+		log.Warn().Msgf("🚨 Chat %d has reached the harshest penalty with %d strikes", chat, len(strikes))
+
+		if hook != nil {
+			go hook(chat, len(strikes), until)
+		}
+	}
+
+	return until
+}
+
+// Returns the chat's strikes within the strike window
+func (spam *AntiSpam) Strikes(chat int64) int {
+	penalties := spam.Penalties()
+	strikes := 0
+
+	spam.peekChat(chat, func(state *chatState) {
+		strikes = len(penalties.decayStrikes(state, time.Now().Unix()))
+	})
+
+	return strikes
+}
+
+// Returns the penalty policy
+func (spam *AntiSpam) Penalties() Penalties {
+	spam.policy.RLock()
+	defer spam.policy.RUnlock()
+
+	return spam.penalties
+}
+
+// Sets the penalty policy
+func (spam *AntiSpam) SetPenalties(penalties Penalties) {
+	spam.policy.Lock()
+	defer spam.policy.Unlock()
+
+	spam.penalties = penalties
+}
+
+// Sets the function called when a chat reaches the harshest penalty
+func (spam *AntiSpam) SetPenaltyHook(hook PenaltyHook) {
+	spam.policy.Lock()
+	defer spam.policy.Unlock()
+
+	spam.onTopPenalty = hook
+}
@@ -0,0 +1,127 @@
+package spam
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"tg-resize-sticker-images/storage"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A chat's ban, as persisted to disk
+type banSnapshot struct {
+	Until  int64 // Unix timestamp the ban ends at, PermanentBan if never
+	Manual bool  // Was the ban set by an admin?
+}
+
+// Anti-spam state persisted across restarts
+type stateSnapshot struct {
+	Saved       int64                 // Unix timestamp of the snapshot
+	Bans        map[int64]banSnapshot // Banned chats
+	Conversions map[int64][]int64     // Conversion timestamps during the trailing day
+	Strikes     map[int64][]int64     // Strike timestamps, for escalating penalties
+	Notify      map[int64]int64       // Chats to notify once their rate-limit ends
+}
+
+// Writes the bans and recent conversions to disk
+func (spam *AntiSpam) SaveState(path string) error {
+	snapshot := stateSnapshot{
+		Saved:       time.Now().Unix(),
+		Bans:        make(map[int64]banSnapshot),
+		Conversions: make(map[int64][]int64),
+		Strikes:     make(map[int64][]int64),
+		Notify:      make(map[int64]int64),
+	}
+
+	spam.eachChat(func(chat int64, state *chatState) bool {
+		if state.banned {
+			snapshot.Bans[chat] = banSnapshot{Until: state.bannedUntil, Manual: state.manual}
+		}
+
+		if len(state.conversions) != 0 {
+			snapshot.Conversions[chat] = append([]int64{}, state.conversions...)
+		}
+
+		if len(state.strikes) != 0 {
+			snapshot.Strikes[chat] = append([]int64{}, state.strikes...)
+		}
+
+		if state.notifyUntil != 0 {
+			snapshot.Notify[chat] = state.notifyUntil
+		}
+
+		return true
+	})
+
+	return storage.WriteJSON(path, snapshot)
+}
+
+// Restores the bans and recent conversions from disk, dropping expired entries.
+// A missing state file is not an error.
+func (spam *AntiSpam) LoadState(path string) error {
+	var snapshot stateSnapshot
+	if err := storage.ReadJSON(path, &snapshot); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	penalties := spam.Penalties()
+	now := time.Now().Unix()
+
+	bans := 0
+	for chat, ban := range snapshot.Bans {
+		if ban.Until <= now {
+			continue
+		}
+
+		spam.withChat(chat, func(state *chatState) {
+			state.banned = true
+			state.bannedUntil = ban.Until
+			state.manual = ban.Manual
+		})
+
+		bans++
+	}
+
+	chats := 0
+	for chat, timestamps := range snapshot.Conversions {
+		// Keep the timestamps within the trailing day
+		fresh := timestamps[len(timestamps)-int(countSince(timestamps, now-24*3600)):]
+		if len(fresh) == 0 {
+			continue
+		}
+
+		spam.withChat(chat, func(state *chatState) {
+			state.conversions = fresh
+			state.lastCommand = time.Unix(fresh[len(fresh)-1], 0)
+		})
+
+		chats++
+	}
+
+	strikes := 0
+	for chat, timestamps := range snapshot.Strikes {
+		spam.withChat(chat, func(state *chatState) {
+			state.strikes = timestamps
+			if len(penalties.decayStrikes(state, now)) != 0 {
+				strikes++
+			}
+		})
+	}
+
+	// Keep subscriptions for expired bans, so that they are notified on the next run
+	for chat, until := range snapshot.Notify {
+		spam.withChat(chat, func(state *chatState) {
+			state.notifyUntil = until
+		})
+	}
+
+	log.Info().Msgf("🚦 Restored anti-spam state: %d bans, %d chats with recent conversions, %d chats with strikes",
+		bans, chats, strikes)
+	return nil
+}
@@ -0,0 +1,52 @@
+package spam
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestAntiSpam() *AntiSpam {
+	aspam := NewAntiSpam()
+	aspam.SetTiers(map[string]Tier{DefaultTier: {HourlyLimit: 2}}, nil)
+	return aspam
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anti-spam.json")
+	now := time.Now().Unix()
+
+	aspam := newTestAntiSpam()
+	aspam.BanChat(1, PermanentBan)
+	aspam.BanChat(2, now-10) // Expired
+
+	// Hit the rate-limit with chat 3
+	for i := 0; i < 3; i++ {
+		ConversionPreHandler(aspam, 3, "")
+	}
+
+	if err := aspam.SaveState(path); err != nil {
+		t.Fatalf("Error saving state: %s", err)
+	}
+
+	restored := newTestAntiSpam()
+	if err := restored.LoadState(path); err != nil {
+		t.Fatalf("Error loading state: %s", err)
+	}
+
+	if _, banned, _, manual := restored.ChatStatus(1); !banned || !manual {
+		t.Errorf("Expected manual ban of chat 1 to be restored")
+	}
+
+	if _, banned, _, _ := restored.ChatStatus(2); banned {
+		t.Errorf("Expected expired ban of chat 2 to be dropped")
+	}
+
+	if _, banned, _, manual := restored.ChatStatus(3); !banned || manual {
+		t.Errorf("Expected automatic ban of chat 3 to be restored")
+	}
+
+	if ConversionPreHandler(restored, 3, "") {
+		t.Errorf("Expected chat 3 to still be rate-limited after restoring")
+	}
+}
@@ -0,0 +1,117 @@
+package spam
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Number of shards the per-chat state is split into, to keep lock contention low
+const shardCount = 32
+
+// Anti-spam state of a single chat. Only accessed with its shard's mutex held.
+type chatState struct {
+	conversions  []int64       // Sorted timestamps of conversions during the trailing day
+	sends        []int64       // Sorted timestamps of recent sends, counted for flooding: one per image or album
+	lastAlbum    string        // Media group of the last conversion, if it was part of an album
+	lastCommand  time.Time     // When the chat last ran a command or converted an image
+	limiter      *rate.Limiter // Per-chat rate-limiter for commands
+	banned       bool          // Is the chat banned or rate-limited?
+	bannedUntil  int64         // Unix timestamp the ban ends at, PermanentBan if never
+	manual       bool          // Was the ban set by an admin?
+	strikes      []int64       // Sorted timestamps of strikes, for escalating penalties
+	notifyUntil  int64         // End of the rate-limit the chat wants to be notified of, 0 if none
+	noticeSentAt time.Time     // When the chat was last told it's rate-limited
+}
+
+// A shard of the per-chat state, guarded by its own mutex
+type shard struct {
+	mutex sync.Mutex
+	chats map[int64]*chatState
+}
+
+// Returns the shard holding the chat's state
+func (spam *AntiSpam) shardOf(chat int64) *shard {
+	return &spam.shards[uint64(chat)%shardCount]
+}
+
+// Runs fn with the chat's state, creating it if it doesn't exist. The shard is locked while fn runs.
+func (spam *AntiSpam) withChat(chat int64, fn func(state *chatState)) {
+	shard := spam.shardOf(chat)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	state := shard.chats[chat]
+	if state == nil {
+		state = &chatState{limiter: rate.NewLimiter(1, 2)}
+		shard.chats[chat] = state
+	}
+
+	fn(state)
+}
+
+// Runs fn with the chat's state, if the chat is tracked. Returns false if it isn't.
+func (spam *AntiSpam) peekChat(chat int64, fn func(state *chatState)) bool {
+	shard := spam.shardOf(chat)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	state := shard.chats[chat]
+	if state == nil {
+		return false
+	}
+
+	fn(state)
+	return true
+}
+
+// Runs fn for every tracked chat, locking one shard at a time. Chats for which
+// fn returns false are forgotten.
+func (spam *AntiSpam) eachChat(fn func(chat int64, state *chatState) bool) {
+	for i := range spam.shards {
+		shard := &spam.shards[i]
+		shard.mutex.Lock()
+
+		for chat, state := range shard.chats {
+			if !fn(chat, state) {
+				delete(shard.chats, chat)
+			}
+		}
+
+		shard.mutex.Unlock()
+	}
+}
+
+// Lifts the chat's ban if it has ended. Returns true if a ban was lifted.
+func (state *chatState) liftExpiredBan(now int64) bool {
+	if !state.banned || state.bannedUntil > now {
+		return false
+	}
+
+	state.lift()
+	return true
+}
+
+// Lifts the chat's ban, and allows telling the chat it's rate-limited again
+func (state *chatState) lift() {
+	state.banned = false
+	state.bannedUntil = 0
+	state.manual = false
+	state.noticeSentAt = time.Time{}
+}
+
+// Forgets conversions older than a day, and sends older than the flood window
+func (state *chatState) pruneConversions(now int64, floodSeconds int64) {
+	fresh := countSince(state.conversions, now-24*3600)
+	state.conversions = state.conversions[len(state.conversions)-int(fresh):]
+
+	recent := countSince(state.sends, now-floodSeconds)
+	state.sends = state.sends[len(state.sends)-int(recent):]
+}
+
+// Checks if the chat's state carries no information, and can be forgotten
+func (state *chatState) idle() bool {
+	return len(state.conversions) == 0 && len(state.strikes) == 0 && !state.banned &&
+		state.notifyUntil == 0 && time.Since(state.lastCommand) > time.Hour
+}
@@ -0,0 +1,83 @@
+package spam
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConcurrentAccess(t *testing.T) {
+	aspam := NewAntiSpam()
+	aspam.SetTiers(map[string]Tier{DefaultTier: {HourlyLimit: 50}}, nil)
+	aspam.SetPenalties(Penalties{CooldownHours: []int64{1}, StrikeWindowHours: 72})
+	path := filepath.Join(t.TempDir(), "anti-spam.json")
+
+	const (
+		chats      = 64
+		goroutines = 16
+		attempts   = 20
+	)
+
+	var wg sync.WaitGroup
+	var converted [chats]int64
+
+	// Convert from many goroutines at once, sharing chats between them
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < attempts; i++ {
+				for chat := int64(0); chat < chats; chat++ {
+					if ConversionPreHandler(aspam, chat, "") {
+						atomic.AddInt64(&converted[chat], 1)
+					}
+				}
+			}
+		}()
+	}
+
+	// Meanwhile, read and modify the state through the rest of the API
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < attempts; i++ {
+			chat := int64(chats + i)
+
+			aspam.RunUserLimiter(chat, 1)
+			aspam.BanChat(chat, PermanentBan)
+			aspam.ChatStatus(chat)
+			aspam.UnbanChat(chat)
+			aspam.ShouldSendRateLimitMessage(chat)
+			aspam.NotifyWhenUnbanned(int64(i))
+			aspam.DueUnbanNotifications()
+			aspam.Strikes(int64(i))
+			aspam.ConversionCount(int64(i))
+			aspam.SetConversionRate(50)
+			aspam.SetChatTier(chat, DefaultTier)
+			aspam.TierOf(int64(i))
+			SpamInspectionString(aspam)
+			CleanConversionLogs(aspam)
+
+			if err := aspam.SaveState(path); err != nil {
+				t.Errorf("Error saving state: %s", err)
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	// Every chat converts exactly up to its limit, no matter how the calls interleave
+	for chat, count := range converted {
+		if count != 50 {
+			t.Errorf("Expected chat %d to convert 50 images, got %d", chat, count)
+		}
+
+		if aspam.ConversionCount(int64(chat)) != 50 || aspam.Strikes(int64(chat)) != 1 {
+			t.Errorf("Expected chat %d to have 50 conversions and a strike, got %d and %d",
+				chat, aspam.ConversionCount(int64(chat)), aspam.Strikes(int64(chat)))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package spam
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Name of the tier chats are in unless assigned to another one
+const DefaultTier = "default"
+
+// Conversion limits for a tier of users. A limit of zero means unlimited.
+type Tier struct {
+	HourlyLimit int64 // Conversions per trailing hour
+	DailyLimit  int64 // Conversions per trailing day
+	BatchSize   int64 // Conversions per trailing minute, i.e. images sent back-to-back
+}
+
+// The tiers a config starts out with
+func DefaultTiers() map[string]Tier {
+	return map[string]Tier{
+		"whitelist":  {HourlyLimit: 0, DailyLimit: 0, BatchSize: 0},
+		DefaultTier:  {HourlyLimit: 100, DailyLimit: 500, BatchSize: 20},
+		"restricted": {HourlyLimit: 10, DailyLimit: 30, BatchSize: 3},
+	}
+}
+
+// Returns the name of the chat's tier. The policy lock must be held.
+func (spam *AntiSpam) tierName(chat int64) string {
+	if name, ok := spam.chatTier[chat]; ok {
+		if _, exists := spam.rules[name]; exists {
+			return name
+		}
+	}
+
+	return DefaultTier
+}
+
+// Returns the chat's tier limits, the penalty policy and the top-penalty hook
+func (spam *AntiSpam) policyOf(chat int64) (Tier, Penalties, PenaltyHook) {
+	spam.policy.RLock()
+	defer spam.policy.RUnlock()
+
+	return spam.rules[spam.tierName(chat)], spam.penalties, spam.onTopPenalty
+}
+
+// Returns the name and limits of the chat's tier
+func (spam *AntiSpam) TierOf(chat int64) (string, Tier) {
+	spam.policy.RLock()
+	defer spam.policy.RUnlock()
+
+	name := spam.tierName(chat)
+	return name, spam.rules[name]
+}
+
+// Replaces the tiers and the chats' tier assignments
+func (spam *AntiSpam) SetTiers(tiers map[string]Tier, chatTiers map[int64]string) {
+	spam.policy.Lock()
+	defer spam.policy.Unlock()
+
+	spam.rules = make(map[string]Tier, len(tiers))
+	for name, tier := range tiers {
+		spam.rules[name] = tier
+	}
+
+	spam.chatTier = make(map[int64]string, len(chatTiers))
+	for chat, name := range chatTiers {
+		spam.chatTier[chat] = name
+	}
+}
+
+// Assigns a chat to a tier. Assigning to the default tier removes the assignment.
+func (spam *AntiSpam) SetChatTier(chat int64, name string) error {
+	spam.policy.Lock()
+	defer spam.policy.Unlock()
+
+	if _, ok := spam.rules[name]; !ok {
+		return fmt.Errorf("unknown tier %q", name)
+	}
+
+	if name == DefaultTier {
+		delete(spam.chatTier, chat)
+	} else {
+		spam.chatTier[chat] = name
+	}
+
+	return nil
+}
+
+// Sets the hourly conversion limit of the default tier
+func (spam *AntiSpam) SetConversionRate(limit int64) {
+	spam.policy.Lock()
+	defer spam.policy.Unlock()
+
+	tier := spam.rules[DefaultTier]
+	tier.HourlyLimit = limit
+	spam.rules[DefaultTier] = tier
+}
+
+// Counts the sorted timestamps later than since
+func countSince(timestamps []int64, since int64) int64 {
+	i := sort.Search(len(timestamps), func(i int) bool { return timestamps[i] > since })
+	return int64(len(timestamps) - i)
+}
+
+// Returns the time at which a chat may convert again without breaking the tier's
+// limits, or 0 if the chat may convert right away. Also reports whether an hourly
+// or daily limit was broken, as opposed to only the batch size. Timestamps must be sorted.
+func (tier Tier) limitedUntil(timestamps []int64, now int64) (int64, bool) {
+	until := int64(0)
+	volumeExceeded := false
+
+	windows := []struct {
+		limit  int64
+		length int64
+		volume bool
+	}{
+		{tier.BatchSize, 60, false},
+		{tier.HourlyLimit, 3600, true},
+		{tier.DailyLimit, 24 * 3600, true},
+	}
+
+	for _, window := range windows {
+		if window.limit == 0 || countSince(timestamps, now-window.length) < window.limit {
+			continue
+		}
+
+		// The chat is allowed to convert once the oldest of the last 'limit' conversions leaves the window
+		if free := timestamps[len(timestamps)-int(window.limit)] + window.length; free > until {
+			until = free
+		}
+
+		volumeExceeded = volumeExceeded || window.volume
+	}
+
+	return until, volumeExceeded
+}
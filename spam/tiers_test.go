@@ -0,0 +1,107 @@
+package spam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTierLimits(t *testing.T) {
+	aspam := newTestAntiSpam()
+	aspam.SetTiers(map[string]Tier{
+		DefaultTier:  {HourlyLimit: 5},
+		"restricted": {HourlyLimit: 10, BatchSize: 2},
+		"whitelist":  {},
+	}, map[int64]string{2: "restricted", 3: "whitelist"})
+
+	converted := func(chat int64, attempts int) int {
+		count := 0
+		for i := 0; i < attempts; i++ {
+			if ConversionPreHandler(aspam, chat, "") {
+				count++
+			}
+		}
+		return count
+	}
+
+	if n := converted(1, 10); n != 5 {
+		t.Errorf("Expected default tier to convert 5 images, got %d", n)
+	}
+
+	// Batch size limits back-to-back conversions before the hourly limit does
+	if n := converted(2, 10); n != 2 {
+		t.Errorf("Expected restricted tier to convert 2 images, got %d", n)
+	}
+
+	if n := converted(3, 50); n != 50 {
+		t.Errorf("Expected whitelisted chat to convert 50 images, got %d", n)
+	}
+
+	if err := aspam.SetChatTier(1, "nonexistent"); err == nil {
+		t.Errorf("Expected assigning an unknown tier to fail")
+	}
+}
+
+func TestEscalatingPenalties(t *testing.T) {
+	aspam := newTestAntiSpam()
+	aspam.SetPenalties(Penalties{CooldownHours: []int64{1, 6, 24}, StrikeWindowHours: 72})
+
+	notified := make(chan int, 1)
+	aspam.SetPenaltyHook(func(chat int64, strikes int, until int64) { notified <- strikes })
+
+	// Hit the hourly limit three times, lifting the ban in between
+	expected := []int64{1, 6, 24}
+	for _, hours := range expected {
+		for i := 0; i < 3; i++ {
+			ConversionPreHandler(aspam, 1, "")
+		}
+
+		_, _, until, _ := aspam.ChatStatus(1)
+		cooldown := until - time.Now().Unix()
+		if cooldown < hours*3600-5 || cooldown > hours*3600 {
+			t.Errorf("Expected a cooldown of %d hours, got %d seconds", hours, cooldown)
+		}
+
+		aspam.UnbanChat(1)
+	}
+
+	if strikes := <-notified; strikes != 3 {
+		t.Errorf("Expected admins to be notified on the third strike, got %d", strikes)
+	}
+}
+
+func TestFloodDetection(t *testing.T) {
+	aspam := newTestAntiSpam()
+	aspam.SetTiers(map[string]Tier{DefaultTier: {HourlyLimit: 100}}, nil)
+	aspam.SetPenalties(Penalties{CooldownHours: []int64{1}, StrikeWindowHours: 72, FloodImages: 5, FloodSeconds: 5})
+
+	converted := 0
+	for i := 0; i < 10; i++ {
+		if ConversionPreHandler(aspam, 1, "") {
+			converted++
+		}
+	}
+
+	if converted != 5 || aspam.Strikes(1) != 1 {
+		t.Errorf("Expected flooding to be stopped after 5 images with a strike, got %d images and %d strikes",
+			converted, aspam.Strikes(1))
+	}
+}
+
+func TestAlbumsAreNotFlooding(t *testing.T) {
+	aspam := NewAntiSpam()
+
+	// Two full albums sent back-to-back, with the default limits and penalties
+	converted := 0
+	for _, album := range []string{"album-1", "album-2"} {
+		for i := 0; i < 10; i++ {
+			if ConversionPreHandler(aspam, 1, album) {
+				converted++
+			}
+		}
+	}
+
+	if converted != 20 || aspam.Strikes(1) != 0 {
+		t.Errorf("Expected both albums to be converted without a strike, got %d images and %d strikes",
+			converted, aspam.Strikes(1))
+	}
+}
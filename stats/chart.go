@@ -0,0 +1,166 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"time"
+
+	"tg-resize-sticker-images/history"
+
+	"github.com/dustin/go-humanize"
+	tb "gopkg.in/telebot.v3"
+)
+
+const (
+	chartWidth  = 800 // Width of the chart, in pixels
+	panelHeight = 240 // Height of each of the two panels, in pixels
+	marginLeft  = 64  // Room for the y-axis labels
+	marginRight = 16  // Room right of the bars
+	marginTop   = 24  // Room above the tallest bar
+	axisHeight  = 28  // Room for the x-axis labels
+	glyphScale  = 2   // Size of a glyph's pixel
+)
+
+var (
+	background = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	gridColor  = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	axisColor  = color.RGBA{0x60, 0x60, 0x60, 0xff}
+	hourColor  = color.RGBA{0x2a, 0x9d, 0xf4, 0xff}
+	dayColor   = color.RGBA{0x34, 0xa8, 0x53, 0xff}
+)
+
+// A 3x5 bitmap font for digits: each row is three bits, most significant bit on the left
+var digits = [10][5]uint8{
+	{7, 5, 5, 5, 7}, {2, 6, 2, 2, 7}, {7, 1, 7, 4, 7}, {7, 1, 7, 1, 7}, {5, 5, 7, 1, 1},
+	{7, 4, 7, 1, 7}, {7, 4, 7, 5, 7}, {7, 1, 1, 1, 1}, {7, 5, 7, 5, 7}, {7, 5, 7, 1, 7},
+}
+
+// Width of a number drawn with drawNumber, in pixels
+func numberWidth(n int64) int {
+	return len(strconv.FormatInt(n, 10))*4*glyphScale - glyphScale
+}
+
+// Draws a number with its top-right corner at (right, top)
+func drawNumber(img draw.Image, n int64, right int, top int, c color.Color) {
+	text := strconv.FormatInt(n, 10)
+	x := right - numberWidth(n)
+
+	for _, char := range text {
+		glyph := digits[char-'0']
+
+		for row := 0; row < 5; row++ {
+			for col := 0; col < 3; col++ {
+				if glyph[row]&(4>>col) != 0 {
+					px := image.Rect(0, 0, glyphScale, glyphScale).Add(image.Pt(x+col*glyphScale, top+row*glyphScale))
+					draw.Draw(img, px, &image.Uniform{c}, image.Point{}, draw.Src)
+				}
+			}
+		}
+
+		x += 4 * glyphScale
+	}
+}
+
+// Draws a bar chart of counts into area. Every labelEvery'th bar is labeled with label(i).
+func drawPanel(img draw.Image, area image.Rectangle, counts []int64, c color.Color, labelEvery int, label func(i int) int64) {
+	plot := image.Rect(area.Min.X+marginLeft, area.Min.Y+marginTop, area.Max.X-marginRight, area.Max.Y-axisHeight)
+
+	max := int64(1)
+	for _, count := range counts {
+		if count > max {
+			max = count
+		}
+	}
+
+	// Grid lines at half and full height, labeled with their values
+	for _, fraction := range []int64{0, 1, 2} {
+		y := plot.Max.Y - int(int64(plot.Dy())*fraction/2)
+		draw.Draw(img, image.Rect(plot.Min.X, y, plot.Max.X, y+1), &image.Uniform{gridColor}, image.Point{}, draw.Src)
+		drawNumber(img, max*fraction/2, plot.Min.X-8, y-5*glyphScale/2, axisColor)
+	}
+
+	// Bars, with a gap between neighbours
+	slot := float64(plot.Dx()) / float64(len(counts))
+	for i, count := range counts {
+		left := plot.Min.X + int(float64(i)*slot)
+		right := plot.Min.X + int(float64(i+1)*slot) - int(slot/5) - 1
+		top := plot.Max.Y - int(int64(plot.Dy())*count/max)
+
+		draw.Draw(img, image.Rect(left, top, right, plot.Max.Y), &image.Uniform{c}, image.Point{}, draw.Src)
+
+		if i%labelEvery == 0 {
+			drawNumber(img, label(i), (left+right+numberWidth(label(i)))/2, plot.Max.Y+8, axisColor)
+		}
+	}
+
+	// Baseline
+	draw.Draw(img, image.Rect(plot.Min.X, plot.Max.Y, plot.Max.X, plot.Max.Y+1), &image.Uniform{axisColor}, image.Point{}, draw.Src)
+}
+
+// Renders a PNG chart of conversions per hour over the last 24 hours (top), and per
+// day over the last 30 days (bottom), both oldest first and ending at now. Hours are
+// labeled with the hour of day and days with the day of month, in UTC.
+func RenderChart(hourly []int64, daily []int64, now time.Time) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, 2*panelHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	now = now.UTC()
+
+	drawPanel(img, image.Rect(0, 0, chartWidth, panelHeight), hourly, hourColor, 3, func(i int) int64 {
+		return int64(now.Add(time.Duration(i-len(hourly)+1) * time.Hour).Hour())
+	})
+
+	drawPanel(img, image.Rect(0, panelHeight, chartWidth, 2*panelHeight), daily, dayColor, 5, func(i int) int64 {
+		return int64(now.AddDate(0, 0, i-len(daily)+1).Day())
+	})
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Builds the chart photo, with a caption explaining it and a button to refresh it
+func BuildChartMsg(hist *history.History) (*tb.Photo, tb.SendOptions, error) {
+	hourly, daily := hist.Hourly(24), hist.Daily(30)
+
+	chart, err := RenderChart(hourly, daily, time.Now())
+	if err != nil {
+		return nil, tb.SendOptions{}, err
+	}
+
+	sum := func(counts []int64) int64 {
+		total := int64(0)
+		for _, count := range counts {
+			total += count
+		}
+
+		return total
+	}
+
+	caption := fmt.Sprintf(
+		"📈 *Conversions over time*\n"+
+			"Top: per hour, last 24 hours (%s in total)\n"+
+			"Bottom: per day, last 30 days (%s in total)\n"+
+			"_Times in UTC_",
+		humanize.Comma(sum(hourly)), humanize.Comma(sum(daily)),
+	)
+
+	photo := &tb.Photo{File: tb.FromReader(bytes.NewReader(chart)), Caption: caption}
+
+	sopts := tb.SendOptions{
+		ParseMode: "Markdown",
+		ReplyMarkup: &tb.ReplyMarkup{
+			InlineKeyboard: [][]tb.InlineButton{{tb.InlineButton{Text: "🔄 Refresh chart", Data: "stats/chart/refresh"}}},
+		},
+	}
+
+	return photo, sopts, nil
+}
@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestRenderChart(t *testing.T) {
+	hourly := make([]int64, 24)
+	daily := make([]int64, 30)
+	hourly[23], daily[0] = 10, 1234
+
+	chart, err := RenderChart(hourly, daily, time.Date(2023, 5, 17, 12, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Error rendering chart: %s", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(chart))
+	if err != nil {
+		t.Fatalf("Chart is not a valid PNG: %s", err)
+	}
+
+	if bounds := img.Bounds(); bounds.Dx() != chartWidth || bounds.Dy() != 2*panelHeight {
+		t.Errorf("Expected a %dx%d chart, got %v", chartWidth, 2*panelHeight, bounds)
+	}
+
+	// The busiest hour and day fill their panels
+	hourBar := img.At(chartWidth-marginRight-8, marginTop+1)
+	dayBar := img.At(marginLeft+2, panelHeight+marginTop+1)
+
+	if hourBar != hourColor || dayBar != dayColor {
+		t.Errorf("Expected the tallest bars to reach the top of their panels, got %v and %v", hourBar, dayBar)
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"sort"
 	"time"
 
+	"tg-resize-sticker-images/analytics"
+	"tg-resize-sticker-images/cache"
 	"tg-resize-sticker-images/config"
 	"tg-resize-sticker-images/daily"
+	"tg-resize-sticker-images/history"
 
 	"github.com/dustin/go-humanize"
 	"github.com/hako/durafmt"
@@ -15,15 +18,26 @@ import (
 
 const gitUrl = "https://github.com/499602D2/tg-resize-sticker-images"
 
-// Update what the last observed user ID was
-func UpdateLastUserId(session *config.Session, id int64) {
+// Update what the last observed user ID was, returning true if it changed
+func UpdateLastUserId(session *config.Session, id int64) bool {
+	session.Mutex.Lock()
+	defer session.Mutex.Unlock()
+
+	changed := id != session.LastUser
 	session.LastUser = id
+
+	return changed
 }
 
-// Add one conversion to the stats
-func StatsPlusOneConversion(conf *config.Config) {
+// Add one conversion to the stats, with its details if known
+func StatsPlusOneConversion(conf *config.Config, details *analytics.Conversion) {
 	conf.Mutex.Lock()
 	conf.StatConverted++
+
+	if details != nil {
+		conf.StatBreakdown.Add(*details)
+	}
+
 	conf.Mutex.Unlock()
 }
 
@@ -77,13 +91,35 @@ func UpdateUniqueStat(uid int64, conf *config.Config) {
 	conf.StatUniqueChats++
 }
 
-func BuildStatsMsg(conf *config.Config, stats *daily.ConversionStatistics, vnum string) (string, tb.SendOptions) {
+// Describes conversions beyond the trailing day, and the busiest hour and day ever
+func historyString(hist *history.History) string {
+	busiestHour, busiestDay := hist.Records()
+
+	msg := "📅 *History*\n" +
+		fmt.Sprintf("Last 7 days: %s\n", humanize.Comma(hist.LastDays(7))) +
+		fmt.Sprintf("Last 30 days: %s", humanize.Comma(hist.LastDays(30)))
+
+	if busiestHour.Count != 0 {
+		msg += fmt.Sprintf("\nBusiest hour: %s (%s)\n", humanize.Comma(busiestHour.Count), busiestHour.Time().Format("2006-01-02 15:00 UTC")) +
+			fmt.Sprintf("Busiest day: %s (%s)", humanize.Comma(busiestDay.Count), busiestDay.Time().Format("2006-01-02"))
+	}
+
+	return msg
+}
+
+func BuildStatsMsg(conf *config.Config, stats *daily.ConversionStatistics, hist *history.History, vnum string) (string, tb.SendOptions) {
+	// Conversions keep updating the counters while the message is built
+	conf.Mutex.Lock()
+	converted, uniqueChats, started := conf.StatConverted, conf.StatUniqueChats, conf.StatStarted
+	conf.Mutex.Unlock()
+
 	// Main stats
 	msg := fmt.Sprintf(
 		"📊 *Overall statistics*\n"+
 			"Images converted: %s\n"+
 			"Unique users seen: %s\n\n"+
 
+			"%s\n\n"+
 			"%s\n\n"+
 
 			"*🎛 Server information*\n"+
@@ -91,14 +127,17 @@ func BuildStatsMsg(conf *config.Config, stats *daily.ConversionStatistics, vnum
 			"Running version [%s](%s)",
 
 		// Overall stats
-		humanize.Comma(int64(conf.StatConverted)),
-		humanize.Comma(int64(conf.StatUniqueChats)),
+		humanize.Comma(int64(converted)),
+		humanize.Comma(int64(uniqueChats)),
 
 		// Trailing-day statistics
 		stats.StatisticsString(),
 
+		// Long-term statistics
+		historyString(hist),
+
 		// Server info
-		durafmt.Parse(time.Since(time.Unix(conf.StatStarted, 0))).LimitFirstN(2),
+		durafmt.Parse(time.Since(time.Unix(started, 0))).LimitFirstN(2),
 		vnum, gitUrl,
 	)
 
@@ -106,7 +145,39 @@ func BuildStatsMsg(conf *config.Config, stats *daily.ConversionStatistics, vnum
 	sopts := tb.SendOptions{
 		ParseMode: "Markdown",
 		ReplyMarkup: &tb.ReplyMarkup{
-			InlineKeyboard: [][]tb.InlineButton{{tb.InlineButton{Text: "🔄 Refresh statistics", Data: "stats/refresh"}}},
+			InlineKeyboard: [][]tb.InlineButton{{
+				tb.InlineButton{Text: "🔄 Refresh statistics", Data: "stats/refresh"},
+				tb.InlineButton{Text: "📈 Chart", Data: "stats/chart"},
+			}, {
+				tb.InlineButton{Text: "🔍 Details", Data: "stats/details"},
+			}},
+		},
+	}
+
+	return msg, sopts
+}
+
+// Builds the second page of the stats, breaking conversions down by mode, input, outcome and latency,
+// followed by how well the conversion cache does
+func BuildDetailsMsg(conf *config.Config, stats *daily.ConversionStatistics, conversions *cache.Cache) (string, tb.SendOptions) {
+	conf.Mutex.Lock()
+	lifetime := conf.StatBreakdown.Copy()
+	conf.Mutex.Unlock()
+
+	trailing := stats.Breakdown()
+
+	msg := "🔍 *Conversion details*\n\n" +
+		trailing.String("Last 24 hours") + "\n\n" +
+		lifetime.String("All time") + "\n\n" +
+		conversions.String("Conversion cache")
+
+	sopts := tb.SendOptions{
+		ParseMode: "Markdown",
+		ReplyMarkup: &tb.ReplyMarkup{
+			InlineKeyboard: [][]tb.InlineButton{{
+				tb.InlineButton{Text: "⬅️ Overview", Data: "stats/refresh"},
+				tb.InlineButton{Text: "🔄 Refresh details", Data: "stats/details"},
+			}},
 		},
 	}
 
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Writes data to path atomically: the data is written to a temporary file in
+// the same folder, flushed to disk and then renamed over the old file, so a
+// crash mid-write can never leave a truncated file behind.
+func WriteFileAtomic(path string, data []byte) error {
+	folder := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(folder, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	// If anything fails before the rename, don't leave the temp file lying around
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the folder so the rename itself is persisted
+	dir, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Marshals v as indented json and writes it atomically to path, creating the folder if needed
+func WriteJSON(path string, v any) error {
+	jsonbytes, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, jsonbytes)
+}
+
+// Reads the json file at path into v. A missing file is reported with os.ErrNotExist.
+func ReadJSON(path string, v any) error {
+	fbytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(fbytes, v)
+}
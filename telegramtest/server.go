@@ -0,0 +1,569 @@
+package telegramtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Token of the bot the fake server accepts requests for
+const Token = "123456:telegramtest"
+
+// How long getUpdates waits for updates when the poller asks not to wait, so it doesn't spin
+const minPollWait = time.Second
+
+// A file uploaded by the bot
+type File struct {
+	Name string // Name of the uploaded file
+	Data []byte // Contents of the file
+}
+
+// A request the bot made to the Bot API
+type Request struct {
+	Method  string            // Bot API method, e.g. "sendMessage"
+	Params  map[string]string // Parameters, with non-string values in JSON
+	Files   map[string]File   // Uploaded files, by field
+	Message *tb.Message       // Message sent or edited by the request, if any
+}
+
+// An error returned instead of handling a request
+type Failure struct {
+	Code        int    // HTTP status and error code, e.g. 400
+	Description string // Description of the error, e.g. "Bad Request: chat not found"
+	RetryAfter  int    // Seconds the bot has to wait before retrying, for 429s
+}
+
+// Returns the failure sent when the bot is flood-limited
+func TooManyRequests(retryAfter int) Failure {
+	return Failure{
+		Code:        http.StatusTooManyRequests,
+		Description: fmt.Sprintf("Too Many Requests: retry after %d", retryAfter),
+		RetryAfter:  retryAfter,
+	}
+}
+
+// A file stored on the fake server
+type storedFile struct {
+	file tb.File // File, as returned by getFile
+	data []byte  // Contents of the file
+}
+
+// An in-process fake of the Telegram Bot API, for end-to-end tests. Point a bot's
+// tb.Settings.URL at URL, and use Token as its token. Updates are served through
+// getUpdates, or handed straight to a bot attached with Attach.
+type Server struct {
+	URL string // Base URL of the server
+
+	server    *httptest.Server
+	bot       tb.User                // User of the bot, returned by getMe
+	updates   []tb.Update            // Updates sent to the bot, oldest first
+	attached  *tb.Bot                // Bot updates are handed to instead of queued, if any
+	messages  map[int]*tb.Message    // Messages in all chats, by ID
+	markups   map[int]string         // Raw reply markup of each message, to detect no-op edits
+	files     map[string]*storedFile // Files by ID, uploaded or sent to the bot
+	byPath    map[string]*storedFile // Files by download path
+	requests  []Request              // Requests handled, except for getUpdates
+	waited    map[string]int         // Requests of each method returned by Wait
+	failures  map[string][]Failure   // Failures to return, per method
+	lastID    int                    // Last ID given to an update, message or file
+	changed   chan struct{}          // Closed and replaced when updates or requests arrive
+	closed    chan struct{}          // Closed when the server is closed
+	closeOnce sync.Once              // Closes the server once
+	mutex     sync.Mutex             // Mutex to avoid concurrent writes
+}
+
+// Starts a fake Bot API server. Close it when done.
+func NewServer() *Server {
+	server := &Server{
+		bot:      tb.User{ID: 1, IsBot: true, FirstName: "Test", Username: "test_bot"},
+		messages: make(map[int]*tb.Message),
+		markups:  make(map[int]string),
+		files:    make(map[string]*storedFile),
+		byPath:   make(map[string]*storedFile),
+		waited:   make(map[string]int),
+		failures: make(map[string][]Failure),
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	server.server = httptest.NewServer(server)
+	server.URL = server.server.URL
+
+	return server
+}
+
+// Stops the server, ending any pending getUpdates
+func (server *Server) Close() {
+	server.closeOnce.Do(func() {
+		close(server.closed)
+		server.server.Close()
+	})
+}
+
+// Returns the bot's user, as returned by getMe
+func (server *Server) Bot() tb.User {
+	return server.bot
+}
+
+// Makes the next requests of a method fail, in order
+func (server *Server) FailNext(method string, failures ...Failure) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.failures[method] = append(server.failures[method], failures...)
+}
+
+// Returns the requests of a method handled so far, oldest first
+func (server *Server) Requests(method string) []Request {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	requests := []Request{}
+	for _, request := range server.requests {
+		if request.Method == method {
+			requests = append(requests, request)
+		}
+	}
+
+	return requests
+}
+
+// Waits for the next request of a method, i.e. the first one not yet returned by Wait
+func (server *Server) Wait(method string, timeout time.Duration) (Request, error) {
+	deadline := time.After(timeout)
+
+	for {
+		server.mutex.Lock()
+		changed := server.changed
+		seen := 0
+
+		for _, request := range server.requests {
+			if request.Method != method {
+				continue
+			}
+
+			if seen == server.waited[method] {
+				server.waited[method]++
+				server.mutex.Unlock()
+				return request, nil
+			}
+
+			seen++
+		}
+
+		server.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Request{}, fmt.Errorf("no %s request within %s", method, timeout)
+		}
+	}
+}
+
+// Wakes up everyone waiting for updates or requests. Must hold the mutex.
+func (server *Server) notify() {
+	close(server.changed)
+	server.changed = make(chan struct{})
+}
+
+// Returns a new ID for an update, message or file. Must hold the mutex.
+func (server *Server) nextID() int {
+	server.lastID++
+	return server.lastID
+}
+
+// Stores a file, returning it as getFile would. Must hold the mutex.
+func (server *Server) storeFile(data []byte, extension string) tb.File {
+	id := server.nextID()
+
+	stored := &storedFile{
+		file: tb.File{
+			FileID:   fmt.Sprintf("file-%d", id),
+			UniqueID: fmt.Sprintf("unique-%d", id),
+			FileSize: int64(len(data)),
+			FilePath: fmt.Sprintf("files/%d.%s", id, extension),
+		},
+		data: data,
+	}
+
+	server.files[stored.file.FileID] = stored
+	server.byPath[stored.file.FilePath] = stored
+
+	return stored.file
+}
+
+// Writes the body of a response
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// Writes a failure as the Bot API would
+func writeFailure(w http.ResponseWriter, failure Failure) {
+	body := map[string]any{
+		"ok":          false,
+		"error_code":  failure.Code,
+		"description": failure.Description,
+	}
+
+	if failure.RetryAfter != 0 {
+		body["parameters"] = map[string]int{"retry_after": failure.RetryAfter}
+	}
+
+	writeJSON(w, failure.Code, body)
+}
+
+// Reads the parameters and files of a request, sent either as JSON or as a multipart form
+func parseRequest(r *http.Request) (map[string]string, map[string]File, error) {
+	params, files := make(map[string]string), make(map[string]File)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(64 << 20); err != nil {
+			return nil, nil, err
+		}
+
+		for key, values := range r.MultipartForm.Value {
+			params[key] = values[0]
+		}
+
+		for key, headers := range r.MultipartForm.File {
+			file, err := headers[0].Open()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			data, err := io.ReadAll(file)
+			file.Close()
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			files[key] = File{Name: headers[0].Filename, Data: data}
+		}
+
+		return params, files, nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	for key, value := range raw {
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			params[key] = text
+		} else {
+			params[key] = string(value)
+		}
+	}
+
+	return params, files, nil
+}
+
+// Serves Bot API requests and file downloads
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if path, ok := strings.CutPrefix(r.URL.Path, "/file/bot"+Token+"/"); ok {
+		server.mutex.Lock()
+		stored, found := server.byPath[path]
+		server.mutex.Unlock()
+
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write(stored.data)
+		return
+	}
+
+	method, ok := strings.CutPrefix(r.URL.Path, "/bot"+Token+"/")
+	if !ok {
+		writeFailure(w, Failure{Code: http.StatusUnauthorized, Description: "Unauthorized"})
+		return
+	}
+
+	params, files, err := parseRequest(r)
+	if err != nil {
+		writeFailure(w, Failure{Code: http.StatusBadRequest, Description: "Bad Request: " + err.Error()})
+		return
+	}
+
+	if method == "getUpdates" {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "result": server.getUpdates(r.Context(), params)})
+		return
+	}
+
+	request := Request{Method: method, Params: params, Files: files}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	var result any
+	failure, failed := server.takeFailure(method)
+
+	if !failed {
+		result, failure, failed = server.handle(&request)
+	}
+
+	server.requests = append(server.requests, request)
+	server.notify()
+
+	if failed {
+		writeFailure(w, failure)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true, "result": result})
+}
+
+// Returns the next failure queued for a method, if any. Must hold the mutex.
+func (server *Server) takeFailure(method string) (Failure, bool) {
+	queued := server.failures[method]
+	if len(queued) == 0 {
+		return Failure{}, false
+	}
+
+	server.failures[method] = queued[1:]
+	return queued[0], true
+}
+
+// Returns the updates from offset on, waiting for some if there are none yet
+func (server *Server) getUpdates(ctx context.Context, params map[string]string) []tb.Update {
+	offset, _ := strconv.Atoi(params["offset"])
+	timeout, _ := strconv.Atoi(params["timeout"])
+
+	wait := time.Duration(timeout) * time.Second
+	if wait < minPollWait {
+		wait = minPollWait
+	}
+
+	deadline := time.After(wait)
+
+	for {
+		server.mutex.Lock()
+		changed := server.changed
+
+		pending := []tb.Update{}
+		for _, update := range server.updates {
+			if update.ID >= offset {
+				pending = append(pending, update)
+			}
+		}
+
+		server.mutex.Unlock()
+
+		if len(pending) != 0 {
+			return pending
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return pending
+		case <-ctx.Done():
+			return pending
+		case <-server.closed:
+			return pending
+		}
+	}
+}
+
+// Handles a request, returning its result. Must hold the mutex.
+func (server *Server) handle(request *Request) (any, Failure, bool) {
+	params := request.Params
+
+	switch request.Method {
+	case "getMe":
+		return server.bot, Failure{}, false
+
+	case "getFile":
+		stored, ok := server.files[params["file_id"]]
+		if !ok {
+			return nil, Failure{Code: http.StatusBadRequest, Description: "Bad Request: invalid file_id"}, true
+		}
+
+		return stored.file, Failure{}, false
+
+	case "sendMessage":
+		message, failure, failed := server.newMessage(params)
+		if failed {
+			return nil, failure, true
+		}
+
+		message.Text = params["text"]
+		request.Message = message
+		return message, Failure{}, false
+
+	case "sendDocument", "sendPhoto":
+		kind := strings.ToLower(strings.TrimPrefix(request.Method, "send"))
+
+		file, failure, failed := server.mediaFile(request, kind, params[kind])
+		if failed {
+			return nil, failure, true
+		}
+
+		message, failure, failed := server.newMessage(params)
+		if failed {
+			return nil, failure, true
+		}
+
+		message.Caption = params["caption"]
+		setMedia(message, kind, file, request.Files[kind].Name)
+
+		request.Message = message
+		return message, Failure{}, false
+
+	case "editMessageText", "editMessageCaption", "editMessageReplyMarkup", "editMessageMedia":
+		return server.editMessage(request)
+
+	case "answerCallbackQuery":
+		return true, Failure{}, false
+
+	default:
+		return nil, Failure{Code: http.StatusNotFound, Description: "Not Found"}, true
+	}
+}
+
+// Returns the file sent in a field: either uploaded, or referenced by its ID. Must hold the mutex.
+func (server *Server) mediaFile(request *Request, field string, reference string) (tb.File, Failure, bool) {
+	if reference, ok := strings.CutPrefix(reference, "attach://"); ok {
+		field = reference
+	}
+
+	if upload, ok := request.Files[field]; ok {
+		extension := "bin"
+		if dot := strings.LastIndex(upload.Name, "."); dot != -1 {
+			extension = upload.Name[dot+1:]
+		}
+
+		return server.storeFile(upload.Data, extension), Failure{}, false
+	}
+
+	if stored, ok := server.files[reference]; ok {
+		return stored.file, Failure{}, false
+	}
+
+	return tb.File{}, Failure{Code: http.StatusBadRequest, Description: "Bad Request: wrong file identifier/HTTP URL specified"}, true
+}
+
+// Sets the media of a message
+func setMedia(message *tb.Message, kind string, file tb.File, name string) {
+	message.Photo, message.Document = nil, nil
+
+	if kind == "photo" {
+		message.Photo = &tb.Photo{File: file}
+	} else {
+		message.Document = &tb.Document{File: file, FileName: name}
+	}
+}
+
+// Decodes the reply markup of a request, if any
+func replyMarkup(params map[string]string) (*tb.ReplyMarkup, Failure, bool) {
+	if params["reply_markup"] == "" {
+		return nil, Failure{}, false
+	}
+
+	var markup tb.ReplyMarkup
+	if err := json.Unmarshal([]byte(params["reply_markup"]), &markup); err != nil {
+		return nil, Failure{Code: http.StatusBadRequest, Description: "Bad Request: can't parse reply keyboard markup JSON object"}, true
+	}
+
+	return &markup, Failure{}, false
+}
+
+// Creates a message sent by the bot to the chat of the request. Must hold the mutex.
+func (server *Server) newMessage(params map[string]string) (*tb.Message, Failure, bool) {
+	chatID, err := strconv.ParseInt(params["chat_id"], 10, 64)
+	if err != nil {
+		return nil, Failure{Code: http.StatusBadRequest, Description: "Bad Request: chat not found"}, true
+	}
+
+	markup, failure, failed := replyMarkup(params)
+	if failed {
+		return nil, failure, true
+	}
+
+	bot := server.bot
+	message := &tb.Message{
+		ID:          server.nextID(),
+		Sender:      &bot,
+		Chat:        &tb.Chat{ID: chatID, Type: tb.ChatPrivate},
+		Unixtime:    time.Now().Unix(),
+		ReplyMarkup: markup,
+	}
+
+	server.messages[message.ID] = message
+	server.markups[message.ID] = params["reply_markup"]
+
+	return message, Failure{}, false
+}
+
+// Edits a message of the bot. Must hold the mutex.
+func (server *Server) editMessage(request *Request) (any, Failure, bool) {
+	params := request.Params
+
+	id, _ := strconv.Atoi(params["message_id"])
+	message, ok := server.messages[id]
+
+	if !ok || strconv.FormatInt(message.Chat.ID, 10) != params["chat_id"] {
+		return nil, Failure{Code: http.StatusBadRequest, Description: "Bad Request: message to edit not found"}, true
+	}
+
+	markup, failure, failed := replyMarkup(params)
+	if failed {
+		return nil, failure, true
+	}
+
+	edited := *message
+
+	switch request.Method {
+	case "editMessageText":
+		edited.Text = params["text"]
+	case "editMessageCaption":
+		edited.Caption = params["caption"]
+	case "editMessageMedia":
+		var media struct {
+			Type    string `json:"type"`
+			Media   string `json:"media"`
+			Caption string `json:"caption"`
+		}
+
+		if err := json.Unmarshal([]byte(params["media"]), &media); err != nil {
+			return nil, Failure{Code: http.StatusBadRequest, Description: "Bad Request: can't parse InputMedia"}, true
+		}
+
+		file, failure, failed := server.mediaFile(request, media.Type, media.Media)
+		if failed {
+			return nil, failure, true
+		}
+
+		edited.Caption = media.Caption
+		setMedia(&edited, media.Type, file, "")
+	}
+
+	// Like the real API, edits that change nothing are refused
+	if request.Method != "editMessageMedia" && edited.Text == message.Text && edited.Caption == message.Caption &&
+		params["reply_markup"] == server.markups[id] {
+		return nil, Failure{Code: http.StatusBadRequest, Description: tb.ErrSameMessageContent.Description}, true
+	}
+
+	edited.ReplyMarkup = markup
+	server.markups[id] = params["reply_markup"]
+	server.messages[id] = &edited
+
+	request.Message = &edited
+	return &edited, Failure{}, false
+}
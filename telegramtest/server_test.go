@@ -0,0 +1,176 @@
+package telegramtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Creates a bot talking to a fake server
+func newBot(t *testing.T) (*tb.Bot, *Server) {
+	server := NewServer()
+	t.Cleanup(server.Close)
+
+	bot, err := tb.NewBot(tb.Settings{
+		URL:         server.URL,
+		Token:       Token,
+		Synchronous: true,
+	})
+
+	if err != nil {
+		t.Fatalf("Creating bot failed: %s", err)
+	}
+
+	return bot, server
+}
+
+func TestSendAndEdit(t *testing.T) {
+	bot, server := newBot(t)
+	user := tb.User{ID: 42, FirstName: "Test"}
+
+	markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{{Text: "Refresh", Data: "refresh"}}}}
+	sent, err := bot.Send(&user, "Hello", &tb.SendOptions{ReplyMarkup: markup})
+
+	if err != nil {
+		t.Fatalf("Sending message failed: %s", err)
+	}
+
+	request, err := server.Wait("sendMessage", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request.Params["text"] != "Hello" || request.Message.ID != sent.ID {
+		t.Errorf("Expected the sent message to be recorded, got %+v", request)
+	}
+
+	if sent.ReplyMarkup == nil || sent.ReplyMarkup.InlineKeyboard[0][0].Data != "refresh" {
+		t.Errorf("Expected the keyboard to be returned, got %+v", sent.ReplyMarkup)
+	}
+
+	if _, err := bot.Edit(sent, "Hello again"); err != nil {
+		t.Fatalf("Editing message failed: %s", err)
+	}
+
+	// Edits that change nothing are refused, like by the real API
+	if _, err := bot.Edit(sent, "Hello again"); !errors.Is(err, tb.ErrSameMessageContent) {
+		t.Errorf("Expected a no-op edit to fail, got %v", err)
+	}
+
+	doc := &tb.Document{File: tb.FromReader(bytes.NewReader([]byte("image"))), FileName: "image.png", Caption: "Done"}
+	sent, err = bot.Send(&user, doc)
+
+	if err != nil {
+		t.Fatalf("Sending document failed: %s", err)
+	}
+
+	request, err = server.Wait("sendDocument", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(request.Files["document"].Data) != "image" || request.Params["caption"] != "Done" {
+		t.Errorf("Expected the uploaded document to be recorded, got %+v", request)
+	}
+
+	// The uploaded file can be sent again by its ID
+	if _, err := bot.Send(&user, &tb.Document{File: tb.File{FileID: sent.Document.FileID}}); err != nil {
+		t.Errorf("Resending document failed: %s", err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	bot, server := newBot(t)
+	user := tb.User{ID: 42}
+
+	server.FailNext("sendMessage", TooManyRequests(5), Failure{Code: 403, Description: "Forbidden: bot was blocked by the user"})
+
+	var flood tb.FloodError
+	if _, err := bot.Send(&user, "Hello"); !errors.As(err, &flood) || flood.RetryAfter != 5 {
+		t.Errorf("Expected a flood error, got %v", err)
+	}
+
+	if _, err := bot.Send(&user, "Hello"); !errors.Is(err, tb.ErrBlockedByUser) {
+		t.Errorf("Expected the bot to be blocked, got %v", err)
+	}
+
+	if _, err := bot.Send(&user, "Hello"); err != nil {
+		t.Errorf("Expected failures to be used up, got %v", err)
+	}
+
+	if n := len(server.Requests("sendMessage")); n != 3 {
+		t.Errorf("Expected failed requests to be recorded, got %d", n)
+	}
+}
+
+func TestUpdatesAndDownloads(t *testing.T) {
+	bot, server := newBot(t)
+	user := tb.User{ID: 42, FirstName: "Test"}
+
+	var received *tb.Message
+	bot.Handle(tb.OnDocument, func(c tb.Context) error {
+		received = c.Message()
+		return nil
+	})
+
+	// The bot is synchronous, so the update is handled once sent
+	server.Attach(bot)
+	server.SendDocument(user, []byte("contents"), "notes.txt", "text/plain")
+
+	if received == nil {
+		t.Fatal("Expected the update to be received")
+	}
+
+	reader, err := bot.File(&received.Document.File)
+	if err != nil {
+		t.Fatalf("Downloading file failed: %s", err)
+	}
+
+	defer reader.Close()
+
+	if data, _ := io.ReadAll(reader); string(data) != "contents" {
+		t.Errorf("Expected the file's contents, got %q", data)
+	}
+
+	if _, err := bot.FileByID("file-unknown"); err == nil {
+		t.Errorf("Expected unknown files to fail")
+	}
+}
+
+func TestGetUpdates(t *testing.T) {
+	bot, server := newBot(t)
+	user := tb.User{ID: 42, FirstName: "Test"}
+
+	// Without an attached bot, updates wait for getUpdates
+	sent := server.SendText(user, "/help")
+
+	data, err := bot.Raw("getUpdates", map[string]string{"offset": "0", "timeout": "0"})
+	if err != nil {
+		t.Fatalf("Getting updates failed: %s", err)
+	}
+
+	var response struct {
+		Result []tb.Update
+	}
+
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Decoding updates failed: %s", err)
+	}
+
+	if len(response.Result) != 1 || response.Result[0].Message.Text != "/help" || response.Result[0].Message.ID != sent.ID {
+		t.Fatalf("Expected the sent message as the only update, got %+v", response.Result)
+	}
+
+	// Acknowledged updates aren't returned again
+	offset := strconv.Itoa(response.Result[0].ID + 1)
+	if data, err := bot.Raw("getUpdates", map[string]string{"offset": offset, "timeout": "0"}); err != nil || strings.Contains(string(data), "/help") {
+		t.Errorf("Expected no more updates, got %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,140 @@
+package telegramtest
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"strings"
+	"time"
+
+	// Read the dimensions of sent photos
+	_ "image/jpeg"
+	_ "image/png"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// Hands updates straight to the bot's ProcessUpdate as they are sent, instead of queueing
+// them for getUpdates. telebot's Start and Stop write fields its API calls read without
+// synchronization, so tests run under -race attach the bot instead of starting a poller;
+// with tb.Settings.Synchronous, sending an update returns once the bot has handled it.
+func (server *Server) Attach(bot *tb.Bot) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.attached = bot
+}
+
+// Sends an update to the bot, giving it an ID. It's queued for the bot's next getUpdates,
+// or handled right away if the bot is attached.
+func (server *Server) SendUpdate(update tb.Update) tb.Update {
+	server.mutex.Lock()
+	update.ID = server.nextID()
+	bot := server.attached
+
+	if bot == nil {
+		server.updates = append(server.updates, update)
+		server.notify()
+	}
+
+	server.mutex.Unlock()
+
+	// The bot calls the server while handling the update, so the lock can't be held
+	if bot != nil {
+		bot.ProcessUpdate(update)
+	}
+
+	return update
+}
+
+// Stores a file the bot can download, as if a user had sent it, returning it as getFile would
+func (server *Server) AddFile(data []byte, extension string) tb.File {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.storeFile(data, extension)
+}
+
+// Creates a message from a user to the bot, in their private chat
+func (server *Server) userMessage(from tb.User) *tb.Message {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	message := &tb.Message{
+		ID:       server.nextID(),
+		Sender:   &from,
+		Chat:     &tb.Chat{ID: from.ID, Type: tb.ChatPrivate, FirstName: from.FirstName, Username: from.Username},
+		Unixtime: time.Now().Unix(),
+	}
+
+	server.messages[message.ID] = message
+	return message
+}
+
+// Sends a text message from a user to the bot. Commands, e.g. "/help", are marked as such.
+func (server *Server) SendText(from tb.User, text string) *tb.Message {
+	message := server.userMessage(from)
+	message.Text = text
+
+	if strings.HasPrefix(text, "/") {
+		command, _, _ := strings.Cut(text, " ")
+		message.Entities = tb.Entities{{Type: tb.EntityCommand, Offset: 0, Length: len(command)}}
+	}
+
+	server.SendUpdate(tb.Update{Message: message})
+	return message
+}
+
+// Sends a photo from a user to the bot. Its dimensions are read from data, if it's a PNG or JPEG.
+func (server *Server) SendPhoto(from tb.User, data []byte) *tb.Message {
+	photo := &tb.Photo{File: server.AddFile(data, "jpg")}
+
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		photo.Width, photo.Height = config.Width, config.Height
+	}
+
+	message := server.userMessage(from)
+	message.Photo = photo
+
+	server.SendUpdate(tb.Update{Message: message})
+	return message
+}
+
+// Sends a file from a user to the bot
+func (server *Server) SendDocument(from tb.User, data []byte, name string, mime string) *tb.Message {
+	extension := "bin"
+	if dot := strings.LastIndex(name, "."); dot != -1 {
+		extension = name[dot+1:]
+	}
+
+	message := server.userMessage(from)
+	message.Document = &tb.Document{File: server.AddFile(data, extension), FileName: name, MIME: mime}
+
+	server.SendUpdate(tb.Update{Message: message})
+	return message
+}
+
+// Sends the media of an earlier message again, e.g. a forwarded photo or a popular sticker. As on
+// Telegram, the files keep their file ID and unique ID.
+func (server *Server) SendAgain(from tb.User, original *tb.Message) *tb.Message {
+	message := server.userMessage(from)
+	message.Photo, message.Document, message.Sticker = original.Photo, original.Document, original.Sticker
+
+	server.SendUpdate(tb.Update{Message: message})
+	return message
+}
+
+// Presses an inline button of a message, sending its callback data to the bot
+func (server *Server) PressButton(from tb.User, message *tb.Message, data string) *tb.Callback {
+	server.mutex.Lock()
+	callback := &tb.Callback{
+		ID:      fmt.Sprintf("callback-%d", server.nextID()),
+		Sender:  &from,
+		Message: message,
+		Data:    data,
+	}
+	server.mutex.Unlock()
+
+	server.SendUpdate(tb.Update{Callback: callback})
+	return callback
+}
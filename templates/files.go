@@ -0,0 +1,218 @@
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/spam"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Default templates, one folder per language, e.g. defaults/en/help.tmpl
+//
+//go:embed defaults
+var defaults embed.FS
+
+// Extension of template files
+const templateExt = ".tmpl"
+
+// Templates of each language, keyed by language code
+type templateSet map[string]*template.Template
+
+// The embedded templates, used as a fallback if an edited template fails to render
+var defaultSet = mustParseDefaults()
+
+// The templates in use: the embedded ones, with the operator's edits on top
+var active atomic.Pointer[templateSet]
+
+func init() {
+	active.Store(&defaultSet)
+}
+
+// Data each template is validated with, covering its branches
+var samples = map[string][]any{
+	"help": {
+		HelpData{Tier: spam.DefaultTier, Limits: spam.DefaultTiers()[spam.DefaultTier], Conversions: 2},
+	},
+	"caption": {
+		CaptionData{Mode: "sticker", Width: 512, Height: 384, Format: "png", Upscaled: true, CompressionFailed: true},
+		CaptionData{Mode: "emoji", Width: 100, Height: 100, Format: "webp", Upscaled: true, Distorted: true},
+		CaptionData{Mode: "emoji", Width: 100, Height: 100, Format: "png", Short: true, Distorted: true},
+	},
+	"ratelimited": {
+		RatelimitedData{Permanent: true, Manual: true},
+		RatelimitedData{Manual: true, Until: time.Now().Add(24 * time.Hour)},
+		RatelimitedData{Limits: spam.DefaultTiers()[spam.DefaultTier], Until: time.Now().Add(time.Hour)},
+	},
+}
+
+// Functions available to the templates of a language
+func templateFuncs(loc *locale.Localizer) template.FuncMap {
+	return template.FuncMap{
+		"t":        func(key string) string { return loc.Text(key, nil) },
+		"plural":   func(key string, n int) string { return loc.Plural(key, n, nil) },
+		"relative": loc.RelativeTime,
+		"limits":   func(tier spam.Tier) string { return TierLimits(loc, tier) },
+		"escape":   EscapeMarkdown,
+		"upper":    strings.ToUpper,
+	}
+}
+
+// Parses the templates of every language, preferring the files in dir over the
+// embedded defaults. An empty dir only parses the defaults.
+func parseTemplates(dir string) (templateSet, int, error) {
+	set := make(templateSet)
+	overrides := 0
+	errs := []error{}
+
+	for _, language := range locale.Languages() {
+		tmpl := template.New(language).Funcs(templateFuncs(locale.For(language))).Option("missingkey=error")
+
+		for name := range samples {
+			file := name + templateExt
+
+			text, err := defaults.ReadFile(path.Join("defaults", language, file))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("no default %s template for %s: %w", name, language, err))
+				continue
+			}
+
+			if dir != "" {
+				edited, err := os.ReadFile(filepath.Join(dir, language, file))
+				if err == nil {
+					text = edited
+					overrides++
+				} else if !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+			}
+
+			if _, err := tmpl.New(name).Parse(string(text)); err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: %w", language, file, err))
+			}
+		}
+
+		set[language] = tmpl
+	}
+
+	return set, overrides, errors.Join(errs...)
+}
+
+// Checks that every template of every language renders with the sample data
+func (set templateSet) validate() error {
+	errs := []error{}
+
+	for language, tmpl := range set {
+		for name, data := range samples {
+			for _, sample := range data {
+				if err := tmpl.ExecuteTemplate(&bytes.Buffer{}, name, sample); err != nil {
+					errs = append(errs, fmt.Errorf("%s/%s%s: %w", language, name, templateExt, err))
+					break
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Parses the embedded templates. They are compiled in, so a broken template is a bug.
+func mustParseDefaults() templateSet {
+	set, _, err := parseTemplates("")
+	if err == nil {
+		err = set.validate()
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
+	return set
+}
+
+// Checks that the files in dir only override known templates of translated languages
+func checkTemplateDir(dir string) error {
+	languages, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, language := range languages {
+		if !language.IsDir() || !locale.Has(language.Name()) {
+			errs = append(errs, fmt.Errorf("%s: not a folder of a translated language", language.Name()))
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(dir, language.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, file := range files {
+			if _, known := samples[strings.TrimSuffix(file.Name(), templateExt)]; !known || path.Ext(file.Name()) != templateExt {
+				errs = append(errs, fmt.Errorf("%s/%s: unknown template", language.Name(), file.Name()))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Loads the templates edited by the operator from dir, e.g. dir/en/help.tmpl, on top
+// of the embedded defaults. Every template is validated: on error, the templates in
+// use are kept.
+func Load(dir string) error {
+	if err := checkTemplateDir(dir); err != nil {
+		return err
+	}
+
+	set, overrides, err := parseTemplates(dir)
+	if err == nil {
+		err = set.validate()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	active.Store(&set)
+
+	if overrides != 0 {
+		log.Info().Msgf("📝 Loaded %d edited template(s) from %s", overrides, dir)
+	}
+
+	return nil
+}
+
+// Renders a template in the localizer's language. Leading and trailing whitespace is
+// trimmed. If an edited template fails to render, the default one is used instead.
+func render(loc *locale.Localizer, name string, data any) string {
+	var buf bytes.Buffer
+
+	err := (*active.Load())[loc.Language].ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		log.Error().Err(err).Msgf("⚠️ Rendering template %s/%s failed, using the default", loc.Language, name)
+
+		buf.Reset()
+		if err = defaultSet[loc.Language].ExecuteTemplate(&buf, name, data); err != nil {
+			log.Error().Err(err).Msgf("⚠️ Rendering default template %s/%s failed", loc.Language, name)
+		}
+	}
+
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,12 @@
+package templates
+
+import "strings"
+
+// Escapes the characters that start an entity in Telegram's (legacy) Markdown, so that
+// values such as tier names can't break the formatting of a message
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+// Escapes text for use in a Markdown message
+func EscapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
@@ -1,33 +1,153 @@
 package templates
 
 import (
-	"fmt"
+	"errors"
+	"strings"
 	"time"
 
+	"tg-resize-sticker-images/admission"
+	"tg-resize-sticker-images/locale"
+	"tg-resize-sticker-images/prefs"
 	"tg-resize-sticker-images/spam"
 
-	"github.com/dustin/go-humanize"
-	"github.com/dustin/go-humanize/english"
 	tb "gopkg.in/telebot.v3"
 )
 
+// Data of the /help message
+type HelpData struct {
+	Tier        string    // Name of the user's tier
+	Limits      spam.Tier // Conversion limits of the tier
+	Conversions int       // Conversions during the trailing hour
+}
+
+// Data of the caption of a converted image
+type CaptionData struct {
+	Mode              string // "sticker" or "emoji"
+	Width             int    // Width of the image in pixels
+	Height            int    // Height of the image in pixels
+	Format            string // Output format, e.g. "png"
+	Short             bool   // Has the user chosen short captions?
+	Upscaled          bool   // Was the image enlarged? False if the user hides warnings.
+	Distorted         bool   // Was the aspect ratio changed? False if the user hides warnings.
+	CompressionFailed bool   // Is the image too large to be used? Always shown.
+}
+
+// Data of the message for rate-limited or banned users
+type RatelimitedData struct {
+	Permanent bool      // Is the user banned until unbanned?
+	Manual    bool      // Was the ban set by an admin?
+	Until     time.Time // When the ban or rate-limit ends
+	Limits    spam.Tier // Conversion limits of the user's tier
+}
+
 // Response to the /help command
-func HelpMessage(message *tb.Message, spam *spam.AntiSpam) string {
-	return fmt.Sprintf(
-		"🖼 Hi there! To use the bot, simply send your image to this chat. "+
-			"Supported file-formats are `jpg`, `png`, and `webp`.\n\n"+
-			"🖌️ The bot can also copy stickers from other packs. Just send any non-animated sticker, and it will be extracted!\n\n"+
-			"*Note:* you can convert up to %d images per hour. You have done %s during the last hour. ",
+func HelpMessage(loc *locale.Localizer, message *tb.Message, spam *spam.AntiSpam) string {
+	tierName, tier := spam.TierOf(message.Sender.ID)
+
+	return render(loc, "help", HelpData{
+		Tier:        tierName,
+		Limits:      tier,
+		Conversions: spam.ConversionCount(message.Sender.ID),
+	})
+}
+
+// Caption of a converted image
+func CaptionMessage(loc *locale.Localizer, data CaptionData) string {
+	return render(loc, "caption", data)
+}
+
+// Describes the tier's limits, e.g. "100 images per hour, 500 per day"
+func TierLimits(loc *locale.Localizer, tier spam.Tier) string {
+	limits := []string{}
+
+	windows := []struct {
+		limit int64
+		unit  string
+	}{
+		{tier.BatchSize, "minute"},
+		{tier.HourlyLimit, "hour"},
+		{tier.DailyLimit, "day"},
+	}
+
+	for _, window := range windows {
+		if window.limit == 0 {
+			continue
+		}
 
-		spam.Rules["ConversionsPerHour"],
-		english.Plural(spam.ChatConversionLog[message.Sender.ID].ConversionCount, "conversion", ""),
-	)
+		if len(limits) == 0 {
+			limits = append(limits, loc.Plural("limits.first."+window.unit, int(window.limit), nil))
+		} else {
+			limits = append(limits, loc.Text("limits.more."+window.unit, locale.Args{"n": window.limit}))
+		}
+	}
+
+	if len(limits) == 0 {
+		return loc.Text("limits.unlimited", nil)
+	}
+
+	return strings.Join(limits, loc.Text("limits.separator", nil))
 }
 
 // Construct the message for rate-limited chats.
-func RatelimitedMessage(spam *spam.AntiSpam, chat int64) string {
-	return fmt.Sprintf(
-		"🚦 *Slow down!* You're allowed to convert %d images per hour. %s %s.",
-		spam.Rules["ConversionsPerHour"], "You can convert images again in",
-		humanize.Time(time.Unix(int64(spam.ChatBannedUntilTimestamp[chat]), 0)))
+func RatelimitedMessage(loc *locale.Localizer, aspam *spam.AntiSpam, chat int64) string {
+	_, _, until, manual := aspam.ChatStatus(chat)
+	_, tier := aspam.TierOf(chat)
+
+	return render(loc, "ratelimited", RatelimitedData{
+		Permanent: until == spam.PermanentBan,
+		Manual:    manual,
+		Until:     time.Unix(until, 0),
+		Limits:    tier,
+	})
+}
+
+// Construct the message for conversions refused by the admission controller
+func RefusedMessage(loc *locale.Localizer, err error, maintenance admission.Maintenance) string {
+	if errors.Is(err, admission.ErrMaintenance) {
+		// The notice is written by an admin, and isn't translated
+		if maintenance.Message != "" {
+			return "🛠 " + maintenance.Message
+		}
+
+		return loc.Text("refused.maintenance", nil)
+	}
+
+	return loc.Text("refused.overloaded", nil)
+}
+
+// Construct the /settings menu text, describing the user's current preferences.
+// The language code is the one of the user's Telegram client.
+func SettingsMessage(loc *locale.Localizer, userPrefs prefs.Preferences, languageCode string) string {
+	mode := loc.Text("settings.mode.sticker", nil)
+	if userPrefs.InEmojiMode {
+		mode = loc.Text("settings.mode.emoji", nil)
+	}
+
+	onOff := func(on bool) string {
+		if on {
+			return loc.Text("settings.on", nil)
+		}
+		return loc.Text("settings.off", nil)
+	}
+
+	captions := loc.Text("settings.captions.full", nil)
+	if userPrefs.ShortCaptions {
+		captions = loc.Text("settings.captions.short", nil)
+	}
+
+	language := loc.Text("language.name", nil)
+	if userPrefs.Language == "" {
+		language = loc.Text("settings.language.auto", locale.Args{
+			"language": locale.For(languageCode).Text("language.name", nil),
+		})
+	}
+
+	return loc.Text("settings", locale.Args{
+		"mode":     mode,
+		"format":   strings.ToUpper(userPrefs.OutputFormat()),
+		"fit":      loc.Text("settings.fit."+userPrefs.FitStrategy(), nil),
+		"warnings": onOff(!userPrefs.HideWarnings),
+		"captions": captions,
+		"language": language,
+	})
 }
@@ -0,0 +1,90 @@
+package templates
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tg-resize-sticker-images/locale"
+)
+
+// Writes an edited template to dir
+func writeTemplate(t *testing.T, dir string, language string, name string, text string) {
+	if err := os.MkdirAll(filepath.Join(dir, language), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, language, name+templateExt), []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultsInEveryLocale(t *testing.T) {
+	for _, language := range locale.Languages() {
+		for name := range samples {
+			if defaultSet[language].Lookup(name) == nil {
+				t.Errorf("%s: missing default %s template", language, name)
+			}
+		}
+	}
+}
+
+func TestEditedTemplates(t *testing.T) {
+	t.Cleanup(func() { active.Store(&defaultSet) })
+
+	dir := t.TempDir()
+	writeTemplate(t, dir, "en", "caption", "Done: {{ .Width }}x{{ .Height }}")
+
+	if err := Load(dir); err != nil {
+		t.Fatalf("Error loading templates: %s", err)
+	}
+
+	loc := locale.For("en")
+	if caption := CaptionMessage(loc, CaptionData{Width: 512, Height: 512}); caption != "Done: 512x512" {
+		t.Errorf("Expected the edited template to be used, got %q", caption)
+	}
+
+	// Other languages keep their defaults
+	if caption := CaptionMessage(locale.For("de"), CaptionData{Mode: "sticker", Width: 512, Height: 512}); !strings.Contains(caption, "Sticker") {
+		t.Errorf("Expected the default German template to be used, got %q", caption)
+	}
+}
+
+func TestInvalidTemplatesFailFast(t *testing.T) {
+	t.Cleanup(func() { active.Store(&defaultSet) })
+
+	broken := map[string]string{
+		"syntax":        "{{ if .Short }}",
+		"unknown field": "{{ .Pixels }}",
+		"unknown func":  "{{ shout .Mode }}",
+	}
+
+	for problem, text := range broken {
+		dir := t.TempDir()
+		writeTemplate(t, dir, "en", "caption", text)
+
+		if err := Load(dir); err == nil {
+			t.Errorf("Expected a template with an %s to be rejected", problem)
+		}
+	}
+
+	// Typos in file names are reported instead of silently ignored
+	dir := t.TempDir()
+	writeTemplate(t, dir, "en", "helpp", "Hi")
+
+	if err := Load(dir); err == nil {
+		t.Errorf("Expected an unknown template to be rejected")
+	}
+
+	// The templates in use are kept
+	if caption := CaptionMessage(locale.For("en"), CaptionData{Mode: "sticker", Width: 1, Height: 1}); !strings.Contains(caption, "sticker-ready") {
+		t.Errorf("Expected the default template to be kept, got %q", caption)
+	}
+}
+
+func TestEscapeMarkdown(t *testing.T) {
+	if escaped := EscapeMarkdown("power_user *vip* [`x`]"); escaped != "power\\_user \\*vip\\* \\[\\`x\\`]" {
+		t.Errorf("Unexpected escaped text %q", escaped)
+	}
+}